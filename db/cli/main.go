@@ -0,0 +1,135 @@
+// Command gopicosql-cli is an interactive SQL shell for gopicosql servers.
+//
+// Usage:
+//
+//	gopicosql-cli [-c SQL] [-f FILE] [DSN]
+//
+// The DSN defaults to http://localhost:8080 and may name the REST API
+// (http://, https://), the gRPC API (grpc://, grpcs://) or an in-process
+// engine (mem://name). Credentials are
+// given as http://user@host:port, the password is then asked for, or as
+// http://host:port?api_key=KEY.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+const defaultDsn = "http://localhost:8080"
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-c SQL] [-f FILE] [DSN]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	command := flag.String("c", "", "run the given statements and exit")
+	file := flag.String("f", "", "run the statements from the given file and exit")
+	timing := flag.Bool("timing", false, "print how long statements take")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+	dsn := defaultDsn
+	if flag.NArg() == 1 {
+		dsn = flag.Arg(0)
+	}
+
+	interactive := *command == "" && *file == "" && readline.IsTerminal(int(os.Stdin.Fd()))
+	if err := run(dsn, *command, *file, *timing, interactive); err != nil {
+		if err != errQuit {
+			os.Exit(1)
+		}
+	}
+}
+
+func run(dsn, command, file string, timing, interactive bool) error {
+	u, err := parseDsn(dsn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	if password, _ := u.User.Password(); u.User.Username() != "" && password == "" && readline.IsTerminal(int(os.Stdin.Fd())) {
+		password, err := readline.Password("Password: ")
+		if err != nil {
+			return err
+		}
+		u.User = url.UserPassword(u.User.Username(), string(password))
+	}
+	b, err := newBackend(u)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	defer b.close()
+
+	sh := &shell{b: b, out: os.Stdout, errOut: os.Stderr, timing: timing}
+	switch {
+	case command != "":
+		return sh.runScript(strings.NewReader(command))
+	case file != "":
+		f, err := os.Open(file)
+		if err != nil {
+			return sh.fail(err)
+		}
+		defer f.Close()
+		return sh.runScript(f)
+	case !interactive:
+		return sh.runScript(os.Stdin)
+	default:
+		return repl(sh)
+	}
+}
+
+// historyFile returns where the history of the interactive shell is kept.
+func historyFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gopicosql_history")
+}
+
+// repl reads lines with line editing and history until \q or EOF. Ctrl-C
+// discards the statement entered so far.
+func repl(sh *shell) error {
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:          sh.prompt(),
+		HistoryFile:     historyFile(),
+		InterruptPrompt: "^C",
+	})
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+	sh.out, sh.errOut = rl.Stdout(), rl.Stderr()
+	fmt.Fprintln(sh.out, `Type \? for help.`)
+
+	for {
+		rl.SetPrompt(sh.prompt())
+		line, err := rl.Readline()
+		switch {
+		case err == readline.ErrInterrupt:
+			sh.reset()
+			continue
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+		// failed statements are reported by the shell
+		if err := sh.feed(line); err == errQuit {
+			return nil
+		}
+	}
+}
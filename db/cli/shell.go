@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopicosql/db/engine"
+)
+
+// errQuit is returned by feed after \q.
+var errQuit = errors.New("quit")
+
+const helpText = `  \dt             list tables
+  \d [TABLE]      describe TABLE or list tables
+  \i FILE         execute statements from FILE
+  \timing [on|off] toggle printing how long statements take
+  \?              show this help
+  \q              quit
+Statements end with ';' and may span several lines.
+`
+
+// shell collects input lines into statements and runs them on a backend.
+type shell struct {
+	b      backend
+	out    io.Writer
+	errOut io.Writer
+	timing bool
+	// pending holds the lines of a statement not terminated with ';' yet
+	pending string
+}
+
+// prompt returns the prompt for the next line, it tells whether a
+// statement is being continued.
+func (sh *shell) prompt() string {
+	if strings.TrimSpace(sh.pending) != "" {
+		return "gopicosql-> "
+	}
+	return "gopicosql=> "
+}
+
+// reset discards the statement entered so far.
+func (sh *shell) reset() {
+	sh.pending = ""
+}
+
+// feed processes one line of input. Meta-commands are run right away,
+// statements once their terminating ';' is read. The error of the first
+// failing statement is returned after it has been reported.
+func (sh *shell) feed(line string) error {
+	if strings.TrimSpace(sh.pending) == "" && strings.HasPrefix(strings.TrimSpace(line), `\`) {
+		sh.pending = ""
+		return sh.meta(strings.Fields(line))
+	}
+	stmts, rest := engine.SplitStatements(sh.pending + line + "\n")
+	sh.pending = rest
+	var first error
+	for _, stmt := range stmts {
+		if err := sh.run(stmt); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// flush runs a statement left without ';' at the end of the input.
+func (sh *shell) flush() error {
+	stmt := strings.TrimSpace(sh.pending)
+	sh.pending = ""
+	if stmt == "" {
+		return nil
+	}
+	return sh.run(stmt)
+}
+
+// runScript runs all statements read from r, it stops at the first
+// failing one.
+func (sh *shell) runScript(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if err := sh.feed(scanner.Text()); err != nil {
+			sh.pending = ""
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return sh.flush()
+}
+
+func (sh *shell) meta(args []string) error {
+	switch {
+	case args[0] == `\q`:
+		return errQuit
+	case args[0] == `\?`:
+		fmt.Fprint(sh.out, helpText)
+		return nil
+	case args[0] == `\dt` || args[0] == `\d` && len(args) == 1:
+		return sh.listTables()
+	case args[0] == `\d` && len(args) == 2:
+		return sh.describe(args[1])
+	case args[0] == `\timing` && len(args) <= 2:
+		switch {
+		case len(args) == 1:
+			sh.timing = !sh.timing
+		case args[1] == "on" || args[1] == "off":
+			sh.timing = args[1] == "on"
+		default:
+			return sh.fail(fmt.Errorf(`\timing expects on or off, got %s`, args[1]))
+		}
+		if sh.timing {
+			fmt.Fprintln(sh.out, "Timing is on.")
+		} else {
+			fmt.Fprintln(sh.out, "Timing is off.")
+		}
+		return nil
+	case args[0] == `\i` && len(args) == 2:
+		f, err := os.Open(args[1])
+		if err != nil {
+			return sh.fail(err)
+		}
+		defer f.Close()
+		return sh.runScript(f)
+	default:
+		return sh.fail(fmt.Errorf(`invalid command %s, try \? for help`, strings.Join(args, " ")))
+	}
+}
+
+// fail reports err and returns it.
+func (sh *shell) fail(err error) error {
+	if e, ok := err.(*engine.Error); ok {
+		fmt.Fprintf(sh.errOut, "ERROR: %s: %s\n", e.Code, e.Msg)
+	} else {
+		fmt.Fprintf(sh.errOut, "ERROR: %s\n", err)
+	}
+	return err
+}
+
+func (sh *shell) run(sql string) error {
+	start := time.Now()
+	res, err := sh.b.query(context.Background(), sql)
+	if err != nil {
+		return sh.fail(err)
+	}
+	engine.WriteTable(sh.out, res)
+	sh.printTiming(start)
+	return nil
+}
+
+func (sh *shell) printTiming(start time.Time) {
+	if sh.timing {
+		fmt.Fprintf(sh.out, "Time: %.3f ms\n", float64(time.Since(start).Microseconds())/1000)
+	}
+}
+
+func (sh *shell) listTables() error {
+	start := time.Now()
+	names, err := sh.b.tables(context.Background())
+	if err != nil {
+		return sh.fail(err)
+	}
+	res := engine.QueryResult{Columns: []engine.Column{{Name: "name", Type: engine.TEXT}}}
+	for _, name := range names {
+		res.Rows = append(res.Rows, engine.Row{Fields: map[string]string{"name": name}})
+	}
+	engine.WriteTable(sh.out, res)
+	sh.printTiming(start)
+	return nil
+}
+
+func (sh *shell) describe(table string) error {
+	start := time.Now()
+	cols, err := sh.b.describe(context.Background(), table)
+	if err != nil {
+		return sh.fail(err)
+	}
+	res := engine.QueryResult{Columns: []engine.Column{{Name: "column", Type: engine.TEXT}, {Name: "type", Type: engine.TEXT}}}
+	for i, col := range cols {
+		typ := col.Type.String()
+		if i == 0 {
+			typ += " (primary key)"
+		}
+		res.Rows = append(res.Rows, engine.Row{Fields: map[string]string{"column": col.Name, "type": typ}})
+	}
+	engine.WriteTable(sh.out, res)
+	sh.printTiming(start)
+	return nil
+}
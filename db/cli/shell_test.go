@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopicosql/db/engine"
+)
+
+// fakeBackend records statements and answers SELECTs with a fixed result.
+type fakeBackend struct {
+	queries []string
+}
+
+func (f *fakeBackend) query(ctx context.Context, sql string) (engine.QueryResult, error) {
+	f.queries = append(f.queries, sql)
+	switch {
+	case strings.HasPrefix(sql, "SELECT"):
+		return engine.QueryResult{
+			Status:  "OK",
+			Columns: []engine.Column{{Name: "id", Type: engine.INT}, {Name: "name", Type: engine.TEXT}},
+			Rows: []engine.Row{
+				{Fields: map[string]string{"id": "7", "name": "alice"}},
+				{Fields: map[string]string{"id": "10"}},
+			},
+		}, nil
+	case strings.HasPrefix(sql, "BAD"):
+		return engine.QueryResult{}, &engine.Error{Code: engine.ErrSyntax, Msg: "syntax error"}
+	default:
+		return engine.QueryResult{Status: "OK", RowsAffected: 1}, nil
+	}
+}
+
+func (f *fakeBackend) tables(ctx context.Context) ([]string, error) {
+	return []string{"t", "users"}, nil
+}
+
+func (f *fakeBackend) describe(ctx context.Context, table string) ([]engine.Column, error) {
+	if table != "t" {
+		return nil, &engine.Error{Code: engine.ErrUndefinedTable, Msg: "table not found"}
+	}
+	return []engine.Column{{Name: "id", Type: engine.INT}, {Name: "name", Type: engine.TEXT}}, nil
+}
+
+func (f *fakeBackend) close() error {
+	return nil
+}
+
+func newTestShell() (*shell, *fakeBackend, *strings.Builder, *strings.Builder) {
+	b := &fakeBackend{}
+	out, errOut := &strings.Builder{}, &strings.Builder{}
+	return &shell{b: b, out: out, errOut: errOut}, b, out, errOut
+}
+
+func TestSqlBackend(t *testing.T) {
+	u, err := parseDsn("mem://cli_test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	b, err := newBackend(u)
+	if err != nil {
+		t.Fatalf("Cannot connect: %s", err)
+	}
+	defer b.close()
+
+	out, errOut := &strings.Builder{}, &strings.Builder{}
+	sh := &shell{b: b, out: out, errOut: errOut}
+	script := "CREATE TABLE t (id INT, name TEXT);\nINSERT INTO t (id, name) VALUES ('1', 'it\\'s; a'), ('10', '');\nSELECT * FROM t;\n\\dt\n\\d t\n"
+	if err := sh.runScript(strings.NewReader(script)); err != nil {
+		t.Fatalf("Unexpected error: %s, output:\n%s", err, errOut.String())
+	}
+	want := "OK, 0 rows affected\nOK, 2 rows affected\n" +
+		" id | name\n----+---------\n  1 | it's; a\n 10 |\n(2 rows)\n" +
+		" name\n------\n t\n(1 row)\n" +
+		" column | type\n--------+-------------------\n id     | INT (primary key)\n name   | TEXT\n(2 rows)\n"
+	if out.String() != want {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+
+	if err := sh.feed("SELECT * FROM nope;"); engine.ErrorCodeOf(err) != engine.ErrUndefinedTable {
+		t.Errorf("Expected an undefined table, got %v", err)
+	}
+}
+
+func TestMultiLineStatements(t *testing.T) {
+	sh, b, out, _ := newTestShell()
+	for _, line := range []string{"SELECT id, name", "FROM t", "WHERE name = 'a;", "b';  INSERT INTO t"} {
+		if err := sh.feed(line); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if sh.prompt() != "gopicosql-> " {
+		t.Errorf("Expected the continuation prompt, got %q", sh.prompt())
+	}
+	sh.feed("VALUES ('1', 'x');")
+	if sh.prompt() != "gopicosql=> " {
+		t.Errorf("Expected the initial prompt, got %q", sh.prompt())
+	}
+
+	want := []string{"SELECT id, name\nFROM t\nWHERE name = 'a;\nb'", "INSERT INTO t\nVALUES ('1', 'x')"}
+	if !reflect.DeepEqual(b.queries, want) {
+		t.Errorf("Expected %q, got %q", want, b.queries)
+	}
+	table := " id | name\n----+-------\n  7 | alice\n 10 |\n(2 rows)\nOK, 1 rows affected\n"
+	if out.String() != table {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
+
+func TestMetaCommands(t *testing.T) {
+	sh, _, out, errOut := newTestShell()
+
+	sh.feed(`\dt`)
+	if want := " name\n-------\n t\n users\n(2 rows)\n"; out.String() != want {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+
+	out.Reset()
+	sh.feed(`\d t`)
+	if want := " column | type\n--------+-------------------\n id     | INT (primary key)\n name   | TEXT\n(2 rows)\n"; out.String() != want {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+
+	if err := sh.feed(`\d nope`); engine.ErrorCodeOf(err) != engine.ErrUndefinedTable {
+		t.Errorf("Expected an undefined table, got %v", err)
+	}
+	if errOut.String() != "ERROR: 42P01: table not found\n" {
+		t.Errorf("Unexpected error output %q", errOut.String())
+	}
+
+	out.Reset()
+	sh.feed(`\timing`)
+	sh.feed("UPDATE t SET name = 'x';")
+	if !strings.HasPrefix(out.String(), "Timing is on.\nOK, 1 rows affected\nTime: ") {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+
+	if err := sh.feed(`\q`); err != errQuit {
+		t.Errorf("Expected to quit, got %v", err)
+	}
+	if err := sh.feed(`\nope`); err == nil {
+		t.Errorf("Expected an invalid command")
+	}
+}
+
+func TestScripts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.sql")
+	script := "INSERT INTO t VALUES ('1');\nUPDATE t\nSET name = 'x'\n"
+	if err := os.WriteFile(path, []byte(script), 0600); err != nil {
+		t.Fatalf("Cannot write script: %s", err)
+	}
+
+	sh, b, _, _ := newTestShell()
+	if err := sh.feed(`\i ` + path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// the last statement runs without ';' at the end of the file
+	want := []string{"INSERT INTO t VALUES ('1')", "UPDATE t\nSET name = 'x'"}
+	if !reflect.DeepEqual(b.queries, want) {
+		t.Errorf("Expected %q, got %q", want, b.queries)
+	}
+
+	sh, b, _, _ = newTestShell()
+	err := sh.runScript(strings.NewReader("INSERT INTO t VALUES ('1'); BAD;\nINSERT INTO t VALUES ('2');"))
+	if engine.ErrorCodeOf(err) != engine.ErrSyntax {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+	if len(b.queries) != 2 {
+		t.Errorf("Expected the script to stop at the error, ran %q", b.queries)
+	}
+}
@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemDriver(t *testing.T) {
+	db, err := sql.Open("gopicosql", fmt.Sprintf("mem://TestMemDriver%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatalf("Cannot open db: %s", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("CREATE TABLE t (id INT, name TEXT, ok BOOL, at DATETIME)"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	at := time.Date(2022, 1, 6, 0, 0, 0, 0, time.UTC)
+	res, err := db.Exec("INSERT INTO t (id, name, ok, at) VALUES (?, ?, ?, ?)", 7, "x'y", true, at)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		t.Errorf("Expected 1 row affected, got %d", n)
+	}
+	res, err = db.Exec("UPDATE t SET ok = 'false' WHERE id = ?", 8)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n, _ := res.RowsAffected(); n != 0 {
+		t.Errorf("Expected no rows affected, got %d", n)
+	}
+
+	var (
+		id   int
+		name string
+		ok   bool
+		ts   time.Time
+	)
+	err = db.QueryRow("SELECT id, name, ok, at FROM t WHERE id = ?", 7).Scan(&id, &name, &ok, &ts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if id != 7 || name != "x'y" || !ok || !ts.Equal(at) {
+		t.Errorf("Unexpected row: %d %s %t %s", id, name, ok, ts)
+	}
+
+	st, err := db.Prepare("SELECT name FROM t WHERE id = $1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer st.Close()
+	if err := st.QueryRow(7).Scan(&name); err != nil || name != "x'y" {
+		t.Errorf("Unexpected result '%s' (%v)", name, err)
+	}
+	if _, err := st.Exec(); err == nil {
+		t.Errorf("Expected an error on missing parameter")
+	}
+
+	if _, err := db.Begin(); err == nil {
+		t.Errorf("Transactions are not expected to be supported")
+	}
+	if _, err := db.Exec("SELECT * FROM missing"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestHttpDriver(t *testing.T) {
+	var got url.Values
+	var user, password string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+		user, password, _ = r.BasicAuth()
+		w.Write([]byte(`{"result": "OK", "error": "",
+			"columns": [{"name": "id", "type": "INT"}, {"name": "name", "type": "TEXT"}],
+			"rows": [{"fields": {"id": "1", "name": "a"}}, {"fields": {"id": "2", "name": "b"}}]}`))
+	}))
+	defer srv.Close()
+
+	db, err := sql.Open("gopicosql", strings.Replace(srv.URL, "://", "://bob:s3cret@", 1))
+	if err != nil {
+		t.Fatalf("Cannot open db: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, name FROM t WHERE name = ? AND id != '?'", "it's")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer rows.Close()
+
+	if user != "bob" || password != "s3cret" {
+		t.Errorf("Unexpected credentials %s:%s", user, password)
+	}
+
+	if exp := "SELECT id, name FROM t WHERE name = ? AND id != '?'"; got.Get("sql") != exp {
+		t.Errorf("Expected query %q, got %q", exp, got.Get("sql"))
+	}
+	if p := got["params"]; len(p) != 1 || p[0] != "it's" {
+		t.Errorf("Unexpected params %v", p)
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("Unexpected ids %v", ids)
+	}
+}
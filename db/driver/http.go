@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopicosql/db/engine"
+)
+
+type httpBackend struct {
+	url    string
+	client *http.Client
+	// user and password are sent as basic credentials unless apiKey is set
+	user   *url.Userinfo
+	apiKey string
+}
+
+func newHttpBackend(dsn string) (*httpBackend, error) {
+	if !strings.Contains(dsn, "://") {
+		dsn = "http://" + dsn
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("gopicosql: invalid DSN: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("gopicosql: unsupported DSN scheme %s", u.Scheme)
+	}
+
+	h := &httpBackend{client: &http.Client{}, user: u.User, apiKey: u.Query().Get("api_key")}
+	u.User = nil
+	u.RawQuery = ""
+	h.url = strings.TrimSuffix(u.String(), "/")
+	return h, nil
+}
+
+type httpResponse struct {
+	Result       string `json:"result"`
+	Error        string `json:"error"`
+	Code         string `json:"code"`
+	Handle       string `json:"handle"`
+	Params       int    `json:"params"`
+	RowsAffected int    `json:"rows_affected"`
+	Columns      []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"columns"`
+	Rows []struct {
+		Fields map[string]string `json:"fields"`
+	} `json:"rows"`
+}
+
+func (h *httpBackend) do(ctx context.Context, method, path string, form url.Values) (*httpResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, h.url+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if h.apiKey != "" {
+		req.Header.Set("X-API-Key", h.apiKey)
+	} else if h.user != nil {
+		password, _ := h.user.Password()
+		req.SetBasicAuth(h.user.Username(), password)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var hr httpResponse
+	if err := json.NewDecoder(resp.Body).Decode(&hr); err != nil {
+		return nil, fmt.Errorf("gopicosql: invalid response (HTTP %d): %s", resp.StatusCode, err)
+	}
+	if hr.Code != "" {
+		msg := hr.Error
+		if msg == "" {
+			msg = hr.Result
+		}
+		return nil, &engine.Error{Code: engine.ErrorCode(hr.Code), Msg: msg}
+	}
+	if hr.Error != "" {
+		return nil, fmt.Errorf("gopicosql: %s: %s", hr.Result, hr.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gopicosql: %s (HTTP %d)", hr.Result, resp.StatusCode)
+	}
+	return &hr, nil
+}
+
+func (h *httpBackend) query(ctx context.Context, sql, handle string, args []interface{}) (engine.QueryResult, error) {
+	form := url.Values{}
+	if handle != "" {
+		form.Set("handle", handle)
+	} else {
+		form.Set("sql", sql)
+	}
+	for i, a := range args {
+		v, err := engine.FormatValue(a)
+		if err != nil {
+			return engine.QueryResult{}, fmt.Errorf("gopicosql: parameter %d: %s", i+1, err)
+		}
+		form.Add("params", v)
+	}
+
+	hr, err := h.do(ctx, http.MethodPost, "/query", form)
+	if err != nil {
+		return engine.QueryResult{}, err
+	}
+
+	res := engine.QueryResult{Status: hr.Result, RowsAffected: hr.RowsAffected}
+	for _, c := range hr.Columns {
+		res.Columns = append(res.Columns, engine.Column{Name: c.Name, Type: engine.ParseFieldType(c.Type)})
+	}
+	for _, r := range hr.Rows {
+		res.Rows = append(res.Rows, engine.Row{Fields: r.Fields})
+	}
+	return res, nil
+}
+
+func (h *httpBackend) prepare(ctx context.Context, sql string) (string, int, error) {
+	hr, err := h.do(ctx, http.MethodPost, "/prepare", url.Values{"sql": {sql}})
+	if err != nil {
+		return "", 0, err
+	}
+	return hr.Handle, hr.Params, nil
+}
+
+func (h *httpBackend) deallocate(ctx context.Context, handle string) error {
+	_, err := h.do(ctx, http.MethodDelete, "/prepare/"+url.PathEscape(handle), url.Values{})
+	return err
+}
+
+func (h *httpBackend) close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,272 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Open creates and starts an in-process database engine.
+// A nil cfg means the default configuration.
+func Open(cfg *Cfg) (*DbEngine, error) {
+	if cfg == nil {
+		cfg = NewConfigDefault()
+	}
+	db, err := NewDbEngine(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db.Start()
+	return db, nil
+}
+
+// Exec runs a statement and waits for its result. Args are bound to '?'
+// placeholders in order or to '$n' placeholders by number.
+func (db *DbEngine) Exec(ctx context.Context, sql string, args ...interface{}) (QueryResult, error) {
+	return db.do(ctx, QueryRequest{Sql: sql, Args: args})
+}
+
+// ExecRequest is Exec for a request that may refer to a prepared statement.
+// Resp and Ctx of req are set by the engine.
+func (db *DbEngine) ExecRequest(ctx context.Context, req QueryRequest) (QueryResult, error) {
+	return db.do(ctx, req)
+}
+
+func (db *DbEngine) do(ctx context.Context, req QueryRequest) (QueryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return QueryResult{}, ctxErr(err)
+	}
+	if req.Resp == nil {
+		req.Resp = make(chan QueryResult, 1)
+	}
+	req.Ctx = ctx
+	if req.User == "" {
+		req.User = UserFrom(ctx)
+	}
+
+	if db.stopped() {
+		return QueryResult{}, errorf(ErrShutdown, "database engine stopped")
+	}
+	select {
+	case db.requests <- req:
+	case <-db.quit:
+		return QueryResult{}, errorf(ErrShutdown, "database engine stopped")
+	case <-ctx.Done():
+		return QueryResult{}, ctxErr(ctx.Err())
+	}
+
+	select {
+	case res := <-req.Resp:
+		return res, res.Err
+	case <-ctx.Done():
+		return QueryResult{}, ctxErr(ctx.Err())
+	}
+}
+
+// Query runs a statement and returns its rows.
+func (db *DbEngine) Query(ctx context.Context, sql string, args ...interface{}) (*Rows, error) {
+	res, err := db.Exec(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return newRows(res), nil
+}
+
+// QueryStream runs a statement and returns its rows as they are produced
+// instead of collecting them first. The table stays read-locked until all
+// rows are read, Rows.Close is called or ctx is done.
+func (db *DbEngine) QueryStream(ctx context.Context, sql string, args ...interface{}) (*Rows, error) {
+	return db.OpenStream(ctx, QueryRequest{Sql: sql, Args: args})
+}
+
+// OpenStream is QueryStream for a request that may refer to a prepared
+// statement. Resp, Rows and Ctx of req are set by the engine.
+func (db *DbEngine) OpenStream(ctx context.Context, req QueryRequest) (*Rows, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req.Rows = make(chan Row, streamBuffer)
+	req.Resp = make(chan QueryResult, 1)
+	res, err := db.do(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Rows{cols: res.Columns, stream: req.Rows, resp: req.Resp, ctx: ctx, cancel: cancel}, nil
+}
+
+func newRows(res QueryResult) *Rows {
+	return &Rows{cols: res.Columns, rows: res.Rows, affected: res.RowsAffected}
+}
+
+// streamBuffer is the number of rows a streaming query produces ahead of
+// the reader.
+const streamBuffer = 64
+
+// Rows is a cursor over the typed result of Query or QueryStream.
+type Rows struct {
+	cols []Column
+	// rows holds the remaining rows of a collected result
+	rows []Row
+	// affected is the number of records changed by the statement
+	affected int
+	// stream delivers the rows of a streamed result, resp the error that
+	// ended it early
+	stream chan Row
+	resp   chan QueryResult
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed bool
+
+	cur   Row
+	valid bool
+	err   error
+}
+
+func (r *Rows) Columns() []Column {
+	return r.cols
+}
+
+// RowsAffected returns the number of records inserted, updated or deleted
+// by the statement.
+func (r *Rows) RowsAffected() int {
+	return r.affected
+}
+
+// Next advances to the next row, it returns false when no rows are left.
+func (r *Rows) Next() bool {
+	r.valid = false
+	if r.err != nil || r.closed {
+		return false
+	}
+
+	if r.stream != nil {
+		row, ok := <-r.stream
+		if !ok {
+			select {
+			case res := <-r.resp:
+				r.err = res.Err
+			default:
+				r.err = ctxErr(r.ctx.Err())
+			}
+			r.cancel()
+			return false
+		}
+		r.cur, r.valid = row, true
+		return true
+	}
+
+	if len(r.rows) == 0 {
+		return false
+	}
+	r.cur, r.rows, r.valid = r.rows[0], r.rows[1:], true
+	return true
+}
+
+// ctxErr reports an expired deadline as a query timeout.
+func ctxErr(err error) error {
+	if err == context.DeadlineExceeded {
+		return errorf(ErrQueryTimeout, "query timeout")
+	}
+	return err
+}
+
+// Row returns the current row as stored in the table.
+func (r *Rows) Row() Row {
+	return r.cur
+}
+
+// Values returns the current row converted according to the column types.
+func (r *Rows) Values() ([]interface{}, error) {
+	if !r.valid {
+		return nil, fmt.Errorf("no current row")
+	}
+	vals := make([]interface{}, len(r.cols))
+	for i, c := range r.cols {
+		v, err := ParseValue(c.Type, r.cur.Fields[c.Name])
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %s", c.Name, err)
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// Scan copies the current row into dest. Supported destinations are
+// *string, *int, *int64, *bool, *time.Time and *interface{}.
+func (r *Rows) Scan(dest ...interface{}) error {
+	if len(dest) != len(r.cols) {
+		return fmt.Errorf("expected %d destinations, got %d", len(r.cols), len(dest))
+	}
+	vals, err := r.Values()
+	if err != nil {
+		r.err = err
+		return err
+	}
+	for i, d := range dest {
+		if err := scanValue(d, vals[i]); err != nil {
+			r.err = fmt.Errorf("column %s: %s", r.cols[i].Name, err)
+			return r.err
+		}
+	}
+	return nil
+}
+
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close releases the rows, a streaming query is stopped.
+func (r *Rows) Close() error {
+	r.closed = true
+	r.valid = false
+	r.rows = nil
+	if r.cancel != nil {
+		r.cancel()
+	}
+	return nil
+}
+
+func scanValue(dest interface{}, v interface{}) error {
+	if d, ok := dest.(*interface{}); ok {
+		*d = v
+		return nil
+	}
+	if v == nil {
+		return fmt.Errorf("cannot scan NULL into %T", dest)
+	}
+
+	switch d := dest.(type) {
+	case *string:
+		switch vv := v.(type) {
+		case string:
+			*d = vv
+		case time.Time:
+			*d = vv.Format(DateTimeLayout)
+		default:
+			*d = fmt.Sprint(vv)
+		}
+		return nil
+	case *int64:
+		if vv, ok := v.(int64); ok {
+			*d = vv
+			return nil
+		}
+	case *int:
+		if vv, ok := v.(int64); ok {
+			*d = int(vv)
+			return nil
+		}
+	case *bool:
+		if vv, ok := v.(bool); ok {
+			*d = vv
+			return nil
+		}
+	case *time.Time:
+		if vv, ok := v.(time.Time); ok {
+			*d = vv
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported destination %T", dest)
+	}
+	return fmt.Errorf("cannot scan %T into %T", v, dest)
+}
@@ -0,0 +1,1155 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestDb(t *testing.T) *DbEngine {
+	db, err := Open(nil)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	t.Cleanup(db.Stop)
+
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, "CREATE TABLE users (id INT, name TEXT, active BOOL, created DATETIME)"); err != nil {
+		t.Fatalf("Cannot create table: %s", err)
+	}
+	return db
+}
+
+func TestExecAndQueryTyped(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+
+	created := time.Date(2022, 1, 6, 12, 30, 0, 0, time.UTC)
+	_, err := db.Exec(ctx, "INSERT INTO users (id, name, active, created) VALUES (?, ?, ?, ?)", 1, "O'Brien", true, created)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = db.Exec(ctx, "INSERT INTO users (id, name, active, created) VALUES ('2', 'it''s me', 'false', '2022-01-07')")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	rows, err := db.Query(ctx, "SELECT id, name, active, created FROM users WHERE id = ?", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer rows.Close()
+
+	cols := rows.Columns()
+	if len(cols) != 4 || cols[0].Name != "id" || cols[0].Type != INT || cols[3].Type != DATETIME {
+		t.Errorf("Unexpected columns %v", cols)
+	}
+
+	n := 0
+	for rows.Next() {
+		var id int64
+		var name string
+		var active bool
+		var ts time.Time
+		if err := rows.Scan(&id, &name, &active, &ts); err != nil {
+			t.Fatalf("Unexpected scan error: %s", err)
+		}
+		if id != 1 || name != "O'Brien" || !active || !ts.Equal(created) {
+			t.Errorf("Unexpected row: %d %s %t %s", id, name, active, ts)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 row, got %d", n)
+	}
+
+	rows, err = db.Query(ctx, "SELECT name FROM users WHERE name = 'it''s me'")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !rows.Next() {
+		t.Fatalf("Expected a row")
+	}
+	var name string
+	if err := rows.Scan(&name); err != nil || name != "it's me" {
+		t.Errorf("Unexpected value '%s' (%v)", name, err)
+	}
+}
+
+func TestBoolSpellings(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+
+	for i, v := range []string{"TRUE", "1", "t", "False", "0"} {
+		if _, err := db.Exec(ctx, fmt.Sprintf("INSERT INTO users (id, active) VALUES ('%d', '%s')", i+1, v)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if _, err := db.Exec(ctx, "UPDATE users SET active = 'T' WHERE id = '4'"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	actives := func(sql string) string {
+		t.Helper()
+		res, err := db.Exec(ctx, sql)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", sql, err)
+		}
+		var vals []string
+		for _, r := range res.Rows {
+			vals = append(vals, r.Fields["id"]+":"+r.Fields["active"])
+		}
+		return strings.Join(vals, " ")
+	}
+	if got := actives("SELECT id, active FROM users"); got != "1:true 2:true 3:true 4:true 5:false" {
+		t.Errorf("Expected normalized values, got %s", got)
+	}
+	if got := actives("SELECT id, active FROM users WHERE active = 'true'"); got != "1:true 2:true 3:true 4:true" {
+		t.Errorf("Unexpected rows %s", got)
+	}
+	if _, err := db.Exec(ctx, "CREATE INDEX users_active ON users (active)"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := actives("SELECT id, active FROM users WHERE active = 'F'"); got != "5:false" {
+		t.Errorf("Unexpected rows %s", got)
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cfg.json")
+	ioutil.WriteFile(path, []byte(`{"DbDir": "/data", "PgPort": 5432, "TrustedProxies": ["10.0.0.0/8"]}`), 0600)
+	cfg, err := NewConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := NewConfigDefault()
+	want.DbDir, want.PgPort, want.TrustedProxies = "/data", 5432, []string{"10.0.0.0/8"}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("Expected %+v, got %+v", want, cfg)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"PgPrt": 5432}`), 0600)
+	if _, err := NewConfig(path); ErrorCodeOf(err) != ErrInvalidParameter {
+		t.Errorf("Expected %s, got %v", ErrInvalidParameter, err)
+	}
+	if _, err := NewConfig(path + ".missing"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestPrimaryKey(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+
+	expectCode := func(sql string, code ErrorCode) {
+		t.Helper()
+		_, err := db.Exec(ctx, sql)
+		if c := ErrorCodeOf(err); err != nil && c != code || err == nil && code != "" {
+			t.Errorf("%s: expected code '%s', got %v", sql, code, err)
+		}
+	}
+	expectCode("INSERT INTO users (id, name) VALUES ('1', 'a'), ('2', 'b')", "")
+	expectCode("INSERT INTO users (id, name) VALUES ('01', 'c')", ErrConstraintViolation)
+	expectCode("INSERT INTO users (id, name) VALUES ('3', 'c'), ('3', 'd')", ErrConstraintViolation)
+	expectCode("INSERT INTO users (name) VALUES ('e'), ('f')", "")
+	expectCode("UPDATE users SET id = '2' WHERE id = '1'", ErrConstraintViolation)
+	expectCode("UPDATE users SET id = '7' WHERE name = 'a' OR name = 'b'", ErrConstraintViolation)
+	// keys are checked once all records are changed
+	expectCode("UPDATE users SET id = id + 1 WHERE name = 'a' OR name = 'b'", "")
+	expectCode("UPDATE users SET id = id + 9 WHERE id >= '0'", "")
+	expectCode("UPDATE users SET name = 'z' WHERE id = '11'", "")
+
+	res, err := db.Exec(ctx, "SELECT id, name FROM users WHERE id = '11' OR id = '12'")
+	if err != nil || len(res.Rows) != 2 || res.Rows[0].Fields["name"] != "z" || res.Rows[1].Fields["name"] != "b" {
+		t.Errorf("Unexpected rows %v (%v)", res.Rows, err)
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+
+	tcs := []struct {
+		name string
+		sql  string
+		args []interface{}
+		code ErrorCode
+	}{
+		{"syntax", "SELEC * FROM users", nil, ErrSyntax},
+		{"missing table", "SELECT * FROM nope", nil, ErrUndefinedTable},
+		{"duplicate table", "CREATE TABLE users (id INT)", nil, ErrDuplicateTable},
+		{"unknown type", "CREATE TABLE other (id FLOAT)", nil, ErrUndefinedObject},
+		{"missing column", "UPDATE users SET nope = '1' WHERE id = '1'", nil, ErrUndefinedColumn},
+		{"missing column in where", "DELETE FROM users WHERE nope = '1'", nil, ErrUndefinedColumn},
+		{"invalid int", "INSERT INTO users (id) VALUES ('x')", nil, ErrInvalidValue},
+		{"invalid bool", "UPDATE users SET active = 'maybe' WHERE id = '1'", nil, ErrInvalidValue},
+		{"too few args", "SELECT * FROM users WHERE id = ?", nil, ErrWrongParamCount},
+		{"too many args", "SELECT * FROM users", []interface{}{1}, ErrWrongParamCount},
+		{"unsupported arg", "SELECT * FROM users WHERE id = ?", []interface{}{struct{}{}}, ErrInvalidParameter},
+		{"unterminated literal", "SELECT * FROM users WHERE name = 'x", nil, ErrSyntax},
+		{"mixed placeholders", "SELECT * FROM users WHERE id = ? AND name = $2", []interface{}{1, "a"}, ErrSyntax},
+		{"invalid placeholder", "SELECT * FROM users WHERE id = $0", []interface{}{1}, ErrSyntax},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := db.Exec(ctx, tc.sql, tc.args...)
+			if err == nil {
+				t.Fatalf("Expected an error")
+			}
+			if code := ErrorCodeOf(err); code != tc.code {
+				t.Errorf("Expected code %s, got %s (%s)", tc.code, code, err)
+			}
+		})
+	}
+}
+
+func TestPreparedStatements(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+
+	ins, err := db.Prepare("INSERT INTO users (id, name) VALUES ($1, $2)")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ins.NumParams() != 2 {
+		t.Errorf("Expected 2 params, got %d", ins.NumParams())
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := ins.Exec(ctx, i, "name"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	ins.Close()
+	if _, err := ins.Exec(ctx, 11, "x"); err == nil {
+		t.Errorf("Expected an error on deallocated statement")
+	}
+
+	sel, err := db.Prepare("SELECT name FROM users WHERE id >= $1 AND name != $2")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer sel.Close()
+
+	cols, err := sel.Columns()
+	if err != nil || len(cols) != 1 || cols[0].Name != "name" || cols[0].Type != TEXT {
+		t.Errorf("Unexpected columns %v (%v)", cols, err)
+	}
+	types, err := sel.ParamTypes()
+	if err != nil || len(types) != 2 || types[0] != INT || types[1] != TEXT {
+		t.Errorf("Unexpected parameter types %v (%v)", types, err)
+	}
+
+	rows, err := sel.Query(ctx, 5, "name7")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	if n != 4 {
+		t.Errorf("Expected 4 rows, got %d", n)
+	}
+
+	// an injection attempt is bound as a plain value
+	rows, err = sel.Query(ctx, 0, "x' OR name != '")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	n = 0
+	for rows.Next() {
+		n++
+	}
+	if n != 10 {
+		t.Errorf("Expected 10 rows, got %d", n)
+	}
+}
+
+func TestQueryStream(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+
+	const N = streamBuffer * 3
+	for i := 0; i < N; i++ {
+		if _, err := db.Exec(ctx, "INSERT INTO users (id, name) VALUES (?, ?)", i, "n"); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	rows, err := db.QueryStream(ctx, "SELECT id FROM users WHERE id >= ?", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if cols := rows.Columns(); len(cols) != 1 || cols[0].Name != "id" {
+		t.Errorf("Unexpected columns %v", cols)
+	}
+	n := 0
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil || n != N-1 {
+		t.Errorf("Expected %d rows, got %d (%v)", N-1, n, err)
+	}
+
+	// an abandoned stream must not keep the table locked
+	rows, err = db.QueryStream(ctx, "SELECT * FROM users")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	rows.Next()
+	rows.Close()
+	if rows.Next() {
+		t.Errorf("No rows expected after Close")
+	}
+	done := make(chan error)
+	go func() {
+		_, err := db.Exec(ctx, "DELETE FROM users WHERE id >= '0'")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Table still locked by a closed stream")
+	}
+
+	// a stream exceeding its deadline reports a timeout
+	for i := 0; i < N; i++ {
+		db.Exec(ctx, "INSERT INTO users (id, name) VALUES (?, ?)", i, "n")
+	}
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	rows, err = db.QueryStream(tctx, "SELECT * FROM users")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for rows.Next() {
+	}
+	if code := ErrorCodeOf(rows.Err()); code != ErrQueryTimeout {
+		t.Errorf("Expected timeout, got %v", rows.Err())
+	}
+
+	// an expression failing midway ends the stream with its error
+	db.Exec(ctx, "CREATE TABLE t (id INT, v INT)")
+	db.Exec(ctx, "INSERT INTO t (id, v) VALUES ('1', '1'), ('2', '0'), ('3', '1')")
+	rows, err = db.QueryStream(ctx, "SELECT id / v AS x FROM t")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	n = 0
+	for rows.Next() {
+		n++
+	}
+	if code := ErrorCodeOf(rows.Err()); code != ErrDivisionByZero || n != 1 {
+		t.Errorf("Expected %s after 1 row, got %v after %d", ErrDivisionByZero, rows.Err(), n)
+	}
+}
+
+func TestStopped(t *testing.T) {
+	db, err := Open(nil)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	db.Stop()
+
+	// more requests than the queue holds
+	for i := 0; i < db.cfg.MaxDbRequests*2; i++ {
+		req := QueryRequest{Sql: "SELECT * FROM users", Resp: make(chan QueryResult)}
+		db.ProcessQuery(req)
+		select {
+		case res := <-req.Resp:
+			if ErrorCodeOf(res.Err) != ErrShutdown {
+				t.Fatalf("Expected %s, got %v", ErrShutdown, res.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No result from a stopped engine")
+		}
+	}
+	if _, err := db.Exec(context.Background(), "SELECT * FROM users"); ErrorCodeOf(err) != ErrShutdown {
+		t.Errorf("Expected %s, got %v", ErrShutdown, err)
+	}
+}
+
+func TestExecContextCancelled(t *testing.T) {
+	db := openTestDb(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := db.Exec(ctx, "SELECT * FROM users"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestGrantRevoke(t *testing.T) {
+	cfg := NewConfigDefault()
+	cfg.DbDir = t.TempDir()
+	db, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	ctx := context.Background()
+
+	if db.AuthEnabled() {
+		t.Errorf("Auth enabled without users")
+	}
+	if err := db.CreateUser("admin", "pw", true); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := db.CreateUser("bob", "pw", false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if code := ErrorCodeOf(db.CreateUser("bob", "x", false)); code != ErrDuplicateObject {
+		t.Errorf("Expected %s, got %s", ErrDuplicateObject, code)
+	}
+	if err := db.Authenticate("bob", "pw"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if code := ErrorCodeOf(db.Authenticate("bob", "nope")); code != ErrInvalidAuthorization {
+		t.Errorf("Expected %s, got %s", ErrInvalidAuthorization, code)
+	}
+
+	admin := WithUser(ctx, "admin")
+	bob := WithUser(ctx, "bob")
+	if _, err := db.Exec(admin, "CREATE TABLE users (id INT, name TEXT)"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expectCode := func(ctx context.Context, sql string, code ErrorCode) {
+		t.Helper()
+		_, err := db.Exec(ctx, sql)
+		if c := ErrorCodeOf(err); err != nil && c != code || err == nil && code != "" {
+			t.Errorf("%s: expected code '%s', got %v", sql, code, err)
+		}
+	}
+
+	expectCode(bob, "SELECT * FROM users", ErrInsufficientPrivilege)
+	expectCode(bob, "GRANT SELECT ON users TO bob", ErrInsufficientPrivilege)
+	expectCode(admin, "GRANT SELECT, INSERT ON users TO bob", "")
+	expectCode(admin, "GRANT SELECT ON users TO nobody", ErrUndefinedObject)
+	expectCode(admin, "GRANT FLY ON users TO bob", ErrSyntax)
+	expectCode(bob, "SELECT * FROM users", "")
+	expectCode(bob, "INSERT INTO users (id, name) VALUES ('1', 'a')", "")
+	expectCode(bob, "DELETE FROM users WHERE id = '1'", ErrInsufficientPrivilege)
+	expectCode(bob, "DROP TABLE users", ErrInsufficientPrivilege)
+	expectCode(admin, "revoke insert on table users from bob;", "")
+	expectCode(bob, "INSERT INTO users (id, name) VALUES ('2', 'b')", ErrInsufficientPrivilege)
+
+	// prepared statements are checked when executed
+	stmt, err := db.PrepareContext(bob, "DELETE FROM users WHERE id = ?")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := stmt.Exec(bob, 1); ErrorCodeOf(err) != ErrInsufficientPrivilege {
+		t.Errorf("Expected %s, got %v", ErrInsufficientPrivilege, err)
+	}
+
+	// only their owner may use prepared statements by handle
+	if _, err := db.ExecPrepared(admin, stmt.Handle(), 1); ErrorCodeOf(err) != ErrInvalidStatement {
+		t.Errorf("Expected %s, got %v", ErrInvalidStatement, err)
+	}
+	if db.DeallocateContext(admin, stmt.Handle()) {
+		t.Errorf("Expected the statement of another user to be left alone")
+	}
+	if !db.DeallocateContext(bob, stmt.Handle()) {
+		t.Errorf("Expected the owner to deallocate the statement")
+	}
+	db.cfg.MaxPreparedStmts = 2
+	for i := 0; i < 2; i++ {
+		if _, err := db.PrepareContext(bob, "SELECT * FROM users"); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if _, err := db.PrepareContext(bob, "SELECT * FROM users"); ErrorCodeOf(err) != ErrTooManyRequests {
+		t.Errorf("Expected %s, got %v", ErrTooManyRequests, err)
+	}
+	if _, err := db.PrepareContext(admin, "SELECT * FROM users"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	key, err := db.CreateApiKey("bob")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	db.Stop()
+
+	// users, keys and grants survive a restart
+	db, err = Open(cfg)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	defer db.Stop()
+	if user, err := db.AuthenticateKey(key); err != nil || user != "bob" {
+		t.Errorf("Unexpected key owner %s (%v)", user, err)
+	}
+	if err := db.CheckPrivilege("bob", "users", PrivSelect); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := db.CheckPrivilege("bob", "users", PrivInsert); err == nil {
+		t.Errorf("Expected revoked privilege to stay revoked")
+	}
+	if err := db.DropUser("bob"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := db.AuthenticateKey(key); err == nil {
+		t.Errorf("Expected key of a dropped user to be rejected")
+	}
+}
+
+func TestAuthSharedFile(t *testing.T) {
+	cfg := NewConfigDefault()
+	cfg.DbDir = t.TempDir()
+	db, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	defer db.Stop()
+	if err := db.CreateUser("admin", "pw", true); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := db.Exec(WithUser(context.Background(), "admin"), "CREATE TABLE users (id INT)"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// like the user management commands next to a running server
+	cli, err := NewDbEngine(cfg)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	if err := cli.CreateUser("bob", "pw", false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	key, err := cli.CreateApiKey("bob")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if err := db.Authenticate("bob", "pw"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := db.Exec(WithUser(context.Background(), "admin"), "GRANT SELECT ON users TO bob"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := cli.CheckPrivilege("bob", "users", PrivSelect); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	// the GRANT kept the key in the file
+	after, err := NewDbEngine(cfg)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	if user, err := after.AuthenticateKey(key); err != nil || user != "bob" {
+		t.Errorf("Unexpected key owner %s (%v)", user, err)
+	}
+	if err := cli.DropUser("bob"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if code := ErrorCodeOf(db.Authenticate("bob", "pw")); code != ErrInvalidAuthorization {
+		t.Errorf("Expected %s, got %s", ErrInvalidAuthorization, code)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	stmts, rest := SplitStatements("SELECT 'a;b' FROM t; INSERT INTO t VALUES ('x');;\nUPDATE t")
+	want := []string{"SELECT 'a;b' FROM t", "INSERT INTO t VALUES ('x')"}
+	if !reflect.DeepEqual(stmts, want) || rest != "\nUPDATE t" {
+		t.Errorf("Unexpected split %q, rest %q", stmts, rest)
+	}
+	if stmts, rest := SplitStatements("SELECT 'it''s;"); len(stmts) != 0 || rest != "SELECT 'it''s;" {
+		t.Errorf("Expected an unterminated statement, got %q, rest %q", stmts, rest)
+	}
+	stmts, rest = SplitStatements("SELECT 'it\\'s;' FROM t; SELECT \"a;b\" FROM t;  \n")
+	want = []string{"SELECT 'it\\'s;' FROM t", "SELECT \"a;b\" FROM t"}
+	if !reflect.DeepEqual(stmts, want) || rest != "" {
+		t.Errorf("Unexpected split %q, rest %q", stmts, rest)
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	var b strings.Builder
+	WriteTable(&b, QueryResult{
+		Columns: []Column{{Name: "id", Type: INT}, {Name: "name", Type: TEXT}},
+		Rows: []Row{
+			{Fields: map[string]string{"id": "7", "name": "a\tb"}},
+			{Fields: map[string]string{"id": "10"}},
+		},
+	})
+	if want := " id | name\n----+------\n  7 | a\\tb\n 10 |\n(2 rows)\n"; b.String() != want {
+		t.Errorf("Unexpected table:\n%s", b.String())
+	}
+	b.Reset()
+	WriteTable(&b, QueryResult{Status: "OK", RowsAffected: 3})
+	if b.String() != "OK, 3 rows affected\n" {
+		t.Errorf("Unexpected output %q", b.String())
+	}
+}
+
+func TestDropTable(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+
+	if _, err := db.Exec(ctx, "DROP TABLE users"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := db.Exec(ctx, "SELECT * FROM users"); ErrorCodeOf(err) != ErrUndefinedTable {
+		t.Errorf("Expected %s, got %v", ErrUndefinedTable, err)
+	}
+	if _, err := db.Exec(ctx, "CREATE TABLE users (id INT)"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestSchemaIntrospection(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+	db.Exec(ctx, "INSERT INTO users (id, name) VALUES ('1', 'a')")
+	db.Exec(ctx, "CREATE TABLE posts (id INT, title TEXT)")
+
+	column := func(sql, col string) []string {
+		t.Helper()
+		res, err := db.Exec(ctx, sql)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", sql, err)
+		}
+		var vals []string
+		for _, r := range res.Rows {
+			vals = append(vals, r.Fields[col])
+		}
+		return vals
+	}
+	expect := func(sql, col string, want ...string) {
+		t.Helper()
+		if got := column(sql, col); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", sql, want, got)
+		}
+	}
+
+	expect("SHOW TABLES", "table_name", "posts", "users")
+	expect("DESCRIBE users", "column_name", "id", "name", "active", "created")
+	expect("desc public.users;", "data_type", "INT", "TEXT", "BOOL", "DATETIME")
+	expect("SHOW COLUMNS FROM posts", "is_primary_key", "true", "false")
+	expect("DESCRIBE information_schema.indexes", "column_name", "table_schema", "table_name", "index_name", "column_name", "is_primary")
+	expect("SELECT table_rows FROM information_schema.tables WHERE table_name = 'users'", "table_rows", "1")
+	expect("SELECT table_name FROM information_schema.tables WHERE table_type = 'VIEW'", "table_name", "column_statistics", "columns", "indexes", "tables")
+	expect("SELECT ordinal_position FROM information_schema.columns WHERE table_name = 'posts'", "ordinal_position", "1", "2")
+	expect("SELECT index_name FROM information_schema.indexes WHERE column_name = 'id'", "index_name", "posts_pkey", "users_pkey")
+
+	rows, err := db.Query(ctx, "SELECT table_rows FROM information_schema.tables WHERE table_name = 'posts'")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var n int64
+	if !rows.Next() || rows.Scan(&n) != nil || n != 0 {
+		t.Errorf("Expected an INT row count, got %d (%v)", n, rows.Err())
+	}
+
+	expectCode := func(sql string, code ErrorCode) {
+		t.Helper()
+		if _, err := db.Exec(ctx, sql); ErrorCodeOf(err) != code {
+			t.Errorf("%s: expected %s, got %v", sql, code, err)
+		}
+	}
+	expectCode("DESCRIBE nope", ErrUndefinedTable)
+	expectCode("SHOW DATABASES", ErrSyntax)
+	expectCode("SELECT * FROM information_schema.nope", ErrUndefinedTable)
+	expectCode("DELETE FROM information_schema.tables WHERE table_name = 'users'", ErrReadOnly)
+	expectCode("CREATE TABLE information_schema.t (id INT)", ErrReadOnly)
+	expectCode("CREATE TABLE app.t (id INT)", ErrSyntax)
+}
+
+func TestSchemaIntrospectionPrivileges(t *testing.T) {
+	cfg := NewConfigDefault()
+	cfg.DbDir = t.TempDir()
+	db, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	defer db.Stop()
+	db.CreateUser("admin", "pw", true)
+	db.CreateUser("bob", "pw", false)
+	admin := WithUser(context.Background(), "admin")
+	bob := WithUser(context.Background(), "bob")
+	db.Exec(admin, "CREATE TABLE public_data (id INT)")
+	db.Exec(admin, "CREATE TABLE secrets (id INT)")
+	db.Exec(admin, "GRANT SELECT ON public_data TO bob")
+
+	res, err := db.Exec(bob, "SHOW TABLES")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(res.Rows) != 1 || res.Rows[0].Fields["table_name"] != "public_data" {
+		t.Errorf("Expected only public_data, got %v", res.Rows)
+	}
+	res, err = db.Exec(bob, "SELECT table_name FROM information_schema.columns WHERE table_schema = 'public'")
+	if err != nil || len(res.Rows) != 1 {
+		t.Errorf("Expected the columns of public_data, got %v (%v)", res.Rows, err)
+	}
+	if _, err := db.Exec(bob, "DESCRIBE secrets"); ErrorCodeOf(err) != ErrInsufficientPrivilege {
+		t.Errorf("Expected %s, got %v", ErrInsufficientPrivilege, err)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		db.Exec(ctx, "INSERT INTO users (id, name) VALUES (?, ?)", i, "u"+strconv.Itoa(i))
+	}
+
+	plan := func(sql string, args ...interface{}) []string {
+		t.Helper()
+		res, err := db.Exec(ctx, sql, args...)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", sql, err)
+		}
+		if len(res.Columns) != 1 || res.Columns[0].Name != "QUERY PLAN" {
+			t.Fatalf("%s: unexpected columns %v", sql, res.Columns)
+		}
+		var lines []string
+		for _, r := range res.Rows {
+			lines = append(lines, r.Fields["QUERY PLAN"])
+		}
+		return lines
+	}
+	count := func(sql string) int {
+		t.Helper()
+		res, err := db.Exec(ctx, sql)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", sql, err)
+		}
+		return len(res.Rows)
+	}
+
+	want := []string{"Full Scan on users  (rows=1)", "  Filter: (name = 'u2' AND active != 'true')"}
+	if got := plan("EXPLAIN SELECT name FROM users WHERE active != 'true' AND name = ?", "u2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	want = []string{"Delete on users  (rows=1)", "  ->  Full Scan on users  (rows=1)", "        Filter: (name = id)"}
+	if got := plan("explain DELETE FROM users WHERE name = id"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if n := count("SELECT * FROM users"); n != 3 {
+		t.Errorf("Expected EXPLAIN to change nothing, got %d rows", n)
+	}
+
+	got := plan("EXPLAIN ANALYZE UPDATE users SET name = 'z' WHERE name != 'u1'")
+	if len(got) != 4 ||
+		!strings.HasPrefix(got[0], "Update on users  (rows=3) (actual rows=2 time=") ||
+		!strings.HasPrefix(got[1], "  ->  Full Scan on users  (rows=3) (actual rows=2 scanned=3 ") ||
+		got[2] != "        Filter: (name != 'u1')" ||
+		!strings.HasPrefix(got[3], "Execution Time: ") {
+		t.Errorf("Unexpected plan %q", got)
+	}
+	if n := count("SELECT * FROM users WHERE name = 'z'"); n != 2 {
+		t.Errorf("Expected EXPLAIN ANALYZE to run the update, got %d rows", n)
+	}
+
+	stmt, err := db.Prepare("EXPLAIN SELECT * FROM users WHERE id = ?")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if cols, err := stmt.Columns(); err != nil || len(cols) != 1 || cols[0].Name != "QUERY PLAN" {
+		t.Errorf("Unexpected columns %v (%v)", cols, err)
+	}
+
+	expectCode := func(sql string, code ErrorCode) {
+		t.Helper()
+		if _, err := db.Exec(ctx, sql); ErrorCodeOf(err) != code {
+			t.Errorf("%s: expected %s, got %v", sql, code, err)
+		}
+	}
+	expectCode("EXPLAIN CREATE TABLE t (id INT)", ErrFeatureNotSupported)
+	expectCode("EXPLAIN EXPLAIN SELECT * FROM users", ErrSyntax)
+	expectCode("EXPLAIN SELECT nope FROM users", ErrUndefinedColumn)
+	expectCode("EXPLAIN SELECT * FROM nope", ErrUndefinedTable)
+}
+
+func TestPlanner(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+	for i := 1; i <= 100; i++ {
+		db.Exec(ctx, "INSERT INTO users (id, name, active) VALUES (?, ?, ?)", i, "u"+strconv.Itoa(i%10), i%2 == 0)
+	}
+
+	access := func(sql string) string {
+		t.Helper()
+		res, err := db.Exec(ctx, "EXPLAIN "+sql)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", sql, err)
+		}
+		line := res.Rows[0].Fields["QUERY PLAN"]
+		return line[:strings.Index(line, "  (")]
+	}
+	ids := func(sql string) []string {
+		t.Helper()
+		res, err := db.Exec(ctx, sql)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", sql, err)
+		}
+		var ids []string
+		for _, r := range res.Rows {
+			ids = append(ids, r.Fields["id"])
+		}
+		return ids
+	}
+
+	if got := access("SELECT * FROM users WHERE name = 'u3'"); got != "Full Scan on users" {
+		t.Errorf("Expected a full scan, got %s", got)
+	}
+	if _, err := db.Exec(ctx, "CREATE INDEX users_name ON users (name)"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := access("SELECT * FROM users WHERE active = 'true' AND name = 'u3'"); got != "Index Lookup using users_name on users" {
+		t.Errorf("Expected an index lookup, got %s", got)
+	}
+	if got := ids("SELECT id FROM users WHERE name = 'u3' AND id < '40'"); !reflect.DeepEqual(got, []string{"3", "13", "23", "33"}) {
+		t.Errorf("Unexpected rows %v", got)
+	}
+	if got := access("SELECT * FROM users WHERE id > '95'"); got != "Index Range Scan using users_pkey on users" {
+		t.Errorf("Expected a range scan, got %s", got)
+	}
+	if got := ids("SELECT id FROM users WHERE id > '95' AND id <= '98'"); !reflect.DeepEqual(got, []string{"96", "97", "98"}) {
+		t.Errorf("Unexpected rows %v", got)
+	}
+
+	// without statistics a third of the records is expected in a range
+	if got := access("SELECT * FROM users WHERE id > '5'"); got != "Index Range Scan using users_pkey on users" {
+		t.Errorf("Expected a range scan, got %s", got)
+	}
+	if !db.LastCompaction().IsZero() {
+		t.Errorf("Unexpected compaction at %s", db.LastCompaction())
+	}
+	db.compact()
+	if time.Since(db.LastCompaction()) > time.Minute {
+		t.Errorf("Expected a recent compaction, got %s", db.LastCompaction())
+	}
+	if st := db.Stats(); st.Compactions != 1 || st.CompactionSeconds <= 0 {
+		t.Errorf("Expected one compaction in the stats, got %d taking %gs", st.Compactions, st.CompactionSeconds)
+	}
+	if _, err := db.Exec(ctx, "ANALYZE users"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := access("SELECT * FROM users WHERE id > '5'"); got != "Full Scan on users" {
+		t.Errorf("Expected a full scan once most records are known to match, got %s", got)
+	}
+	res, err := db.Exec(ctx, "SELECT * FROM information_schema.column_statistics WHERE column_name = 'id'")
+	if err != nil || len(res.Rows) != 1 {
+		t.Fatalf("Expected the statistics of users.id, got %v (%v)", res.Rows, err)
+	}
+	if f := res.Rows[0].Fields; f["row_count"] != "100" || f["distinct_count"] != "100" || f["min_value"] != "1" || f["max_value"] != "100" {
+		t.Errorf("Unexpected statistics %v", f)
+	}
+
+	// indexes follow the changes of the table
+	db.Exec(ctx, "UPDATE users SET name = 'x' WHERE id <= '2'")
+	db.Exec(ctx, "DELETE FROM users WHERE id = '1'")
+	if got := ids("SELECT id FROM users WHERE name = 'x'"); !reflect.DeepEqual(got, []string{"2"}) {
+		t.Errorf("Unexpected rows %v", got)
+	}
+	if got := ids("SELECT id FROM users WHERE id <= '3'"); len(got) != 2 {
+		t.Errorf("Unexpected rows %v", got)
+	}
+	if got := ids("SELECT id FROM users WHERE id = '100'"); !reflect.DeepEqual(got, []string{"100"}) {
+		t.Errorf("Unexpected rows %v", got)
+	}
+
+	expectCode := func(sql string, code ErrorCode) {
+		t.Helper()
+		if _, err := db.Exec(ctx, sql); ErrorCodeOf(err) != code {
+			t.Errorf("%s: expected %s, got %v", sql, code, err)
+		}
+	}
+	expectCode("CREATE INDEX users_name ON users (active)", ErrDuplicateObject)
+	expectCode("CREATE INDEX users_both ON users (id, name)", ErrFeatureNotSupported)
+	expectCode("ANALYZE nope", ErrUndefinedTable)
+	expectCode("ANALYZE users posts", ErrSyntax)
+}
+
+func TestExpressions(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+	db.Exec(ctx, "INSERT INTO users (id, name, active, created) VALUES ('1', 'Ann', 'true', '2022-03-15 10:20:30')")
+	db.Exec(ctx, "INSERT INTO users (id, name, active) VALUES ('2', 'bob', 'false')")
+	db.Exec(ctx, "INSERT INTO users (id, active) VALUES ('3', 'true')")
+
+	rows := func(sql string, args ...interface{}) []map[string]string {
+		t.Helper()
+		res, err := db.Exec(ctx, sql, args...)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", sql, err)
+		}
+		var fields []map[string]string
+		for _, r := range res.Rows {
+			fields = append(fields, r.Fields)
+		}
+		return fields
+	}
+
+	res, err := db.Exec(ctx, "SELECT id * 10 + 1 AS n, UPPER(name) AS upper, name || '!' FROM users WHERE id = '1'")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(res.Columns, []Column{{Name: "n", Type: INT}, {Name: "upper", Type: TEXT}, {Name: "name || '!'", Type: TEXT}}) {
+		t.Errorf("Unexpected columns %v", res.Columns)
+	}
+	if f := res.Rows[0].Fields; f["n"] != "11" || f["upper"] != "ANN" || f["name || '!'"] != "Ann!" {
+		t.Errorf("Unexpected row %v", f)
+	}
+
+	got := rows("SELECT id, LOWER(name) AS l, LENGTH(name) AS len, SUBSTR(name, 2, 1) AS s, COALESCE(created, '2000-01-01') AS c FROM users")
+	want := []map[string]string{
+		{"id": "1", "l": "ann", "len": "3", "s": "n", "c": "2022-03-15 10:20:30"},
+		{"id": "2", "l": "bob", "len": "3", "s": "o", "c": "2000-01-01"},
+		{"id": "3", "l": "", "len": "0", "s": "", "c": "2000-01-01"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected rows %v", got)
+	}
+
+	got = rows("SELECT id, CASE WHEN id % 2 = 0 THEN 'even' ELSE 'odd' END AS parity, DATE_TRUNC('day', created) AS day FROM users WHERE id < 3 AND (active OR name = 'bob')")
+	want = []map[string]string{
+		{"id": "1", "parity": "odd", "day": "2022-03-15 00:00:00"},
+		{"id": "2", "parity": "even", "day": ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected rows %v", got)
+	}
+	if got := rows("SELECT id FROM users WHERE created < NOW() AND name IS NOT NULL"); len(got) != 1 || got[0]["id"] != "1" {
+		t.Errorf("Unexpected rows %v", got)
+	}
+	if got := rows("SELECT id FROM users WHERE LENGTH(name) = ? AND id > 1", 3); len(got) != 1 || got[0]["id"] != "2" {
+		t.Errorf("Unexpected rows %v", got)
+	}
+
+	res, err = db.Exec(ctx, "UPDATE users SET id = id + 10, name = UPPER(name) || id WHERE id >= '2'")
+	if err != nil || res.RowsAffected != 2 {
+		t.Fatalf("Unexpected result %v (%v)", res, err)
+	}
+	if got := rows("SELECT id, name FROM users WHERE id > 10"); !reflect.DeepEqual(got, []map[string]string{{"id": "12", "name": "BOB2"}, {"id": "13", "name": "3"}}) {
+		t.Errorf("Unexpected rows %v", got)
+	}
+
+	expectCode := func(sql string, code ErrorCode) {
+		t.Helper()
+		if _, err := db.Exec(ctx, sql); ErrorCodeOf(err) != code {
+			t.Errorf("%s: expected %s, got %v", sql, code, err)
+		}
+	}
+	expectCode("SELECT NOPE(name) FROM users", ErrUndefinedFunction)
+	expectCode("SELECT UPPER(name, id) FROM users", ErrUndefinedFunction)
+	expectCode("SELECT id / (id - 1) FROM users", ErrDivisionByZero)
+	expectCode("SELECT id FROM users WHERE id + 1", ErrDatatypeMismatch)
+	expectCode("SELECT nope + 1 FROM users", ErrUndefinedColumn)
+	// a failing UPDATE changes nothing
+	expectCode("UPDATE users SET id = 100 / (id - 12) WHERE id > 0", ErrDivisionByZero)
+	if got := rows("SELECT id FROM users WHERE id = 100"); len(got) != 0 {
+		t.Errorf("Unexpected rows %v", got)
+	}
+}
+
+// sumAgg sums INT values.
+type sumAgg struct{ sum int64 }
+
+func (a *sumAgg) Step(args []interface{}) error {
+	a.sum += args[0].(int64)
+	return nil
+}
+
+func (a *sumAgg) Result() (interface{}, error) { return a.sum, nil }
+
+func TestRegisterFunc(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+	db.Exec(ctx, "INSERT INTO users (id, name, active) VALUES ('1', 'Hello World', 'true')")
+	db.Exec(ctx, "INSERT INTO users (id, name, active) VALUES ('2', 'Go  Is Fun', 'false')")
+	db.Exec(ctx, "INSERT INTO users (id, name, active) VALUES ('3', 'x', 'true')")
+
+	slug := Func{Args: []FieldType{TEXT}, Returns: TEXT, Scalar: func(args []interface{}) (interface{}, error) {
+		return strings.Join(strings.Fields(strings.ToLower(args[0].(string))), "-"), nil
+	}}
+	if err := db.RegisterFunc("slug", slug); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := db.RegisterFunc("my_sum", Func{Args: []FieldType{INT}, Returns: INT, Aggregate: func() Aggregator { return &sumAgg{} }}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	db.RegisterFunc("half", Func{Args: []FieldType{INT}, Returns: INT, Scalar: func(args []interface{}) (interface{}, error) {
+		if args[0].(int64)%2 != 0 {
+			return nil, fmt.Errorf("%d is odd", args[0])
+		}
+		return int(args[0].(int64) / 2), nil
+	}})
+	db.RegisterFunc("bad", Func{Returns: INT, Scalar: func([]interface{}) (interface{}, error) { return "x", nil }})
+
+	res, err := db.Exec(ctx, "SELECT id, SLUG(name) AS s FROM users WHERE slug(name) != 'x' AND HALF(id * 2) < 3")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(res.Rows) != 2 || res.Rows[0].Fields["s"] != "hello-world" || res.Rows[1].Fields["s"] != "go-is-fun" || res.Columns[1].Type != TEXT {
+		t.Errorf("Unexpected result %v %v", res.Columns, res.Rows)
+	}
+	if _, err := db.Exec(ctx, "UPDATE users SET name = slug(name) WHERE id = '1'"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res, err = db.Exec(ctx, "SELECT name FROM users WHERE id = '1'")
+	if err != nil || res.Rows[0].Fields["name"] != "hello-world" {
+		t.Errorf("Unexpected result %v (%v)", res.Rows, err)
+	}
+
+	res, err = db.Exec(ctx, "SELECT my_sum(id) AS total, my_sum(id * 10) + 1 AS more FROM users WHERE active = 'true'")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(res.Rows) != 1 || res.Rows[0].Fields["total"] != "4" || res.Rows[0].Fields["more"] != "41" || res.Columns[0].Type != INT {
+		t.Errorf("Unexpected result %v %v", res.Columns, res.Rows)
+	}
+	// without records the aggregate still makes a row
+	res, err = db.Exec(ctx, "SELECT my_sum(id) AS total FROM users WHERE id > '10'")
+	if err != nil || len(res.Rows) != 1 || res.Rows[0].Fields["total"] != "0" {
+		t.Errorf("Unexpected result %v (%v)", res.Rows, err)
+	}
+	res, err = db.Exec(ctx, "EXPLAIN SELECT my_sum(id) FROM users")
+	if err != nil || !strings.HasPrefix(res.Rows[0].Fields["QUERY PLAN"], "Aggregate") {
+		t.Errorf("Unexpected plan %v (%v)", res.Rows, err)
+	}
+
+	expectCode := func(sql string, code ErrorCode) {
+		t.Helper()
+		if _, err := db.Exec(ctx, sql); ErrorCodeOf(err) != code {
+			t.Errorf("%s: expected %s, got %v", sql, code, err)
+		}
+	}
+	expectCode("SELECT slug(id) FROM users", ErrDatatypeMismatch)
+	expectCode("SELECT slug(name, name) FROM users", ErrUndefinedFunction)
+	expectCode("SELECT half('x') FROM users", ErrInvalidValue)
+	expectCode("SELECT half(id) FROM users", ErrExternalRoutine)
+	expectCode("SELECT bad() FROM users", ErrDatatypeMismatch)
+	expectCode("SELECT id, my_sum(id) FROM users", ErrGrouping)
+	expectCode("SELECT my_sum(my_sum(id)) FROM users", ErrGrouping)
+	expectCode("SELECT id FROM users WHERE my_sum(id) > 1", ErrGrouping)
+	expectCode("UPDATE users SET id = my_sum(id) WHERE id = '1'", ErrGrouping)
+
+	for _, tc := range []struct {
+		name string
+		fn   Func
+		code ErrorCode
+	}{
+		{"slug", slug, ErrDuplicateObject},
+		{"upper", slug, ErrDuplicateObject},
+		{"no-dash", slug, ErrInvalidParameter},
+		{"null", slug, ErrInvalidParameter},
+		{"neither", Func{Returns: INT}, ErrInvalidParameter},
+		{"untyped", Func{Args: []FieldType{UNKNOWN_FIELD_TYPE}, Returns: INT, Scalar: slug.Scalar}, ErrInvalidParameter},
+	} {
+		if err := db.RegisterFunc(tc.name, tc.fn); ErrorCodeOf(err) != tc.code {
+			t.Errorf("%s: expected %s, got %v", tc.name, tc.code, err)
+		}
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	db := openTestDb(t)
+	ctx := context.Background()
+	db.Exec(ctx, "CREATE TABLE admins (id INT, login TEXT)")
+	for i, name := range []string{"ann", "bob", "ann", "cid"} {
+		db.Exec(ctx, "INSERT INTO users (id, name, active) VALUES (?, ?, ?)", i+1, name, i%2 == 0)
+	}
+	db.Exec(ctx, "INSERT INTO admins (id, login) VALUES ('1', 'ann')")
+	db.Exec(ctx, "INSERT INTO admins (id, login) VALUES ('7', 'dan')")
+	db.Exec(ctx, "INSERT INTO admins (id, login) VALUES ('8', 'dan')")
+
+	values := func(sql string, args ...interface{}) []string {
+		t.Helper()
+		res, err := db.Exec(ctx, sql, args...)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", sql, err)
+		}
+		var vals []string
+		for _, r := range res.Rows {
+			var v []string
+			for _, c := range res.Columns {
+				v = append(v, r.Fields[c.Name])
+			}
+			vals = append(vals, strings.Join(v, "/"))
+		}
+		return vals
+	}
+
+	tcs := []struct {
+		sql  string
+		want []string
+	}{
+		{"SELECT DISTINCT name FROM users", []string{"ann", "bob", "cid"}},
+		{"SELECT DISTINCT name, active FROM users", []string{"ann/true", "bob/false", "cid/false"}},
+		{"SELECT name FROM users UNION SELECT login FROM admins", []string{"ann", "bob", "cid", "dan"}},
+		{"SELECT name FROM users UNION ALL SELECT login FROM admins WHERE id > '1'", []string{"ann", "bob", "ann", "cid", "dan", "dan"}},
+		{"SELECT name FROM users INTERSECT SELECT login FROM admins", []string{"ann"}},
+		{"SELECT name FROM users INTERSECT ALL SELECT login FROM admins", []string{"ann"}},
+		{"SELECT name FROM users EXCEPT SELECT login FROM admins", []string{"bob", "cid"}},
+		{"SELECT name FROM users EXCEPT ALL SELECT login FROM admins", []string{"bob", "ann", "cid"}},
+		{"SELECT id, name AS who FROM users WHERE id < ? UNION SELECT id, login FROM admins WHERE login = ?", []string{"1/ann", "2/bob", "7/dan", "8/dan"}},
+		// INTERSECT first
+		{"SELECT login FROM admins UNION SELECT name FROM users INTERSECT SELECT login FROM admins", []string{"ann", "dan"}},
+		{"SELECT name FROM users EXCEPT SELECT login FROM admins UNION SELECT UPPER(login) FROM admins", []string{"bob", "cid", "ANN", "DAN"}},
+	}
+	for _, tc := range tcs {
+		var args []interface{}
+		if strings.Contains(tc.sql, "?") {
+			args = []interface{}{3, "dan"}
+		}
+		if got := values(tc.sql, args...); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.sql, tc.want, got)
+		}
+	}
+
+	res, err := db.Exec(ctx, "SELECT id, name AS who FROM users UNION SELECT id, login FROM admins")
+	if err != nil || !reflect.DeepEqual(res.Columns, []Column{{Name: "id", Type: INT}, {Name: "who", Type: TEXT}}) {
+		t.Errorf("Unexpected columns %v (%v)", res.Columns, err)
+	}
+	st, err := db.Prepare("SELECT name FROM users WHERE id = ? EXCEPT SELECT login FROM admins WHERE id = ?")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if types, err := st.ParamTypes(); err != nil || !reflect.DeepEqual(types, []FieldType{INT, INT}) {
+		t.Errorf("Unexpected parameter types %v (%v)", types, err)
+	}
+	rows, err := db.Query(ctx, "SELECT DISTINCT name FROM users WHERE active = ?", true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	rows.Close()
+	if n != 1 {
+		t.Errorf("Expected a single row, got %d", n)
+	}
+
+	expectCode := func(sql string, code ErrorCode) {
+		t.Helper()
+		if _, err := db.Exec(ctx, sql); ErrorCodeOf(err) != code {
+			t.Errorf("%s: expected %s, got %v", sql, code, err)
+		}
+	}
+	expectCode("SELECT id FROM users UNION SELECT login FROM admins", ErrDatatypeMismatch)
+	expectCode("SELECT id, name FROM users UNION SELECT id FROM admins", ErrSyntax)
+	expectCode("SELECT id FROM users UNION SELECT id FROM nope", ErrUndefinedTable)
+	expectCode("SELECT id FROM users UNION DELETE FROM admins WHERE id = '1'", ErrSyntax)
+	expectCode("SELECT id FROM users UNION", ErrSyntax)
+	expectCode("EXPLAIN SELECT DISTINCT id FROM users", ErrFeatureNotSupported)
+}
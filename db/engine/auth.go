@@ -0,0 +1,585 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rrowniak/sqlparser/query"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authFileName is the file in DbDir holding users and their grants.
+const authFileName = "auth.json"
+
+// Privilege is a set of statement kinds a user may run on a table.
+type Privilege uint8
+
+const (
+	PrivSelect Privilege = 1 << iota
+	PrivInsert
+	PrivUpdate
+	PrivDelete
+	// PrivDDL covers CREATE TABLE, CREATE INDEX and DROP TABLE.
+	PrivDDL
+
+	PrivAll = PrivSelect | PrivInsert | PrivUpdate | PrivDelete | PrivDDL
+)
+
+var privilegeNames = []struct {
+	priv Privilege
+	name string
+}{
+	{PrivSelect, "SELECT"},
+	{PrivInsert, "INSERT"},
+	{PrivUpdate, "UPDATE"},
+	{PrivDelete, "DELETE"},
+	{PrivDDL, "DDL"},
+}
+
+func (p Privilege) names() []string {
+	var names []string
+	for _, pn := range privilegeNames {
+		if p&pn.priv != 0 {
+			names = append(names, pn.name)
+		}
+	}
+	return names
+}
+
+func (p Privilege) String() string {
+	return strings.Join(p.names(), ", ")
+}
+
+func privilegeOf(qt query.Type) Privilege {
+	switch qt {
+	case query.Select:
+		return PrivSelect
+	case query.Insert:
+		return PrivInsert
+	case query.Update:
+		return PrivUpdate
+	case query.Delete:
+		return PrivDelete
+	default:
+		return PrivDDL
+	}
+}
+
+type authUser struct {
+	Name string `json:"name"`
+	// Password is a bcrypt hash.
+	Password string `json:"password,omitempty"`
+	// ApiKeys are SHA-256 hashes of the keys issued to the user.
+	ApiKeys   []string `json:"api_keys,omitempty"`
+	Superuser bool     `json:"superuser,omitempty"`
+}
+
+type authFile struct {
+	Users  []*authUser                    `json:"users"`
+	Grants map[string]map[string][]string `json:"grants"`
+}
+
+// authStore keeps users and per-table grants, every change is written to
+// the auth file right away. The table '*' stands for all tables.
+//
+// The file may also be changed by another process, like the user
+// management commands run next to a server. Changes lock the file and load
+// it again before they are applied, reads load it again once it changed.
+type authStore struct {
+	lock   *sync.RWMutex
+	path   string
+	users  map[string]*authUser
+	keys   map[string]string
+	grants map[string]map[string]Privilege
+	// loaded describes the file the store was read from or written to,
+	// nil if there was none
+	loaded os.FileInfo
+}
+
+func loadAuth(path string) (*authStore, error) {
+	a := &authStore{lock: &sync.RWMutex{}, path: path}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load reads the auth file, must be called with the lock held.
+func (a *authStore) load() error {
+	a.users = make(map[string]*authUser)
+	a.keys = make(map[string]string)
+	a.grants = make(map[string]map[string]Privilege)
+	a.loaded = nil
+
+	info, err := os.Stat(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var f authFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return errorf(ErrInternal, "corrupted auth file %s: %s", a.path, err)
+	}
+	a.loaded = info
+
+	for _, u := range f.Users {
+		a.users[u.Name] = u
+		for _, k := range u.ApiKeys {
+			a.keys[k] = u.Name
+		}
+	}
+	for user, tables := range f.Grants {
+		a.grants[user] = make(map[string]Privilege)
+		for table, names := range tables {
+			for _, n := range names {
+				for _, pn := range privilegeNames {
+					if pn.name == n {
+						a.grants[user][table] |= pn.priv
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// changed tells whether the auth file is not the one last read or written.
+func (a *authStore) changed() bool {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return a.loaded != nil || !os.IsNotExist(err)
+	}
+	return a.loaded == nil || !info.ModTime().Equal(a.loaded.ModTime()) || info.Size() != a.loaded.Size()
+}
+
+// refresh loads the auth file again if another process changed it. The
+// store is kept as it is if the file can't be read.
+func (a *authStore) refresh() {
+	a.lock.RLock()
+	changed := a.changed()
+	a.lock.RUnlock()
+	if !changed {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.changed() {
+		a.reload()
+	}
+}
+
+// reload loads the auth file, keeping the store if that fails. Must be
+// called with the lock held.
+func (a *authStore) reload() error {
+	prev := *a
+	if err := a.load(); err != nil {
+		*a = prev
+		return err
+	}
+	return nil
+}
+
+// changeAuth locks the auth store and file and loads the file again if
+// another process changed it. The returned function unlocks both. Like a
+// failed save, failing to lock the file turns the engine read-only.
+func (db *DbEngine) changeAuth() (func(), error) {
+	a := db.auth
+	a.lock.Lock()
+	unlock, err := lockFile(a.path + ".lock")
+	if err != nil {
+		a.lock.Unlock()
+		db.setReadOnly(err)
+		return nil, errorf(ErrInternal, "cannot lock %s: %s", authFileName, err)
+	}
+	done := func() {
+		unlock()
+		a.lock.Unlock()
+	}
+	if a.changed() {
+		if err := a.reload(); err != nil {
+			done()
+			return nil, errorf(ErrInternal, "cannot read %s: %s", authFileName, err)
+		}
+	}
+	return done, nil
+}
+
+// saveAuth persists the auth store, must be called with its lock held. If
+// the write fails the change is reverted by undo and the engine turns
+// read-only.
+func (db *DbEngine) saveAuth(undo func()) error {
+	if err := db.auth.save(); err != nil {
+		undo()
+		db.setReadOnly(err)
+		return errorf(ErrInternal, "cannot save %s: %s", authFileName, err)
+	}
+	return nil
+}
+
+// save writes the store, must be called with the lock held.
+func (a *authStore) save() error {
+	f := authFile{Grants: make(map[string]map[string][]string)}
+	for _, u := range a.users {
+		f.Users = append(f.Users, u)
+	}
+	sort.Slice(f.Users, func(i, j int) bool { return f.Users[i].Name < f.Users[j].Name })
+	for user, tables := range a.grants {
+		f.Grants[user] = make(map[string][]string)
+		for table, p := range tables {
+			f.Grants[user][table] = p.names()
+		}
+	}
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		return err
+	}
+	a.loaded, err = os.Stat(a.path)
+	return err
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateUser adds a user who logs in with password. Passwords are stored
+// as bcrypt hashes.
+func (db *DbEngine) CreateUser(name, password string, superuser bool) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	if name == "" {
+		return errorf(ErrInvalidParameter, "empty user name")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errorf(ErrInvalidParameter, "%s", err)
+	}
+
+	a := db.auth
+	done, err := db.changeAuth()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if _, ok := a.users[name]; ok {
+		return errorf(ErrDuplicateObject, "user %s already exists", name)
+	}
+	a.users[name] = &authUser{Name: name, Password: string(hash), Superuser: superuser}
+	return db.saveAuth(func() { delete(a.users, name) })
+}
+
+// DropUser removes a user with all the keys and grants.
+func (db *DbEngine) DropUser(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	a := db.auth
+	done, err := db.changeAuth()
+	if err != nil {
+		return err
+	}
+	defer done()
+	u, ok := a.users[name]
+	if !ok {
+		return errorf(ErrUndefinedObject, "user %s does not exist", name)
+	}
+	grants := a.grants[name]
+	for _, k := range u.ApiKeys {
+		delete(a.keys, k)
+	}
+	delete(a.users, name)
+	delete(a.grants, name)
+	return db.saveAuth(func() {
+		a.users[name] = u
+		a.grants[name] = grants
+		for _, k := range u.ApiKeys {
+			a.keys[k] = name
+		}
+	})
+}
+
+// CreateApiKey issues a new API key for the user. The key is returned only
+// once, the engine keeps just its hash.
+func (db *DbEngine) CreateApiKey(name string) (string, error) {
+	if err := db.checkWritable(); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	key := "gpk_" + hex.EncodeToString(buf)
+
+	a := db.auth
+	done, err := db.changeAuth()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	u, ok := a.users[name]
+	if !ok {
+		return "", errorf(ErrUndefinedObject, "user %s does not exist", name)
+	}
+	h := hashApiKey(key)
+	u.ApiKeys = append(u.ApiKeys, h)
+	a.keys[h] = name
+	undo := func() {
+		u.ApiKeys = u.ApiKeys[:len(u.ApiKeys)-1]
+		delete(a.keys, h)
+	}
+	if err := db.saveAuth(undo); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// AuthEnabled reports whether any user exists. Until then the engine
+// accepts requests from everybody.
+func (db *DbEngine) AuthEnabled() bool {
+	db.auth.refresh()
+	db.auth.lock.RLock()
+	defer db.auth.lock.RUnlock()
+	return len(db.auth.users) > 0
+}
+
+// Authenticate checks the password of a user.
+func (db *DbEngine) Authenticate(name, password string) error {
+	db.auth.refresh()
+	db.auth.lock.RLock()
+	u, ok := db.auth.users[name]
+	db.auth.lock.RUnlock()
+	if !ok || u.Password == "" || bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return errorf(ErrInvalidAuthorization, "invalid user name or password")
+	}
+	return nil
+}
+
+// AuthenticateKey returns the user an API key was issued to.
+func (db *DbEngine) AuthenticateKey(key string) (string, error) {
+	db.auth.refresh()
+	db.auth.lock.RLock()
+	defer db.auth.lock.RUnlock()
+	name, ok := db.auth.keys[hashApiKey(key)]
+	if !ok {
+		return "", errorf(ErrInvalidAuthorization, "invalid API key")
+	}
+	return name, nil
+}
+
+// CheckPrivilege fails unless user may run statements of kind p on table.
+// An empty user is a trusted in-process caller.
+func (db *DbEngine) CheckPrivilege(user, table string, p Privilege) error {
+	if user == "" || p == PrivSelect && isInfoSchema(table) {
+		return nil
+	}
+	a := db.auth
+	a.refresh()
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	u, ok := a.users[user]
+	if !ok {
+		return errorf(ErrInvalidAuthorization, "user %s does not exist", user)
+	}
+	if u.Superuser {
+		return nil
+	}
+	granted := a.grants[user][table] | a.grants[user]["*"]
+	if granted&p != p {
+		return errorf(ErrInsufficientPrivilege, "permission denied: %s on table %s", p, table)
+	}
+	return nil
+}
+
+func (db *DbEngine) isSuperuser(user string) bool {
+	db.auth.lock.RLock()
+	defer db.auth.lock.RUnlock()
+	u, ok := db.auth.users[user]
+	return ok && u.Superuser
+}
+
+type userKey struct{}
+
+// WithUser returns a context whose statements run with the privileges of
+// user.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFrom returns the user set by WithUser.
+func UserFrom(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// grantStmt is either 'GRANT privs ON table TO user' or
+// 'REVOKE privs ON table FROM user'. privs is a comma separated list of
+// privilege names or ALL [PRIVILEGES].
+type grantStmt struct {
+	revoke bool
+	privs  Privilege
+	table  string
+	user   string
+}
+
+// isGrantStmt tells statements handled by the engine itself apart from
+// the ones given to sqlparser.
+func isGrantStmt(sql string) bool {
+	f := strings.Fields(sql)
+	if len(f) == 0 {
+		return false
+	}
+	kw := strings.ToUpper(f[0])
+	return kw == "GRANT" || kw == "REVOKE"
+}
+
+func parseGrant(sql string) (grantStmt, error) {
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	tokens := strings.Fields(strings.ReplaceAll(sql, ",", " , "))
+	var g grantStmt
+	g.revoke = strings.ToUpper(tokens[0]) == "REVOKE"
+
+	i := 1
+	next := func() string {
+		if i >= len(tokens) {
+			return ""
+		}
+		i++
+		return tokens[i-1]
+	}
+
+	for {
+		tok := strings.ToUpper(next())
+		switch tok {
+		case "ALL":
+			g.privs |= PrivAll
+			if i < len(tokens) && strings.ToUpper(tokens[i]) == "PRIVILEGES" {
+				i++
+			}
+		case "CREATE", "DROP":
+			g.privs |= PrivDDL
+		default:
+			found := false
+			for _, pn := range privilegeNames {
+				if pn.name == tok {
+					g.privs |= pn.priv
+					found = true
+				}
+			}
+			if !found {
+				return g, errorf(ErrSyntax, "unknown privilege '%s'", tok)
+			}
+		}
+		if i < len(tokens) && tokens[i] == "," {
+			i++
+			continue
+		}
+		break
+	}
+
+	if strings.ToUpper(next()) != "ON" {
+		return g, errorf(ErrSyntax, "ON expected")
+	}
+	g.table = next()
+	if strings.ToUpper(g.table) == "TABLE" {
+		g.table = next()
+	}
+	if g.table == "" {
+		return g, errorf(ErrSyntax, "table name expected")
+	}
+	kw := "TO"
+	if g.revoke {
+		kw = "FROM"
+	}
+	if strings.ToUpper(next()) != kw {
+		return g, errorf(ErrSyntax, "%s expected", kw)
+	}
+	g.user = next()
+	if g.user == "" || i != len(tokens) {
+		return g, errorf(ErrSyntax, "single user name expected")
+	}
+	return g, nil
+}
+
+// execGrant runs GRANT or REVOKE, only superusers and trusted callers may
+// change grants.
+func (db *DbEngine) execGrant(req QueryRequest) (res QueryResult) {
+	res.Status = "Syntax error"
+	g, err := parseGrant(req.Sql)
+	if err != nil {
+		res.Err = err
+		return
+	}
+
+	res.Status = "Permission denied"
+	if req.User != "" && !db.isSuperuser(req.User) {
+		res.Err = errorf(ErrInsufficientPrivilege, "permission denied: only superusers may grant privileges")
+		return
+	}
+
+	res.Status = "Read-only"
+	if err := db.checkWritable(); err != nil {
+		res.Err = err
+		return
+	}
+
+	res.Status = "Logic error"
+	a := db.auth
+	done, err := db.changeAuth()
+	if err != nil {
+		res.Err = err
+		return
+	}
+	defer done()
+	if _, ok := a.users[g.user]; !ok {
+		res.Err = errorf(ErrUndefinedObject, "user %s does not exist", g.user)
+		return
+	}
+	if a.grants[g.user] == nil {
+		a.grants[g.user] = make(map[string]Privilege)
+	}
+	prev, had := a.grants[g.user][g.table]
+	undo := func() {
+		if had {
+			a.grants[g.user][g.table] = prev
+		} else {
+			delete(a.grants[g.user], g.table)
+		}
+	}
+	if g.revoke {
+		a.grants[g.user][g.table] &^= g.privs
+		if a.grants[g.user][g.table] == 0 {
+			delete(a.grants[g.user], g.table)
+		}
+	} else {
+		a.grants[g.user][g.table] |= g.privs
+	}
+	if err := db.saveAuth(undo); err != nil {
+		res.Err = err
+		return
+	}
+	res.Status = "OK"
+	return
+}
@@ -0,0 +1,557 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rrowniak/sqlparser"
+	"github.com/rrowniak/sqlparser/query"
+)
+
+// slotMark starts every token substituted for a quoted literal or a bind
+// parameter before the statement is handed over to sqlparser. It can't appear
+// in a valid statement, so restored values never go through the parser.
+const slotMark = "\x00"
+
+// qualMark stands for the dot of a qualified name like
+// information_schema.tables while the statement is parsed, sqlparser
+// doesn't accept dots in identifiers.
+const qualMark = "*"
+
+// slot is either a literal taken verbatim from the statement or a reference
+// to a bind parameter (param >= 0).
+type slot struct {
+	literal string
+	param   int
+}
+
+// parsedStmt is a statement parsed once and bound to parameters on every
+// execution.
+type parsedStmt struct {
+	tmpl   query.Query
+	slots  []slot
+	params int
+	// show is set for SHOW and DESCRIBE, described is the table listed by
+	// DESCRIBE or SHOW COLUMNS
+	show      bool
+	described string
+	// explain is set for EXPLAIN, analyze for EXPLAIN ANALYZE
+	explain bool
+	analyze bool
+	// distinct is set for SELECT DISTINCT, compound holds the SELECTs
+	// combined with the one of tmpl by set operations
+	distinct bool
+	compound []compoundPart
+	// owner is the user who prepared the statement
+	owner string
+}
+
+func parseStmt(sql string) (*parsedStmt, error) {
+	if isExplainStmt(sql) {
+		return parseExplain(sql)
+	}
+	if isShowStmt(sql) {
+		q, described, err := parseShow(sql)
+		if err != nil {
+			return nil, err
+		}
+		return &parsedStmt{tmpl: q, show: true, described: described}, nil
+	}
+	text, slots, params, err := lexSql(sql)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := splitCompound(text)
+	if err != nil {
+		return nil, err
+	}
+	ps := &parsedStmt{params: params}
+	for i, part := range parts {
+		var q query.Query
+		var distinct bool
+		q, slots, distinct, err = parseLexed(part.text, slots)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) > 1 && q.Type != query.Select {
+			return nil, errorf(ErrSyntax, "set operations combine SELECT statements only")
+		}
+		if i == 0 {
+			ps.tmpl, ps.distinct = q, distinct
+			continue
+		}
+		part.tmpl, part.distinct = q, distinct
+		ps.compound = append(ps.compound, part)
+	}
+	ps.slots = slots
+	return ps, nil
+}
+
+// parseLexed parses a statement lexed by lexSql, slots gets the slots of
+// the literals rewriteExprs adds. DISTINCT right after SELECT is removed
+// and reported.
+func parseLexed(text string, slots []slot) (q query.Query, _ []slot, distinct bool, err error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return q, nil, false, err
+	}
+	if len(tokens) > 1 && tokens[0].isKeyword("SELECT") && tokens[1].isKeyword("DISTINCT") {
+		text = text[:tokens[1].start] + text[tokens[1].end:]
+		distinct = true
+	}
+	text, slots, exprs, err := rewriteExprs(text, slots)
+	if err != nil {
+		return q, nil, false, err
+	}
+	if q, err = sqlparser.Parse(text); err != nil {
+		return q, nil, false, errorf(ErrSyntax, "%s", err)
+	}
+	restoreExprs(&q, exprs)
+	restoreQualified(&q)
+	return q, slots, distinct, nil
+}
+
+// restoreQualified puts back the dots of qualified names replaced by
+// rewriteExprs.
+func restoreQualified(q *query.Query) {
+	restore := func(s string) string {
+		if s == "*" || strings.HasPrefix(s, slotMark) || isExpr(s) {
+			return s
+		}
+		return strings.ReplaceAll(s, qualMark, ".")
+	}
+	q.TableName = restore(q.TableName)
+	for i, f := range q.Fields {
+		q.Fields[i] = restore(f)
+	}
+	for i, c := range q.Conditions {
+		if c.Operand1IsField {
+			q.Conditions[i].Operand1 = restore(c.Operand1)
+		}
+		if c.Operand2IsField {
+			q.Conditions[i].Operand2 = restore(c.Operand2)
+		}
+	}
+}
+
+// bind returns a copy of the parsed statement with literals restored and
+// placeholders replaced with args.
+func (ps *parsedStmt) bind(args []interface{}) (query.Query, error) {
+	values, err := ps.values(args)
+	if err != nil {
+		return query.Query{}, err
+	}
+	return ps.bindTmpl(ps.tmpl, values), nil
+}
+
+// bindCompound binds the SELECTs of ps.compound like bind.
+func (ps *parsedStmt) bindCompound(args []interface{}) ([]query.Query, error) {
+	values, err := ps.values(args)
+	if err != nil {
+		return nil, err
+	}
+	qs := make([]query.Query, len(ps.compound))
+	for i, part := range ps.compound {
+		qs[i] = ps.bindTmpl(part.tmpl, values)
+	}
+	return qs, nil
+}
+
+// values formats the arguments of a statement.
+func (ps *parsedStmt) values(args []interface{}) ([]string, error) {
+	if len(args) != ps.params {
+		return nil, errorf(ErrWrongParamCount, "expected %d parameters, got %d", ps.params, len(args))
+	}
+	values := make([]string, len(args))
+	for i, a := range args {
+		var err error
+		if values[i], err = FormatValue(a); err != nil {
+			return nil, errorf(ErrInvalidParameter, "parameter %d: %s", i+1, err)
+		}
+		if strings.Contains(values[i], exprMark) {
+			return nil, errorf(ErrInvalidParameter, "parameter %d: unexpected control character", i+1)
+		}
+	}
+	return values, nil
+}
+
+// bindTmpl returns a copy of t with slot tokens replaced by literals and
+// parameter values.
+func (ps *parsedStmt) bindTmpl(t query.Query, values []string) query.Query {
+	slotValue := func(token string) (string, bool) {
+		i, e := strconv.Atoi(token[len(slotMark):])
+		if e != nil || i >= len(ps.slots) {
+			return "", false
+		}
+		if ps.slots[i].param >= 0 {
+			return values[ps.slots[i].param], true
+		}
+		return ps.slots[i].literal, true
+	}
+	// bindExpr replaces the slot tokens of an expression with quoted values
+	bindExpr := func(s string) string {
+		var b strings.Builder
+		for {
+			i := strings.Index(s, "'"+slotMark)
+			if i < 0 {
+				b.WriteString(s)
+				return b.String()
+			}
+			j := i + 1 + strings.IndexByte(s[i+1:], '\'')
+			v, ok := slotValue(s[i+1 : j])
+			if !ok {
+				v = s[i+1 : j]
+			}
+			b.WriteString(s[:i])
+			b.WriteString("'" + strings.ReplaceAll(v, "'", "''") + "'")
+			s = s[j+1:]
+		}
+	}
+	resolve := func(s string) string {
+		if isExpr(s) {
+			return bindExpr(s)
+		}
+		if !strings.HasPrefix(s, slotMark) {
+			return s
+		}
+		v, ok := slotValue(s)
+		switch {
+		case !ok:
+			return s
+		case isExpr(v):
+			// an expression assigned by UPDATE
+			return bindExpr(v)
+		}
+		return v
+	}
+
+	q := query.Query{
+		Type:      t.Type,
+		TableName: resolve(t.TableName),
+		IndexName: resolve(t.IndexName),
+	}
+	for _, f := range t.Fields {
+		q.Fields = append(q.Fields, resolve(f))
+	}
+	for _, c := range t.Conditions {
+		c.Operand1 = resolve(c.Operand1)
+		c.Operand2 = resolve(c.Operand2)
+		q.Conditions = append(q.Conditions, c)
+	}
+	if t.Updates != nil {
+		q.Updates = make(map[string]string, len(t.Updates))
+		for k, v := range t.Updates {
+			q.Updates[k] = resolve(v)
+		}
+	}
+	for _, ins := range t.Inserts {
+		row := make([]string, len(ins))
+		for i, v := range ins {
+			row[i] = resolve(v)
+		}
+		q.Inserts = append(q.Inserts, row)
+	}
+	if t.Aliases != nil {
+		q.Aliases = make(map[string]string, len(t.Aliases))
+		for k, v := range t.Aliases {
+			q.Aliases[resolve(k)] = resolve(v)
+		}
+	}
+	return q
+}
+
+// paramOf returns the parameter a slot token refers to, -1 for anything
+// else.
+func (ps *parsedStmt) paramOf(token string) int {
+	if !strings.HasPrefix(token, slotMark) {
+		return -1
+	}
+	i, err := strconv.Atoi(token[len(slotMark):])
+	if err != nil || i >= len(ps.slots) {
+		return -1
+	}
+	return ps.slots[i].param
+}
+
+// lexSql replaces quoted literals and placeholders with slot tokens,
+// normalizes whitespace and strips a trailing semicolon.
+// Placeholders are either positional ('?') or numbered ('$1'), a statement
+// can't mix both styles.
+// A quote inside a literal is escaped either by doubling it or with a backslash.
+func lexSql(sql string) (text string, slots []slot, params int, err error) {
+	if strings.Contains(sql, slotMark) || strings.Contains(sql, exprMark) {
+		return "", nil, 0, errorf(ErrSyntax, "unexpected control character in query")
+	}
+
+	var b strings.Builder
+	positional, numbered := false, false
+	addSlot := func(s slot) {
+		fmt.Fprintf(&b, "'%s%d'", slotMark, len(slots))
+		slots = append(slots, s)
+	}
+
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch c {
+		case '\'':
+			var lit strings.Builder
+			closed := false
+			for i++; i < len(sql); i++ {
+				if sql[i] == '\\' && i+1 < len(sql) && sql[i+1] == '\'' {
+					lit.WriteByte('\'')
+					i++
+				} else if sql[i] == '\'' && i+1 < len(sql) && sql[i+1] == '\'' {
+					lit.WriteByte('\'')
+					i++
+				} else if sql[i] == '\'' {
+					closed = true
+					break
+				} else {
+					lit.WriteByte(sql[i])
+				}
+			}
+			if !closed {
+				return "", nil, 0, errorf(ErrSyntax, "unterminated quoted string")
+			}
+			addSlot(slot{literal: lit.String(), param: -1})
+		case '?':
+			positional = true
+			addSlot(slot{param: params})
+			params++
+		case '$':
+			j := i + 1
+			for j < len(sql) && sql[j] >= '0' && sql[j] <= '9' {
+				j++
+			}
+			if j == i+1 {
+				b.WriteByte(c)
+				continue
+			}
+			n, e := strconv.Atoi(sql[i+1 : j])
+			if e != nil || n < 1 {
+				return "", nil, 0, errorf(ErrSyntax, "invalid placeholder %s", sql[i:j])
+			}
+			numbered = true
+			addSlot(slot{param: n - 1})
+			if n > params {
+				params = n
+			}
+			i = j - 1
+		case '\t', '\n', '\r':
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	if positional && numbered {
+		return "", nil, 0, errorf(ErrSyntax, "mixed '?' and '$n' placeholders")
+	}
+
+	text = strings.TrimSpace(b.String())
+	text = strings.TrimSpace(strings.TrimSuffix(text, ";"))
+	return text, slots, params, nil
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// exprToken is the identifier standing for an expression while the
+// statement is parsed, followed by the number of the expression.
+const exprToken = "*x"
+
+// rewriteExprs replaces the expressions of a statement lexed by lexSql,
+// which sqlparser doesn't accept, with tokens it does:
+//
+//	SELECT fields become an identifier *xN
+//	WHERE conditions become *xN = 'true'
+//	UPDATE values become a literal slot holding exprMark and the expression
+//
+// exprs[N] is the source of the expression *xN stands for. Numbers outside
+// of expressions become literal slots, dots of qualified names qualMark.
+func rewriteExprs(text string, slots []slot) (string, []slot, []string, error) {
+	tokens, err := tokenize(text)
+	if err != nil || len(tokens) == 0 {
+		return text, slots, nil, err
+	}
+
+	type edit struct {
+		start, end int
+		repl       string
+	}
+	var edits []edit
+	var exprs []string
+	inExpr := make([]bool, len(tokens))
+	addExpr := func(from, to int) string {
+		for i := from; i < to; i++ {
+			inExpr[i] = true
+		}
+		exprs = append(exprs, text[tokens[from].start:tokens[to-1].end])
+		return exprToken + strconv.Itoa(len(exprs)-1)
+	}
+	addSlot := func(s slot) string {
+		slots = append(slots, s)
+		return fmt.Sprintf("'%s%d'", slotMark, len(slots)-1)
+	}
+
+	where := func(from int) {
+		for _, c := range splitTop(tokens, from, len(tokens), func(tk token) bool { return tk.isKeyword("AND") }) {
+			if c[1]-c[0] == 3 && isColumnToken(tokens[c[0]]) && isComparison(tokens[c[0]+1]) {
+				if v := tokens[c[0]+2]; v.kind == tokString || v.kind == tokNumber || isColumnToken(v) {
+					if tokens[c[0]+1].isOp("<>") {
+						edits = append(edits, edit{tokens[c[0]+1].start, tokens[c[0]+1].end, "!="})
+					}
+					continue
+				}
+			}
+			if c[1] > c[0] {
+				token := addExpr(c[0], c[1])
+				edits = append(edits, edit{tokens[c[0]].start, tokens[c[1]-1].end, token + " = " + addSlot(slot{literal: "true", param: -1})})
+			}
+		}
+	}
+	whereAfter := func(from int) {
+		if i := findTop(tokens, from, "WHERE"); i >= 0 {
+			where(i + 1)
+		}
+	}
+
+	switch {
+	case tokens[0].isKeyword("SELECT"):
+		from := findTop(tokens, 1, "FROM")
+		if from < 0 {
+			break
+		}
+		for _, f := range splitTop(tokens, 1, from, func(tk token) bool { return tk.isOp(",") }) {
+			end := f[1]
+			if end-f[0] >= 3 && tokens[end-2].isKeyword("AS") {
+				end -= 2
+			}
+			if end-f[0] == 1 && (isColumnToken(tokens[f[0]]) || tokens[f[0]].isOp("*")) || end == f[0] {
+				continue
+			}
+			edits = append(edits, edit{tokens[f[0]].start, tokens[end-1].end, addExpr(f[0], end)})
+		}
+		whereAfter(from)
+	case tokens[0].isKeyword("UPDATE"):
+		set := findTop(tokens, 1, "SET")
+		if set < 0 {
+			break
+		}
+		end := findTop(tokens, set, "WHERE")
+		if end < 0 {
+			end = len(tokens)
+		}
+		for _, a := range splitTop(tokens, set+1, end, func(tk token) bool { return tk.isOp(",") }) {
+			if a[1]-a[0] < 3 || !tokens[a[0]+1].isOp("=") {
+				continue
+			}
+			v := a[0] + 2
+			if a[1]-v == 1 && (tokens[v].kind == tokString || tokens[v].kind == tokNumber) {
+				continue
+			}
+			addExpr(v, a[1])
+			lit := addSlot(slot{literal: exprMark + exprs[len(exprs)-1], param: -1})
+			edits = append(edits, edit{tokens[v].start, tokens[a[1]-1].end, lit})
+		}
+		whereAfter(end)
+	case tokens[0].isKeyword("DELETE"):
+		whereAfter(1)
+	}
+
+	for i, tk := range tokens {
+		switch {
+		case inExpr[i]:
+		case tk.kind == tokNumber:
+			edits = append(edits, edit{tk.start, tk.end, addSlot(slot{literal: tk.text, param: -1})})
+		case tk.kind == tokIdent && strings.Contains(tk.text, "."):
+			edits = append(edits, edit{tk.start, tk.end, strings.ReplaceAll(tk.text, ".", qualMark)})
+		}
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var b strings.Builder
+	pos := 0
+	for _, e := range edits {
+		b.WriteString(text[pos:e.start])
+		b.WriteString(e.repl)
+		pos = e.end
+	}
+	b.WriteString(text[pos:])
+	return b.String(), slots, exprs, nil
+}
+
+// restoreExprs puts the expressions replaced by rewriteExprs into q.
+func restoreExprs(q *query.Query, exprs []string) {
+	restore := func(s string) string {
+		if !strings.HasPrefix(s, exprToken) {
+			return s
+		}
+		i, err := strconv.Atoi(s[len(exprToken):])
+		if err != nil || i >= len(exprs) {
+			return s
+		}
+		return exprMark + exprs[i]
+	}
+	for i, f := range q.Fields {
+		q.Fields[i] = restore(f)
+	}
+	for i, c := range q.Conditions {
+		if c.Operand1IsField {
+			q.Conditions[i].Operand1 = restore(c.Operand1)
+		}
+	}
+	for k, v := range q.Aliases {
+		if r := restore(k); r != k {
+			delete(q.Aliases, k)
+			q.Aliases[r] = v
+		}
+	}
+}
+
+// splitTop returns the ranges of tokens[from:to] separated by tokens sep
+// matches outside of parentheses and CASE ... END.
+func splitTop(tokens []token, from, to int, sep func(token) bool) [][2]int {
+	var parts [][2]int
+	depth, start := 0, from
+	for i := from; i < to; i++ {
+		tk := tokens[i]
+		switch {
+		case tk.isOp("(") || tk.isKeyword("CASE"):
+			depth++
+		case tk.isOp(")") || tk.isKeyword("END"):
+			depth--
+		case depth == 0 && sep(tk):
+			parts = append(parts, [2]int{start, i})
+			start = i + 1
+		}
+	}
+	return append(parts, [2]int{start, to})
+}
+
+// findTop returns the position of the first keyword kw after from outside
+// of parentheses and CASE ... END, or -1.
+func findTop(tokens []token, from int, kw string) int {
+	parts := splitTop(tokens, from, len(tokens), func(tk token) bool { return tk.isKeyword(kw) })
+	if len(parts) == 1 {
+		return -1
+	}
+	return parts[0][1]
+}
+
+// isColumnToken tells identifiers that may name a column apart from
+// keywords of expressions.
+func isColumnToken(tk token) bool {
+	return tk.kind == tokIdent && !isExprKeyword(tk.text)
+}
+
+func isComparison(tk token) bool {
+	switch {
+	case tk.isOp("="), tk.isOp("!="), tk.isOp("<>"), tk.isOp("<"), tk.isOp("<="), tk.isOp(">"), tk.isOp(">="):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package engine
+
+import "sort"
+
+// Tables returns the names of all tables in alphabetical order.
+func (db *DbEngine) Tables() []string {
+	db.lockTables.RLock()
+	defer db.lockTables.RUnlock()
+	names := make([]string, 0, len(db.tables))
+	for n := range db.tables {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TableColumns returns the schema of the table name, which may also be a
+// view of information_schema.
+func (db *DbEngine) TableColumns(name string) ([]Column, error) {
+	if sch, ok := infoSchemaView(name); ok {
+		return columnsOf(sch), nil
+	}
+	db.lockTables.RLock()
+	t, ok := db.tables[name]
+	db.lockTables.RUnlock()
+	if !ok {
+		return nil, errorf(ErrUndefinedTable, "table %s does not exist", name)
+	}
+
+	t.tableLock.RLock()
+	defer t.tableLock.RUnlock()
+	return columnsOf(t.sch), nil
+}
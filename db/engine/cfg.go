@@ -1,5 +1,11 @@
 package engine
 
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+)
+
 func NewConfigDefault() *Cfg {
 	return &Cfg{
 		DbDir:            ".",
@@ -9,11 +15,25 @@ func NewConfigDefault() *Cfg {
 		MaxRestRequests:  10,
 		MaxDbRequests:    10,
 		QueryTimeoutSecs: 30,
+		MaxPreparedStmts: 1000,
 	}
 }
 
-func NewConfig(filename string) *Cfg {
-	panic("Not implemented")
+// NewConfig reads the configuration from the JSON file filename, keys are
+// named after the fields of Cfg. Settings missing from the file keep their
+// defaults, unknown keys are rejected.
+func NewConfig(filename string) (*Cfg, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := NewConfigDefault()
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(cfg); err != nil {
+		return nil, errorf(ErrInvalidParameter, "invalid configuration %s: %s", filename, err)
+	}
+	return cfg, nil
 }
 
 type Cfg struct {
@@ -24,4 +44,30 @@ type Cfg struct {
 	MaxRestRequests  int
 	MaxDbRequests    int
 	QueryTimeoutSecs int
+	// MaxPreparedStmts limits the statements a single user may keep
+	// prepared. Zero disables the limit.
+	MaxPreparedStmts int
+	// TlsCertFile and TlsKeyFile switch the REST server to HTTPS, the files
+	// are reloaded when they change on disk.
+	TlsCertFile string
+	TlsKeyFile  string
+	// TlsClientCAFile enables mutual TLS, clients must present a
+	// certificate signed by one of the CAs in the file.
+	TlsClientCAFile string
+	// RateLimitPerSec limits the REST requests of a single client, bursts
+	// of up to RateLimitBurst requests are allowed. Zero disables the limit.
+	RateLimitPerSec float64
+	RateLimitBurst  int
+	// TrustedProxies lists the addresses or CIDR ranges of the proxies
+	// whose X-Forwarded-For and X-Real-IP headers name the client. Without
+	// any, clients are told apart by the address they connect from.
+	TrustedProxies []string
+	// PgPort enables the PostgreSQL wire protocol listener on ServHost.
+	// Zero disables it.
+	PgPort int
+	// MySqlPort enables the MySQL protocol listener on ServHost. Zero
+	// disables it.
+	MySqlPort int
+	// GrpcPort enables the gRPC API on ServHost. Zero disables it.
+	GrpcPort int
 }
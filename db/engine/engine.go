@@ -1,27 +1,64 @@
 package engine
 
 import (
-	"fmt"
+	"context"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/rrowniak/sqlparser"
 	"github.com/rrowniak/sqlparser/query"
 )
 
 func NewDbEngine(cfg *Cfg) (*DbEngine, error) {
-	return &DbEngine{cfg: cfg, lockTables: &sync.RWMutex{}, tables: make(map[string]*table)}, nil
+	auth, err := loadAuth(filepath.Join(cfg.DbDir, authFileName))
+	if err != nil {
+		return nil, err
+	}
+	return &DbEngine{
+		cfg:        cfg,
+		lockTables: &sync.RWMutex{},
+		tables:     make(map[string]*table),
+		lockStmts:  &sync.Mutex{},
+		stmts:      make(map[string]*parsedStmt),
+		stmtCount:  make(map[string]int),
+		lockFuncs:  &sync.RWMutex{},
+		funcs:      make(map[string]*sqlFunc),
+		auth:       auth,
+		stats:      newQueryStats(),
+		lockErr:    &sync.Mutex{},
+	}, nil
 }
 
+// QueryRequest asks the engine to execute either Sql or, if Handle is set,
+// a statement prepared before. Args are bound to the statement placeholders.
+//
+// If Rows is set, SELECT results are not collected in QueryResult.Rows but
+// sent one by one to Rows after the result has been sent to Resp. Rows is
+// closed once the statement is done or Ctx is cancelled. If the statement
+// fails after the first result was sent, a second result with the error is
+// sent to Resp before Rows is closed.
+//
+// The statement runs with the privileges of User, an empty User is a
+// trusted in-process caller allowed to do anything.
 type QueryRequest struct {
-	Sql  string
-	Resp chan QueryResult
+	Sql    string
+	Handle string
+	Args   []interface{}
+	Resp   chan QueryResult
+	Rows   chan Row
+	Ctx    context.Context
+	User   string
 }
 
 type QueryResult struct {
-	Err    error
-	Status string
-	Rows   []Row
+	Err     error
+	Status  string
+	Columns []Column
+	Rows    []Row
+	// RowsAffected is the number of records inserted, updated or deleted.
+	RowsAffected int
 }
 
 type Row struct {
@@ -29,6 +66,13 @@ type Row struct {
 }
 
 type DbEngine struct {
+	// lastCompact is the UnixNano time of the last compaction, compactions
+	// and compactNanos count them and the time they took. They are
+	// accessed atomically and kept first to be 64-bit aligned
+	lastCompact  int64
+	compactions  int64
+	compactNanos int64
+
 	cfg            *Cfg
 	lockTables     *sync.RWMutex
 	quit           chan struct{}
@@ -36,45 +80,184 @@ type DbEngine struct {
 	reqWorkersPool chan struct{}
 
 	tables map[string]*table
+
+	lockStmts *sync.Mutex
+	stmts     map[string]*parsedStmt
+	stmtCount map[string]int
+	lastStmt  int
+
+	lockFuncs *sync.RWMutex
+	funcs     map[string]*sqlFunc
+
+	auth  *authStore
+	stats *queryStats
+
+	state   int32
+	started time.Time
+	lockErr *sync.Mutex
+	lastErr error
 }
 
 func (db *DbEngine) Start() {
 	db.quit = make(chan struct{})
 	db.requests = make(chan QueryRequest, db.cfg.MaxDbRequests)
 	db.reqWorkersPool = make(chan struct{}, db.cfg.MaxDbRequests*2)
+	db.started = time.Now()
+	db.setState(StateReady)
 	go db.main()
 }
 
 func (db *DbEngine) Stop() {
-	close(db.requests)
-	db.quit <- struct{}{}
+	db.setState(StateStopped)
 	close(db.quit)
 }
 
+// ProcessQuery queues req, its result is sent to req.Resp. Once the engine
+// is stopped the result is an ErrShutdown error.
 func (db *DbEngine) ProcessQuery(req QueryRequest) {
-	db.requests <- req
+	if db.stopped() {
+		db.rejectStopped(req)
+		return
+	}
+	select {
+	case db.requests <- req:
+	case <-db.quit:
+		db.rejectStopped(req)
+	}
+}
+
+// stopped tells whether Stop was called. Requests are checked before
+// they are queued, as nothing reads the queue once the engine stopped.
+func (db *DbEngine) stopped() bool {
+	select {
+	case <-db.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// rejectStopped answers req with an ErrShutdown error. The caller reads
+// Resp after ProcessQuery returns, so it is sent in the background.
+func (db *DbEngine) rejectStopped(req QueryRequest) {
+	go func() {
+		req.Resp <- QueryResult{Status: "Shutdown", Err: errorf(ErrShutdown, "database engine stopped")}
+		if req.Rows != nil {
+			close(req.Rows)
+		}
+	}()
 }
 
 func (db *DbEngine) execQuery(req QueryRequest) {
 	result := QueryResult{Status: "Unexpected failure"}
+	respSent := false
+	statement := "unknown"
+	start := time.Now()
 	defer func() {
+		db.stats.observe(statement, result.Err, time.Since(start))
 		<-db.reqWorkersPool
-		req.Resp <- result
+		if !respSent {
+			req.Resp <- result
+		} else if result.Err != nil {
+			// the rows were cut short, the reader finds the error once
+			// the rows are closed
+			var done <-chan struct{}
+			if req.Ctx != nil {
+				done = req.Ctx.Done()
+			}
+			select {
+			case req.Resp <- result:
+			case <-done:
+			}
+		}
+		if req.Rows != nil {
+			close(req.Rows)
+		}
 	}()
 
-	actual, err := sqlparser.Parse(req.Sql)
+	if req.Handle == "" && isGrantStmt(req.Sql) {
+		statement = "grant"
+		result = db.execGrant(req)
+		return
+	}
+	if req.Handle == "" && isAnalyzeStmt(req.Sql) {
+		statement = "analyze"
+		result = db.execAnalyze(req)
+		return
+	}
+
+	var ps *parsedStmt
+	var actual query.Query
+	var err error
+	if req.Handle != "" {
+		ps, err = db.preparedStmt(req.Handle, req.User)
+	} else {
+		ps, err = parseStmt(req.Sql)
+	}
+	if err == nil {
+		actual, err = ps.bind(req.Args)
+	}
 	if err != nil {
 		result.Status = "Syntax error"
 		result.Err = err
 		return
 	}
+	statement = statementName(actual.Type)
+	if ps.show {
+		statement = "show"
+	}
+	if ps.explain {
+		statement = "explain"
+		if !explainable(actual.Type) {
+			result.Status = "Syntax error"
+			result.Err = errorf(ErrFeatureNotSupported, "only SELECT, INSERT, UPDATE and DELETE can be explained")
+			return
+		}
+	}
+
+	if ps.described != "" {
+		if _, err := db.TableColumns(ps.described); err != nil {
+			result.Status = "Logic error"
+			result.Err = err
+			return
+		}
+		if err := db.CheckPrivilege(req.User, ps.described, PrivSelect); err != nil {
+			result.Status = "Permission denied"
+			result.Err = err
+			return
+		}
+	}
+
+	if err := db.CheckPrivilege(req.User, actual.TableName, privilegeOf(actual.Type)); err != nil {
+		result.Status = "Permission denied"
+		result.Err = err
+		return
+	}
+
+	// EXPLAIN without ANALYZE changes nothing
+	if actual.Type != query.Select && (!ps.explain || ps.analyze) {
+		if isInfoSchema(actual.TableName) {
+			result.Status = "Read-only"
+			result.Err = errorf(ErrReadOnly, "%s is read-only", infoSchema)
+			return
+		}
+		if err := db.checkWritable(); err != nil {
+			result.Status = "Read-only"
+			result.Err = err
+			return
+		}
+	}
 
 	result.Status = "Logic error"
 
 	if actual.Type == query.Create {
+		if strings.Contains(actual.TableName, ".") {
+			result.Err = errorf(ErrSyntax, "tables can't be created in schema %s", actual.TableName[:strings.IndexByte(actual.TableName, '.')])
+			return
+		}
 		db.lockTables.RLock()
 		if _, ok := db.tables[actual.TableName]; ok {
-			result.Err = fmt.Errorf("table %s already exists", actual.TableName)
+			result.Err = errorf(ErrDuplicateTable, "table %s already exists", actual.TableName)
 			db.lockTables.RUnlock()
 			return
 		}
@@ -85,37 +268,76 @@ func (db *DbEngine) execQuery(req QueryRequest) {
 		for _, f := range actual.Fields {
 			t, ok := actual.Updates[f]
 			if !ok {
-				result.Err = fmt.Errorf("field %s type definition missing", f)
+				result.Err = errorf(ErrSyntax, "field %s type definition missing", f)
 				return
 			}
 			ft := fieldTypeFromString(t)
 			if ft == UNKNOWN_FIELD_TYPE {
-				result.Err = fmt.Errorf("field %s type is not supported", t)
+				result.Err = errorf(ErrUndefinedObject, "field %s type is not supported", t)
 				return
 			}
 			sch.name = append(sch.name, f)
 			sch.colType = append(sch.colType, ft)
 		}
+		t := newTable(actual.TableName, sch)
+		t.funcs = db.lookupFunc
+		t.addIndex(actual.TableName+"_pkey", 0, true)
 		db.lockTables.Lock()
-		db.tables[actual.TableName] = newTable(actual.TableName, sch)
+		db.tables[actual.TableName] = t
 		db.lockTables.Unlock()
 
 		result.Status = "OK"
 		return
 	}
 
-	db.lockTables.RLock()
-	table, ok := db.tables[actual.TableName]
-	db.lockTables.RUnlock()
+	if ps.distinct || len(ps.compound) > 0 {
+		result = db.execSetQuery(req, ps, actual)
+		if req.Rows == nil || result.Err != nil {
+			return
+		}
+		respSent = true
+		streamRows(req, result)
+		return
+	}
 
+	table, ok := db.lookupTable(actual.TableName, req.User)
 	if !ok {
-		result.Err = fmt.Errorf("table %s does not exist", actual.TableName)
+		result.Err = errorf(ErrUndefinedTable, "table %s does not exist", actual.TableName)
+		return
+	}
+
+	if ps.explain {
+		result = table.explainQ(actual, ps.analyze)
+		if req.Rows == nil || result.Err != nil {
+			return
+		}
+		respSent = true
+		streamRows(req, result)
 		return
 	}
 
 	switch actual.Type {
 	case query.Select:
-		result = table.selectQ(actual)
+		if req.Rows == nil {
+			result = table.selectQ(actual)
+			break
+		}
+		ctx := req.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		header := func(res QueryResult) {
+			req.Resp <- res
+			respSent = true
+		}
+		result = table.selectEach(actual, header, func(row Row) bool {
+			select {
+			case req.Rows <- row:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
 	case query.Update:
 		result = table.updateQ(actual)
 	case query.Insert:
@@ -123,6 +345,9 @@ func (db *DbEngine) execQuery(req QueryRequest) {
 	case query.Delete:
 		result = table.deleteQ(actual)
 	case query.Drop:
+		db.lockTables.Lock()
+		delete(db.tables, actual.TableName)
+		db.lockTables.Unlock()
 		table.dropQ()
 		result.Status = "OK"
 	case query.CreateIndex:
@@ -130,29 +355,50 @@ func (db *DbEngine) execQuery(req QueryRequest) {
 	}
 }
 
-func (db *DbEngine) processRequests() {
-	for {
+// streamRows sends result without its rows to req.Resp, then the rows to
+// req.Rows.
+func streamRows(req QueryRequest, result QueryResult) {
+	ctx := req.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	rows := result.Rows
+	result.Rows = nil
+	req.Resp <- result
+	for _, row := range rows {
 		select {
-		case req := <-db.requests:
-			db.reqWorkersPool <- struct{}{}
-			go db.execQuery(req)
-		default:
+		case req.Rows <- row:
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// compact runs the periodic maintenance, for now refreshing the statistics
+// of tables that changed a lot.
+func (db *DbEngine) compact() {
+	start := time.Now()
+	db.refreshStats()
+	end := time.Now()
+	atomic.AddInt64(&db.compactNanos, int64(end.Sub(start)))
+	atomic.AddInt64(&db.compactions, 1)
+	atomic.StoreInt64(&db.lastCompact, end.UnixNano())
+}
+
 func (db *DbEngine) main() {
-	compactTimer := time.NewTimer(time.Duration(db.cfg.CompactEverySecs) * time.Second)
+	compactEvery := time.Duration(db.cfg.CompactEverySecs) * time.Second
+	compactTimer := time.NewTimer(compactEvery)
+	defer compactTimer.Stop()
 	for {
 		select {
 		case <-db.quit:
 			return
 		case <-compactTimer.C:
-			// launch compact operation
-		default:
-			// do other stuff
-			db.processRequests()
+			go db.compact()
+			compactTimer.Reset(compactEvery)
+		case req := <-db.requests:
+			db.reqWorkersPool <- struct{}{}
+			go db.execQuery(req)
 		}
 	}
 }
@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode is a SQLSTATE-style code classifying an Error.
+type ErrorCode string
+
+const (
+	ErrNoData                ErrorCode = "02000"
+	ErrSyntax                ErrorCode = "42601"
+	ErrUndefinedTable        ErrorCode = "42P01"
+	ErrUndefinedColumn       ErrorCode = "42703"
+	ErrUndefinedObject       ErrorCode = "42704"
+	ErrDuplicateTable        ErrorCode = "42P07"
+	ErrDuplicateObject       ErrorCode = "42710"
+	ErrInvalidStatement      ErrorCode = "26000"
+	ErrWrongParamCount       ErrorCode = "07001"
+	ErrInvalidParameter      ErrorCode = "22023"
+	ErrInvalidValue          ErrorCode = "22P02"
+	ErrDivisionByZero        ErrorCode = "22012"
+	ErrConstraintViolation   ErrorCode = "23000" // duplicate primary key value
+	ErrInvalidAuthorization  ErrorCode = "28000"
+	ErrInsufficientPrivilege ErrorCode = "42501"
+	ErrUndefinedFunction     ErrorCode = "42883"
+	ErrDatatypeMismatch      ErrorCode = "42804"
+	ErrGrouping              ErrorCode = "42803"
+	ErrExternalRoutine       ErrorCode = "38000"
+	ErrFeatureNotSupported   ErrorCode = "0A000"
+	ErrReadOnly              ErrorCode = "25006"
+	ErrTooManyRequests       ErrorCode = "53300"
+	ErrQueryTimeout          ErrorCode = "57014"
+	ErrShutdown              ErrorCode = "57P01"
+	ErrInternal              ErrorCode = "XX000"
+)
+
+// Error is returned by the engine for every failed statement.
+type Error struct {
+	Code ErrorCode
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func errorf(code ErrorCode, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+// ErrorCodeOf returns the code of err, errors that don't come from the
+// engine are reported as ErrInternal.
+func ErrorCodeOf(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ErrInternal
+}
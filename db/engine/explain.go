@@ -0,0 +1,279 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rrowniak/sqlparser/query"
+)
+
+// planColumn is the only column of the result of EXPLAIN.
+const planColumn = "QUERY PLAN"
+
+// opStats collects what EXPLAIN ANALYZE reports about an operator. A nil
+// *opStats collects nothing, which is what statements not being analyzed
+// pass around.
+type opStats struct {
+	scanned  int
+	matched  int
+	lockWait time.Duration
+	elapsed  time.Duration
+}
+
+func (st *opStats) rlock(l *sync.RWMutex) {
+	if st == nil {
+		l.RLock()
+		return
+	}
+	start := time.Now()
+	l.RLock()
+	st.lockWait += time.Since(start)
+}
+
+func (st *opStats) lock(l *sync.RWMutex) {
+	if st == nil {
+		l.Lock()
+		return
+	}
+	start := time.Now()
+	l.Lock()
+	st.lockWait += time.Since(start)
+}
+
+func (st *opStats) since(start time.Time) {
+	if st != nil {
+		st.elapsed += time.Since(start)
+	}
+}
+
+// planNode is an operator of the plan printed by EXPLAIN.
+type planNode struct {
+	op      string
+	details []string
+	child   *planNode
+	// estimate is the number of rows the planner expects
+	estimate float64
+	// stats and rows are set by EXPLAIN ANALYZE
+	stats *opStats
+	rows  int
+}
+
+// scanPlan describes the access path p to the records of t.
+func scanPlan(t *table, p accessPath) *planNode {
+	n := &planNode{op: "Full Scan on " + t.name, estimate: p.rows}
+	switch {
+	case p.isRange():
+		n.op = "Index Range Scan using " + p.idx.name + " on " + t.name
+	case p.idx != nil:
+		n.op = "Index Lookup using " + p.idx.name + " on " + t.name
+	}
+	if p.idx != nil {
+		n.details = append(n.details, "Index Cond: "+formatConditions(p.indexConds))
+	}
+	if len(p.filter) > 0 {
+		n.details = append(n.details, "Filter: "+formatConditions(p.filter))
+	}
+	return n
+}
+
+var operatorSymbols = map[query.Operator]string{
+	query.Eq:  "=",
+	query.Ne:  "!=",
+	query.Gt:  ">",
+	query.Lt:  "<",
+	query.Gte: ">=",
+	query.Lte: "<=",
+}
+
+func formatConditions(conds []query.Condition) string {
+	operand := func(s string, field bool) string {
+		if field {
+			return s
+		}
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+	parts := make([]string, len(conds))
+	for i, c := range conds {
+		if isExpr(c.Operand1) {
+			parts[i] = exprText(c.Operand1)
+			continue
+		}
+		parts[i] = fmt.Sprintf("%s %s %s", operand(c.Operand1, c.Operand1IsField), operatorSymbols[c.Operator], operand(c.Operand2, c.Operand2IsField))
+	}
+	return "(" + strings.Join(parts, " AND ") + ")"
+}
+
+// explainQ returns the plan of q as rows of a single TEXT column. With
+// analyze the statement is run, changes included, and every operator
+// reports the rows it produced, the records it scanned, how long it waited
+// for the table lock and how long it took.
+func (t *table) explainQ(q query.Query, analyze bool) (res QueryResult) {
+	t.tableLock.RLock()
+	err := t.validate(q)
+	var aggs []*aggExpr
+	if err == nil && q.Type == query.Select {
+		_, aggs, _ = projectFields(t.name, columnsOf(t.sch), q.Fields, q.Aliases, t.lookupFunc)
+	}
+	// deleted records are compacted in place, so DELETE always scans
+	p := t.plan(q.Conditions, q.Type != query.Delete)
+	t.tableLock.RUnlock()
+	if err != nil {
+		res.Err = err
+		res.Status = "Schema error"
+		return
+	}
+
+	scan := scanPlan(t, p)
+	root := scan
+	switch q.Type {
+	case query.Select:
+		if len(aggs) > 0 {
+			root = &planNode{op: "Aggregate", child: scan, estimate: 1}
+		}
+	case query.Insert:
+		root = &planNode{op: "Insert on " + t.name, estimate: float64(len(q.Inserts))}
+	case query.Update:
+		root = &planNode{op: "Update on " + t.name, child: scan, estimate: p.rows}
+	case query.Delete:
+		root = &planNode{op: "Delete on " + t.name, child: scan, estimate: p.rows}
+	}
+
+	var total time.Duration
+	if analyze {
+		start := time.Now()
+		st := &opStats{}
+		var run QueryResult
+		switch q.Type {
+		case query.Select:
+			emitted := 0
+			run = t.selectRows(q, nil, func(Row) bool {
+				emitted++
+				return true
+			}, st)
+			// reported by the aggregate, if any
+			run.RowsAffected = emitted
+		case query.Insert:
+			run = t.insertRows(q, st)
+		case query.Update:
+			run = t.updateRows(q, st)
+		case query.Delete:
+			run = t.deleteRows(q, st)
+		}
+		total = time.Since(start)
+		if run.Err != nil {
+			return run
+		}
+		if q.Type == query.Insert {
+			root.stats, root.rows = st, run.RowsAffected
+			st.elapsed = total
+		} else {
+			scan.stats, scan.rows = st, st.matched
+			if root != scan {
+				root.stats, root.rows = &opStats{elapsed: total}, run.RowsAffected
+			}
+		}
+	}
+
+	res.Status = "OK"
+	res.Columns = []Column{{Name: planColumn, Type: TEXT}}
+	add := func(line string) {
+		res.Rows = append(res.Rows, Row{Fields: map[string]string{planColumn: line}})
+	}
+	indent := ""
+	for n := root; n != nil; n = n.child {
+		// like the actual figures, estimates of less than a row are
+		// rounded up
+		rows := math.Round(n.estimate)
+		if rows == 0 && n.estimate > 0 {
+			rows = 1
+		}
+		line := fmt.Sprintf("%s  (rows=%.0f)", n.op, rows)
+		if n != root {
+			line = indent + "->  " + line
+			indent += "      "
+		}
+		if n.stats != nil {
+			line += " " + n.actual()
+		}
+		add(line)
+		for _, d := range n.details {
+			if n == root {
+				add("  " + d)
+			} else {
+				add(indent + d)
+			}
+		}
+		if n == root {
+			indent = "  "
+		}
+	}
+	if analyze {
+		add(fmt.Sprintf("Execution Time: %s", formatMillis(total)))
+	}
+	return
+}
+
+// actual formats the figures collected by EXPLAIN ANALYZE.
+func (n *planNode) actual() string {
+	st := n.stats
+	figures := []string{fmt.Sprintf("rows=%d", n.rows)}
+	if st.scanned > 0 {
+		figures = append(figures, fmt.Sprintf("scanned=%d", st.scanned))
+	}
+	if st.lockWait >= time.Microsecond {
+		figures = append(figures, "lock wait="+formatMillis(st.lockWait))
+	}
+	figures = append(figures, "time="+formatMillis(st.elapsed))
+	return "(actual " + strings.Join(figures, " ") + ")"
+}
+
+func formatMillis(d time.Duration) string {
+	return fmt.Sprintf("%.3f ms", float64(d.Microseconds())/1000)
+}
+
+// cutKeyword removes the keyword kw, in any case, from the start of sql.
+func cutKeyword(sql, kw string) (string, bool) {
+	sql = strings.TrimLeft(sql, " \t\r\n")
+	if len(sql) < len(kw) || !strings.EqualFold(sql[:len(kw)], kw) {
+		return sql, false
+	}
+	if len(sql) > len(kw) && !strings.ContainsRune(" \t\r\n", rune(sql[len(kw)])) {
+		return sql, false
+	}
+	return sql[len(kw):], true
+}
+
+// parseExplain parses EXPLAIN [ANALYZE] <statement>.
+func parseExplain(sql string) (*parsedStmt, error) {
+	sql, _ = cutKeyword(sql, "EXPLAIN")
+	sql, analyze := cutKeyword(sql, "ANALYZE")
+	if _, nested := cutKeyword(sql, "EXPLAIN"); nested {
+		return nil, errorf(ErrSyntax, "EXPLAIN can't be explained")
+	}
+	ps, err := parseStmt(sql)
+	if err != nil {
+		return nil, err
+	}
+	if ps.distinct || len(ps.compound) > 0 {
+		return nil, errorf(ErrFeatureNotSupported, "DISTINCT and set operations can't be explained")
+	}
+	ps.explain, ps.analyze = true, analyze
+	return ps, nil
+}
+
+func isExplainStmt(sql string) bool {
+	_, ok := cutKeyword(sql, "EXPLAIN")
+	return ok
+}
+
+// explainable tells whether EXPLAIN supports statements of type qt.
+func explainable(qt query.Type) bool {
+	switch qt {
+	case query.Select, query.Insert, query.Update, query.Delete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,1031 @@
+package engine
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// exprMark starts the fields, condition operands and assigned values of a
+// query that hold an expression instead of a column name or a value. Like
+// slotMark it can't appear in a statement.
+const exprMark = "\x01"
+
+func isExpr(s string) bool {
+	return strings.HasPrefix(s, exprMark)
+}
+
+// exprText returns the source of the expression s holds.
+func exprText(s string) string {
+	return strings.TrimPrefix(s, exprMark)
+}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	// text is the identifier, number or operator, or the unquoted string
+	text       string
+	start, end int
+}
+
+// isKeyword tells whether the token is the keyword kw, in any case.
+func (tk token) isKeyword(kw string) bool {
+	return tk.kind == tokIdent && strings.EqualFold(tk.text, kw)
+}
+
+// isExprKeyword tells whether s is a keyword an operand of an expression
+// may start with, which can't name a column or a function.
+func isExprKeyword(s string) bool {
+	switch strings.ToUpper(s) {
+	case "NULL", "TRUE", "FALSE", "CURRENT_TIMESTAMP", "CASE", "NOT":
+		return true
+	}
+	return false
+}
+
+func (tk token) isOp(op string) bool {
+	return tk.kind == tokOp && tk.text == op
+}
+
+var operators = []string{"||", "<=", ">=", "!=", "<>", "=", "<", ">", "+", "-", "*", "/", "%", "(", ")", ","}
+
+// tokenize splits s into tokens. Identifiers may be qualified with dots,
+// a quote inside a string is doubled.
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '\'':
+			var b strings.Builder
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+					b.WriteByte('\'')
+					i++
+				} else if s[i] == '\'' {
+					closed = true
+					i++
+					break
+				} else {
+					b.WriteByte(s[i])
+				}
+			}
+			if !closed {
+				return nil, errorf(ErrSyntax, "unterminated quoted string")
+			}
+			tokens = append(tokens, token{kind: tokString, text: b.String(), start: start, end: i})
+			continue
+		case c >= '0' && c <= '9':
+			for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+				i++
+			}
+			if i < len(s) && (s[i] == '.' || isIdentChar(s[i])) {
+				return nil, errorf(ErrSyntax, "invalid number at %q, only integers are supported", s[start:])
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: s[start:i], start: start, end: i})
+			continue
+		case isIdentChar(c):
+			for i < len(s) && (isIdentChar(s[i]) || s[i] == '.' && i+1 < len(s) && isIdentChar(s[i+1])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: s[start:i], start: start, end: i})
+			continue
+		}
+		matched := false
+		for _, op := range operators {
+			if strings.HasPrefix(s[i:], op) {
+				tokens = append(tokens, token{kind: tokOp, text: op, start: i, end: i + len(op)})
+				i += len(op)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, errorf(ErrSyntax, "unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+// expr is a compiled expression evaluated against the cells of a record.
+type expr interface {
+	eval(cells []string) (interface{}, error)
+	// typ is the type of the values of the expression, UNKNOWN_FIELD_TYPE
+	// for NULL and untyped strings, which take the type of what they are
+	// compared with.
+	typ() FieldType
+}
+
+type literalExpr struct {
+	v interface{}
+	t FieldType
+}
+
+func (e *literalExpr) eval([]string) (interface{}, error) { return e.v, nil }
+func (e *literalExpr) typ() FieldType                     { return e.t }
+
+type columnExpr struct {
+	i int
+	t FieldType
+}
+
+func (e *columnExpr) eval(cells []string) (interface{}, error) {
+	if cells[e.i] == "" && e.t != TEXT {
+		return nil, nil
+	}
+	return ParseValue(e.t, cells[e.i])
+}
+
+func (e *columnExpr) typ() FieldType { return e.t }
+
+type unaryExpr struct {
+	op string
+	x  expr
+}
+
+func (e *unaryExpr) eval(cells []string) (interface{}, error) {
+	v, err := e.x.eval(cells)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	if e.op == "NOT" {
+		b, err := toBool(v)
+		return !b, err
+	}
+	n, err := toInt(v)
+	return -n, err
+}
+
+func (e *unaryExpr) typ() FieldType {
+	if e.op == "NOT" {
+		return BOOL
+	}
+	return INT
+}
+
+type binaryExpr struct {
+	op   string
+	l, r expr
+}
+
+func (e *binaryExpr) eval(cells []string) (interface{}, error) {
+	l, err := e.l.eval(cells)
+	if err != nil {
+		return nil, err
+	}
+	// AND and OR follow three-valued logic and skip what they don't need
+	switch e.op {
+	case "AND", "OR":
+		var lb bool
+		if l != nil {
+			if lb, err = toBool(l); err != nil {
+				return nil, err
+			}
+			if lb == (e.op == "OR") {
+				return lb, nil
+			}
+		}
+		r, err := e.r.eval(cells)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			return nil, nil
+		}
+		rb, err := toBool(r)
+		if err != nil || l == nil && rb == (e.op == "AND") {
+			return nil, err
+		}
+		return rb, nil
+	}
+
+	r, err := e.r.eval(cells)
+	if err != nil || l == nil || r == nil {
+		return nil, err
+	}
+	switch e.op {
+	case "||":
+		return toText(l) + toText(r), nil
+	case "+", "-", "*", "/", "%":
+		a, err := toInt(l)
+		if err != nil {
+			return nil, err
+		}
+		b, err := toInt(r)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "+":
+			return a + b, nil
+		case "-":
+			return a - b, nil
+		case "*":
+			return a * b, nil
+		}
+		if b == 0 {
+			return nil, errorf(ErrDivisionByZero, "division by zero")
+		}
+		if e.op == "/" {
+			return a / b, nil
+		}
+		return a % b, nil
+	}
+	c, err := compareAny(l, r)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "=":
+		return c == 0, nil
+	case "!=", "<>":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func (e *binaryExpr) typ() FieldType {
+	switch e.op {
+	case "||":
+		return TEXT
+	case "+", "-", "*", "/", "%":
+		return INT
+	}
+	return BOOL
+}
+
+type isNullExpr struct {
+	x   expr
+	not bool
+}
+
+func (e *isNullExpr) eval(cells []string) (interface{}, error) {
+	v, err := e.x.eval(cells)
+	return (v == nil) != e.not, err
+}
+
+func (e *isNullExpr) typ() FieldType { return BOOL }
+
+// caseExpr is CASE [operand] WHEN ... THEN ... [ELSE ...] END, without an
+// operand the WHEN expressions are conditions.
+type caseExpr struct {
+	operand      expr
+	whens, thens []expr
+	els          expr
+}
+
+func (e *caseExpr) eval(cells []string) (interface{}, error) {
+	var operand interface{}
+	if e.operand != nil {
+		v, err := e.operand.eval(cells)
+		if err != nil {
+			return nil, err
+		}
+		operand = v
+	}
+	for i, w := range e.whens {
+		v, err := w.eval(cells)
+		if err != nil {
+			return nil, err
+		}
+		hit := false
+		switch {
+		case v == nil:
+		case e.operand == nil:
+			if hit, err = toBool(v); err != nil {
+				return nil, err
+			}
+		case operand != nil:
+			c, err := compareAny(operand, v)
+			if err != nil {
+				return nil, err
+			}
+			hit = c == 0
+		}
+		if hit {
+			return e.thens[i].eval(cells)
+		}
+	}
+	if e.els == nil {
+		return nil, nil
+	}
+	return e.els.eval(cells)
+}
+
+func (e *caseExpr) typ() FieldType {
+	return commonType(append(append([]expr(nil), e.thens...), e.els))
+}
+
+type callExpr struct {
+	f    *sqlFunc
+	args []expr
+}
+
+func (e *callExpr) eval(cells []string) (interface{}, error) {
+	args, err := evalArgs(e.args, cells)
+	if err != nil {
+		return nil, err
+	}
+	return e.f.call(args)
+}
+
+func (e *callExpr) typ() FieldType {
+	return e.f.returns(argTypes(e.args))
+}
+
+// aggExpr is a call of an aggregate function. step feeds it the arguments
+// of a record, once all records were fed finish computes what eval returns.
+type aggExpr struct {
+	f     *sqlFunc
+	args  []expr
+	state Aggregator
+	v     interface{}
+}
+
+func (e *aggExpr) step(cells []string) error {
+	args, err := evalArgs(e.args, cells)
+	if err != nil {
+		return err
+	}
+	if !e.f.nullable {
+		for _, a := range args {
+			if a == nil {
+				return nil
+			}
+		}
+	}
+	return e.state.Step(args)
+}
+
+func (e *aggExpr) finish() (err error) {
+	e.v, err = e.state.Result()
+	return
+}
+
+func (e *aggExpr) eval([]string) (interface{}, error) { return e.v, nil }
+
+func (e *aggExpr) typ() FieldType {
+	return e.f.returns(argTypes(e.args))
+}
+
+func evalArgs(exprs []expr, cells []string) ([]interface{}, error) {
+	args := make([]interface{}, len(exprs))
+	for i, a := range exprs {
+		v, err := a.eval(cells)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return args, nil
+}
+
+func argTypes(exprs []expr) []FieldType {
+	types := make([]FieldType, len(exprs))
+	for i, a := range exprs {
+		types[i] = a.typ()
+	}
+	return types
+}
+
+// commonType returns the type of the first of exprs with a known type.
+func commonType(exprs []expr) FieldType {
+	for _, e := range exprs {
+		if e != nil && e.typ() != UNKNOWN_FIELD_TYPE {
+			return e.typ()
+		}
+	}
+	return UNKNOWN_FIELD_TYPE
+}
+
+// resultType is the type of the column holding the values of e.
+func resultType(e expr) FieldType {
+	if t := e.typ(); t != UNKNOWN_FIELD_TYPE {
+		return t
+	}
+	return TEXT
+}
+
+func toInt(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return 0, errorf(ErrInvalidValue, "invalid INT value '%s'", v)
+		}
+		return n, nil
+	}
+	return 0, errorf(ErrDatatypeMismatch, "%s used where an INT is expected", typeName(v))
+}
+
+func toBool(v interface{}) (bool, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, errorf(ErrInvalidValue, "invalid BOOL value '%s'", v)
+		}
+		return b, nil
+	}
+	return false, errorf(ErrDatatypeMismatch, "%s used where a BOOL is expected", typeName(v))
+}
+
+func toTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		t, err := parseDateTime(v)
+		if err != nil {
+			return time.Time{}, errorf(ErrInvalidValue, "%s", err)
+		}
+		return t, nil
+	}
+	return time.Time{}, errorf(ErrDatatypeMismatch, "%s used where a DATETIME is expected", typeName(v))
+}
+
+func toText(v interface{}) string {
+	s, _ := FormatValue(v)
+	return s
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case int64:
+		return "INT"
+	case bool:
+		return "BOOL"
+	case time.Time:
+		return "DATETIME"
+	}
+	return "TEXT"
+}
+
+// compareAny orders two non-NULL values, a string compared with a value of
+// another type is converted to that type.
+func compareAny(a, b interface{}) (int, error) {
+	if s, ok := a.(string); ok {
+		if _, ok := b.(string); !ok {
+			c, err := compareAny(b, s)
+			return -c, err
+		}
+	}
+	switch x := a.(type) {
+	case int64:
+		y, err := toInt(b)
+		if err != nil {
+			return 0, err
+		}
+		return compareInts64(x, y), nil
+	case bool:
+		y, err := toBool(b)
+		if err != nil {
+			return 0, err
+		}
+		return compareInts(boolRank(x), boolRank(y)), nil
+	case time.Time:
+		y, err := toTime(b)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case x.Before(y):
+			return -1, nil
+		case x.After(y):
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	}
+	return 0, errorf(ErrDatatypeMismatch, "%s can't be compared with %s", typeName(a), typeName(b))
+}
+
+func compareInts64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sqlFunc is a function expressions may call. It isn't called with NULL
+// arguments unless nullable is set, the result is NULL then. An aggregate
+// function has aggregate set instead of call, it is fed the arguments of
+// every record and skips those with NULL arguments unless nullable is set.
+type sqlFunc struct {
+	minArgs, maxArgs int
+	nullable         bool
+	// args are the types of the arguments if they are checked, the last
+	// one is repeated when maxArgs is -1
+	args      []FieldType
+	returns   func(args []FieldType) FieldType
+	call      func(args []interface{}) (interface{}, error)
+	aggregate func() Aggregator
+}
+
+// checkArgs makes sure the arguments of a call of f have the types f takes,
+// arguments of unknown type are converted when f is called.
+func (f *sqlFunc) checkArgs(name string, args []expr) error {
+	if len(f.args) == 0 {
+		return nil
+	}
+	for i, a := range args {
+		want := f.args[len(f.args)-1]
+		if i < len(f.args) {
+			want = f.args[i]
+		}
+		if t := a.typ(); t != UNKNOWN_FIELD_TYPE && t != want {
+			return errorf(ErrDatatypeMismatch, "argument %d of function %s must be %s, not %s", i+1, strings.ToLower(name), want, t)
+		}
+	}
+	return nil
+}
+
+func returning(t FieldType) func([]FieldType) FieldType {
+	return func([]FieldType) FieldType { return t }
+}
+
+var builtinFuncs = map[string]*sqlFunc{
+	"UPPER": {minArgs: 1, maxArgs: 1, returns: returning(TEXT), call: func(args []interface{}) (interface{}, error) {
+		return strings.ToUpper(toText(args[0])), nil
+	}},
+	"LOWER": {minArgs: 1, maxArgs: 1, returns: returning(TEXT), call: func(args []interface{}) (interface{}, error) {
+		return strings.ToLower(toText(args[0])), nil
+	}},
+	"LENGTH": {minArgs: 1, maxArgs: 1, returns: returning(INT), call: func(args []interface{}) (interface{}, error) {
+		return int64(utf8.RuneCountInString(toText(args[0]))), nil
+	}},
+	"SUBSTR":     {minArgs: 2, maxArgs: 3, returns: returning(TEXT), call: substr},
+	"DATE_TRUNC": {minArgs: 2, maxArgs: 2, returns: returning(DATETIME), call: dateTrunc},
+	"COALESCE": {minArgs: 1, maxArgs: -1, nullable: true, returns: func(args []FieldType) FieldType {
+		for _, t := range args {
+			if t != UNKNOWN_FIELD_TYPE {
+				return t
+			}
+		}
+		return UNKNOWN_FIELD_TYPE
+	}, call: func(args []interface{}) (interface{}, error) {
+		for _, a := range args {
+			if a != nil {
+				return a, nil
+			}
+		}
+		return nil, nil
+	}},
+}
+
+// substr returns the characters of s from start (counted from 1) on, at
+// most n of them.
+func substr(args []interface{}) (interface{}, error) {
+	s := []rune(toText(args[0]))
+	start, err := toInt(args[1])
+	if err != nil {
+		return nil, err
+	}
+	end := int64(len(s)) + 1
+	if len(args) == 3 {
+		n, err := toInt(args[2])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errorf(ErrInvalidParameter, "negative substring length not allowed")
+		}
+		if start+n < end {
+			end = start + n
+		}
+	}
+	if start < 1 {
+		start = 1
+	}
+	if start >= end {
+		return "", nil
+	}
+	return string(s[start-1 : end-1]), nil
+}
+
+// dateTrunc truncates a DATETIME to the given precision.
+func dateTrunc(args []interface{}) (interface{}, error) {
+	t, err := toTime(args[1])
+	if err != nil {
+		return nil, err
+	}
+	y, mo, d := t.Date()
+	h, mi, s := t.Clock()
+	switch strings.ToLower(toText(args[0])) {
+	case "year":
+		mo, d, h, mi, s = 1, 1, 0, 0, 0
+	case "quarter":
+		mo, d, h, mi, s = mo-(mo-1)%3, 1, 0, 0, 0
+	case "month":
+		d, h, mi, s = 1, 0, 0, 0
+	case "week":
+		// weeks start on Monday
+		d, h, mi, s = d-(int(t.Weekday())+6)%7, 0, 0, 0
+	case "day":
+		h, mi, s = 0, 0, 0
+	case "hour":
+		mi, s = 0, 0
+	case "minute":
+		s = 0
+	case "second":
+	default:
+		return nil, errorf(ErrInvalidParameter, "unit '%s' not recognized", toText(args[0]))
+	}
+	return time.Date(y, mo, d, h, mi, s, 0, t.Location()), nil
+}
+
+// exprParser compiles the tokens of an expression for the columns cols of
+// the table named table.
+type exprParser struct {
+	tokens []token
+	i      int
+	table  string
+	cols   []Column
+	funcs  func(name string) *sqlFunc
+	now    time.Time
+	// aggs collects the aggregate calls, which are only allowed if it is
+	// set. bare is set by columns used outside of them.
+	aggs  *[]*aggExpr
+	inAgg bool
+	bare  bool
+}
+
+// compileExpr compiles the expression src for the columns cols of table.
+// NOW() and CURRENT_TIMESTAMP are the time of compilation, so they are the
+// same for every record of a statement.
+func compileExpr(src, table string, cols []Column, funcs func(string) *sqlFunc) (expr, error) {
+	p, err := newExprParser(src, table, cols, funcs)
+	if err != nil {
+		return nil, err
+	}
+	return p.parse()
+}
+
+// compileSelected compiles an expression of a SELECT, which may call
+// aggregate functions. It returns those calls and whether columns are used
+// outside of them.
+func compileSelected(src, table string, cols []Column, funcs func(string) *sqlFunc) (e expr, aggs []*aggExpr, bare bool, err error) {
+	p, err := newExprParser(src, table, cols, funcs)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	p.aggs = &aggs
+	e, err = p.parse()
+	return e, aggs, p.bare, err
+}
+
+func newExprParser(src, table string, cols []Column, funcs func(string) *sqlFunc) (*exprParser, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	return &exprParser{tokens: tokens, table: table, cols: cols, funcs: funcs, now: time.Now().UTC().Truncate(time.Second)}, nil
+}
+
+func (p *exprParser) parse() (expr, error) {
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(p.tokens) {
+		return nil, p.errorf("unexpected %s", p.tokens[p.i].text)
+	}
+	return e, nil
+}
+
+func (p *exprParser) errorf(format string, a ...interface{}) error {
+	return errorf(ErrSyntax, "in expression: "+format, a...)
+}
+
+func (p *exprParser) peek() token {
+	if p.i < len(p.tokens) {
+		return p.tokens[p.i]
+	}
+	return token{kind: tokOp}
+}
+
+func (p *exprParser) next() token {
+	tk := p.peek()
+	p.i++
+	return tk
+}
+
+func (p *exprParser) expectOp(op string) error {
+	if !p.peek().isOp(op) {
+		return p.errorf("expected %s", op)
+	}
+	p.i++
+	return nil
+}
+
+func (p *exprParser) expectKeyword(kw string) error {
+	if !p.peek().isKeyword(kw) {
+		return p.errorf("expected %s", kw)
+	}
+	p.i++
+	return nil
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	return p.parseBinary([]string{"OR"}, true, p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	return p.parseBinary([]string{"AND"}, true, p.parseNot)
+}
+
+func (p *exprParser) parseNot() (expr, error) {
+	if p.peek().isKeyword("NOT") {
+		p.i++
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "NOT", x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (expr, error) {
+	l, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().isKeyword("IS") {
+		p.i++
+		not := p.peek().isKeyword("NOT")
+		if not {
+			p.i++
+		}
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return &isNullExpr{x: l, not: not}, nil
+	}
+	tk := p.peek()
+	switch {
+	case tk.isOp("="), tk.isOp("!="), tk.isOp("<>"), tk.isOp("<"), tk.isOp("<="), tk.isOp(">"), tk.isOp(">="):
+		p.i++
+		r, err := p.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryExpr{op: tk.text, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseConcat() (expr, error) {
+	return p.parseBinary([]string{"||"}, false, p.parseAdditive)
+}
+
+func (p *exprParser) parseAdditive() (expr, error) {
+	return p.parseBinary([]string{"+", "-"}, false, p.parseMultiplicative)
+}
+
+func (p *exprParser) parseMultiplicative() (expr, error) {
+	return p.parseBinary([]string{"*", "/", "%"}, false, p.parseUnary)
+}
+
+// parseBinary parses left-associative operators ops, keywords if keyword is
+// set, between operands parsed by operand.
+func (p *exprParser) parseBinary(ops []string, keyword bool, operand func() (expr, error)) (expr, error) {
+	l, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tk := p.peek()
+		op := ""
+		for _, o := range ops {
+			if keyword && tk.isKeyword(o) || !keyword && tk.isOp(o) {
+				op = o
+			}
+		}
+		if op == "" {
+			return l, nil
+		}
+		p.i++
+		r, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: op, l: l, r: r}
+	}
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if tk := p.peek(); tk.isOp("-") || tk.isOp("+") {
+		p.i++
+		x, err := p.parseUnary()
+		if err != nil || tk.text == "+" {
+			return x, err
+		}
+		if l, ok := x.(*literalExpr); ok && l.t == INT {
+			return &literalExpr{v: -l.v.(int64), t: INT}, nil
+		}
+		return &unaryExpr{op: "-", x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	if p.i >= len(p.tokens) {
+		return nil, p.errorf("unexpected end")
+	}
+	tk := p.next()
+	switch tk.kind {
+	case tokNumber:
+		n, err := strconv.ParseInt(tk.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("number %s out of range", tk.text)
+		}
+		return &literalExpr{v: n, t: INT}, nil
+	case tokString:
+		return &literalExpr{v: tk.text, t: UNKNOWN_FIELD_TYPE}, nil
+	case tokOp:
+		if tk.text != "(" {
+			return nil, p.errorf("unexpected %s", tk.text)
+		}
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectOp(")")
+	}
+
+	switch name := strings.ToUpper(tk.text); {
+	case name == "NULL":
+		return &literalExpr{t: UNKNOWN_FIELD_TYPE}, nil
+	case name == "TRUE" || name == "FALSE":
+		return &literalExpr{v: name == "TRUE", t: BOOL}, nil
+	case name == "CURRENT_TIMESTAMP":
+		return &literalExpr{v: p.now, t: DATETIME}, nil
+	case name == "CASE":
+		return p.parseCase()
+	case p.peek().isOp("("):
+		return p.parseCall(name)
+	}
+	if !p.inAgg {
+		p.bare = true
+	}
+	return p.column(tk.text)
+}
+
+func (p *exprParser) parseCase() (expr, error) {
+	e := &caseExpr{}
+	if !p.peek().isKeyword("WHEN") {
+		operand, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		e.operand = operand
+	}
+	for p.peek().isKeyword("WHEN") {
+		p.i++
+		w, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("THEN"); err != nil {
+			return nil, err
+		}
+		t, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		e.whens, e.thens = append(e.whens, w), append(e.thens, t)
+	}
+	if len(e.whens) == 0 {
+		return nil, p.errorf("expected WHEN")
+	}
+	if p.peek().isKeyword("ELSE") {
+		p.i++
+		els, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		e.els = els
+	}
+	return e, p.expectKeyword("END")
+}
+
+func (p *exprParser) parseCall(name string) (expr, error) {
+	f := p.funcs(name)
+	if f != nil && f.aggregate != nil {
+		switch {
+		case p.aggs == nil:
+			return nil, errorf(ErrGrouping, "aggregate function %s is not allowed here", strings.ToLower(name))
+		case p.inAgg:
+			return nil, errorf(ErrGrouping, "aggregate function calls cannot be nested")
+		}
+		p.inAgg = true
+		defer func() { p.inAgg = false }()
+	}
+
+	p.i++ // (
+	var args []expr
+	for !p.peek().isOp(")") {
+		if len(args) > 0 {
+			if err := p.expectOp(","); err != nil {
+				return nil, err
+			}
+		}
+		a, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	p.i++ // )
+
+	if name == "NOW" && len(args) == 0 {
+		return &literalExpr{v: p.now, t: DATETIME}, nil
+	}
+	if f == nil {
+		return nil, errorf(ErrUndefinedFunction, "function %s does not exist", strings.ToLower(name))
+	}
+	if len(args) < f.minArgs || f.maxArgs >= 0 && len(args) > f.maxArgs {
+		return nil, errorf(ErrUndefinedFunction, "function %s does not take %d arguments", strings.ToLower(name), len(args))
+	}
+	if err := f.checkArgs(name, args); err != nil {
+		return nil, err
+	}
+	if f.aggregate != nil {
+		a := &aggExpr{f: f, args: args, state: f.aggregate()}
+		*p.aggs = append(*p.aggs, a)
+		return a, nil
+	}
+	if f.nullable {
+		return &callExpr{f: f, args: args}, nil
+	}
+	return &callExpr{f: &sqlFunc{returns: f.returns, call: skipNulls(f.call)}, args: args}, nil
+}
+
+// skipNulls makes call return NULL when one of its arguments is NULL.
+func skipNulls(call func([]interface{}) (interface{}, error)) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		for _, a := range args {
+			if a == nil {
+				return nil, nil
+			}
+		}
+		return call(args)
+	}
+}
+
+// column resolves a column name, which may be qualified with the name of
+// the table.
+func (p *exprParser) column(name string) (expr, error) {
+	find := func(n string) (expr, bool) {
+		for i, c := range p.cols {
+			if c.Name == n {
+				return &columnExpr{i: i, t: c.Type}, true
+			}
+		}
+		return nil, false
+	}
+	if e, ok := find(name); ok {
+		return e, nil
+	}
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		qual := name[:i]
+		if qual == p.table || qual == defaultSchema+"."+p.table || strings.HasSuffix(p.table, "."+qual) {
+			if e, ok := find(name[i+1:]); ok {
+				return e, nil
+			}
+		}
+	}
+	return nil, errorf(ErrUndefinedColumn, "schema violation: field %s not defined", name)
+}
@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Func is a function written in Go that SQL expressions may call once it is
+// registered with DbEngine.RegisterFunc. Values are passed as int64 (INT),
+// string (TEXT), bool (BOOL), time.Time (DATETIME) or nil (NULL), INT
+// results may also be int or one of the smaller integer types.
+type Func struct {
+	// Args are the types of the arguments, with Variadic set the last one
+	// may be repeated or left out.
+	Args     []FieldType
+	Variadic bool
+	Returns  FieldType
+	// NullArgs passes NULL arguments on, otherwise a scalar function
+	// returns NULL and an aggregate skips the record.
+	NullArgs bool
+	// Scalar computes the value of the function for a record, Aggregate
+	// starts computing it over all the records a SELECT reads. Exactly one
+	// of them must be set.
+	Scalar    func(args []interface{}) (interface{}, error)
+	Aggregate func() Aggregator
+}
+
+// Aggregator computes the value of an aggregate function for a statement.
+type Aggregator interface {
+	// Step is called with the arguments of every record.
+	Step(args []interface{}) error
+	// Result is called once all records were stepped through.
+	Result() (interface{}, error)
+}
+
+var funcNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// RegisterFunc makes fn callable from expressions as name, in any case.
+// Arguments are checked against the types fn takes when a statement is
+// compiled, results against the type it returns when it is called. Built-in
+// functions can't be replaced and a name can only be registered once.
+func (db *DbEngine) RegisterFunc(name string, fn Func) error {
+	if !funcNameRe.MatchString(name) || isExprKeyword(name) {
+		return errorf(ErrInvalidParameter, "invalid function name '%s'", name)
+	}
+	if (fn.Scalar == nil) == (fn.Aggregate == nil) {
+		return errorf(ErrInvalidParameter, "function %s must be either scalar or aggregate", name)
+	}
+	if fn.Variadic && len(fn.Args) == 0 {
+		return errorf(ErrInvalidParameter, "variadic function %s takes no arguments", name)
+	}
+	for _, t := range append([]FieldType{fn.Returns}, fn.Args...) {
+		switch t {
+		case INT, TEXT, BOOL, DATETIME:
+		default:
+			return errorf(ErrInvalidParameter, "function %s: unknown type %d", name, t)
+		}
+	}
+
+	upper := strings.ToUpper(name)
+	db.lockFuncs.Lock()
+	defer db.lockFuncs.Unlock()
+	if _, ok := builtinFuncs[upper]; ok || upper == "NOW" {
+		return errorf(ErrDuplicateObject, "function %s is built in", strings.ToLower(name))
+	}
+	if _, ok := db.funcs[upper]; ok {
+		return errorf(ErrDuplicateObject, "function %s already exists", strings.ToLower(name))
+	}
+	db.funcs[upper] = fn.compile(strings.ToLower(name))
+	return nil
+}
+
+// lookupFunc returns the built-in or registered function name, which is
+// upper case.
+func (db *DbEngine) lookupFunc(name string) *sqlFunc {
+	if f, ok := builtinFuncs[name]; ok {
+		return f
+	}
+	db.lockFuncs.RLock()
+	defer db.lockFuncs.RUnlock()
+	return db.funcs[name]
+}
+
+// compile returns the function expressions call for fn.
+func (fn Func) compile(name string) *sqlFunc {
+	f := &sqlFunc{minArgs: len(fn.Args), maxArgs: len(fn.Args), nullable: fn.NullArgs, args: fn.Args, returns: returning(fn.Returns)}
+	if fn.Variadic {
+		f.minArgs, f.maxArgs = len(fn.Args)-1, -1
+	}
+	if fn.Scalar != nil {
+		f.call = func(args []interface{}) (v interface{}, err error) {
+			if args, err = fn.convertArgs(args); err != nil {
+				return nil, err
+			}
+			err = guard(name, func() (err error) {
+				v, err = fn.Scalar(args)
+				return
+			})
+			if err != nil {
+				return nil, err
+			}
+			return fn.result(name, v)
+		}
+		return f
+	}
+	f.aggregate = func() Aggregator {
+		return &funcAggregator{fn: fn, name: name, agg: fn.Aggregate()}
+	}
+	return f
+}
+
+// funcAggregator converts the arguments and checks the result of the
+// Aggregator of a registered function.
+type funcAggregator struct {
+	fn   Func
+	name string
+	agg  Aggregator
+}
+
+func (a *funcAggregator) Step(args []interface{}) error {
+	args, err := a.fn.convertArgs(args)
+	if err != nil {
+		return err
+	}
+	return guard(a.name, func() error { return a.agg.Step(args) })
+}
+
+func (a *funcAggregator) Result() (v interface{}, err error) {
+	err = guard(a.name, func() (err error) {
+		v, err = a.agg.Result()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.fn.result(a.name, v)
+}
+
+// guard runs the Go code of the function name, turning its errors and
+// panics into errors of the statement.
+func guard(name string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errorf(ErrExternalRoutine, "function %s: panic: %v", name, r)
+		}
+	}()
+	if err = f(); err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return errorf(ErrExternalRoutine, "function %s: %s", name, err)
+}
+
+// convertArgs converts arguments of unknown type, strings mostly, to the
+// types fn takes.
+func (fn Func) convertArgs(args []interface{}) ([]interface{}, error) {
+	for i, a := range args {
+		want := fn.Args[len(fn.Args)-1]
+		if i < len(fn.Args) {
+			want = fn.Args[i]
+		}
+		switch v := a.(type) {
+		case nil:
+		case string:
+			x, err := ParseValue(want, v)
+			if err != nil {
+				return nil, errorf(ErrInvalidValue, "%s", err)
+			}
+			args[i] = x
+		default:
+			if valueType(v) == want {
+				break
+			}
+			if want != TEXT {
+				return nil, errorf(ErrDatatypeMismatch, "%s used where %s is expected", typeName(v), want)
+			}
+			args[i] = toText(v)
+		}
+	}
+	return args, nil
+}
+
+// result checks that v is a value of the type fn returns.
+func (fn Func) result(name string, v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case int:
+		v = int64(x)
+	case int8:
+		v = int64(x)
+	case int16:
+		v = int64(x)
+	case int32:
+		v = int64(x)
+	case uint8:
+		v = int64(x)
+	case uint16:
+		v = int64(x)
+	case uint32:
+		v = int64(x)
+	}
+	if v != nil && valueType(v) != fn.Returns {
+		return nil, errorf(ErrDatatypeMismatch, "function %s returned %T, not %s", name, v, fn.Returns)
+	}
+	return v, nil
+}
+
+// valueType returns the type of a value expressions evaluate to.
+func valueType(v interface{}) FieldType {
+	switch v.(type) {
+	case int64:
+		return INT
+	case string:
+		return TEXT
+	case bool:
+		return BOOL
+	case time.Time:
+		return DATETIME
+	}
+	return UNKNOWN_FIELD_TYPE
+}
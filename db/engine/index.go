@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// index maps the values of a column to the positions in records of the
+// rows holding them. Statements changing the table keep its indexes up to
+// date while holding the table lock.
+type index struct {
+	name    string
+	col     int
+	primary bool
+	entries map[string][]int
+	// sorted holds the keys of an INT index in order for range scans. It is
+	// built on first use after keys were added, which may happen under the
+	// read lock of the table.
+	sortLock sync.Mutex
+	sorted   []int
+}
+
+// indexKey returns the key of the value v of a column of type ft, values
+// no condition can match aren't indexed.
+func indexKey(ft FieldType, v string) (string, bool) {
+	switch ft {
+	case INT:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return "", false
+		}
+		return strconv.Itoa(n), true
+	case BOOL:
+		return strconv.FormatBool(isTrue(v)), true
+	default:
+		return v, true
+	}
+}
+
+// addIndex creates an index on the column col and fills it with the
+// records of the table.
+func (t *table) addIndex(name string, col int, primary bool) *index {
+	idx := &index{name: name, col: col, primary: primary}
+	t.fillIndex(idx)
+	t.indexes = append(t.indexes, idx)
+	return idx
+}
+
+func (t *table) fillIndex(idx *index) {
+	idx.entries = make(map[string][]int)
+	idx.sortLock.Lock()
+	idx.sorted = nil
+	idx.sortLock.Unlock()
+	for i := range t.records {
+		t.indexRecord(idx, i)
+	}
+}
+
+func (t *table) indexRecord(idx *index, pos int) {
+	key, ok := indexKey(t.sch.colType[idx.col], t.records[pos].cells[idx.col])
+	if !ok {
+		return
+	}
+	if _, seen := idx.entries[key]; !seen {
+		idx.sortLock.Lock()
+		idx.sorted = nil
+		idx.sortLock.Unlock()
+	}
+	idx.entries[key] = append(idx.entries[key], pos)
+}
+
+// reindex rebuilds the indexes on the columns cols, all of them if cols is
+// nil. Positions change when records are deleted.
+func (t *table) reindex(cols map[int]bool) {
+	for _, idx := range t.indexes {
+		if cols == nil || cols[idx.col] {
+			t.fillIndex(idx)
+		}
+	}
+}
+
+// checkPrimaryKey fails if a value of the primary key would appear twice
+// once the records replaced get the cells values, or with replaced nil
+// once records with the cells values are added. NULLs may repeat.
+func (t *table) checkPrimaryKey(replaced []*record, values [][]string) error {
+	var pk *index
+	for _, idx := range t.indexes {
+		if idx.primary {
+			pk = idx
+		}
+	}
+	if pk == nil {
+		return nil
+	}
+	ft := t.sch.colType[pk.col]
+
+	// the keys left by the records not replaced
+	taken := make(map[string]int, len(pk.entries))
+	for k, pos := range pk.entries {
+		taken[k] = len(pos)
+	}
+	for _, r := range replaced {
+		if k, ok := indexKey(ft, r.cells[pk.col]); ok {
+			taken[k]--
+		}
+	}
+	for _, cells := range values {
+		v := cells[pk.col]
+		k, ok := indexKey(ft, v)
+		if !ok || v == "" {
+			continue
+		}
+		if taken[k] > 0 {
+			return errorf(ErrConstraintViolation, "duplicate key value violates unique constraint \"%s\": %s=%s", pk.name, t.sch.name[pk.col], v)
+		}
+		taken[k]++
+	}
+	return nil
+}
+
+func (t *table) indexNamed(name string) *index {
+	for _, idx := range t.indexes {
+		if idx.name == name {
+			return idx
+		}
+	}
+	return nil
+}
+
+// lookup returns the positions of the records whose value has the given
+// key, in table order.
+func (idx *index) lookup(key string) []int {
+	return idx.entries[key]
+}
+
+// scanRange returns the positions, in table order, of the records of an
+// INT index whose value lies within lo and hi.
+func (idx *index) scanRange(lo, hi bound) []int {
+	idx.sortLock.Lock()
+	if idx.sorted == nil {
+		idx.sorted = make([]int, 0, len(idx.entries))
+		for k := range idx.entries {
+			n, _ := strconv.Atoi(k)
+			idx.sorted = append(idx.sorted, n)
+		}
+		sort.Ints(idx.sorted)
+	}
+	keys := idx.sorted
+	idx.sortLock.Unlock()
+
+	first := 0
+	if lo.set {
+		first = sort.Search(len(keys), func(i int) bool {
+			return keys[i] > lo.v || lo.incl && keys[i] == lo.v
+		})
+	}
+	var pos []int
+	for _, k := range keys[first:] {
+		if hi.set && (k > hi.v || !hi.incl && k == hi.v) {
+			break
+		}
+		pos = append(pos, idx.entries[strconv.Itoa(k)]...)
+	}
+	sort.Ints(pos)
+	return pos
+}
+
+// bound is an end of the range of a range scan.
+type bound struct {
+	set  bool
+	v    int
+	incl bool
+}
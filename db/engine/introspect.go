@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rrowniak/sqlparser/query"
+)
+
+// infoSchema holds read-only views generated from the engine's metadata.
+// User tables belong to the schema public.
+const (
+	infoSchema    = "information_schema"
+	defaultSchema = "public"
+)
+
+// infoSchemaViews are the schemas of the views in information_schema.
+var infoSchemaViews = map[string]schema{
+	"tables": {
+		name:    []string{"table_schema", "table_name", "table_type", "table_rows"},
+		colType: []FieldType{TEXT, TEXT, TEXT, INT},
+	},
+	"columns": {
+		name:    []string{"table_schema", "table_name", "column_name", "ordinal_position", "data_type", "is_primary_key"},
+		colType: []FieldType{TEXT, TEXT, TEXT, INT, TEXT, BOOL},
+	},
+	"indexes": {
+		name:    []string{"table_schema", "table_name", "index_name", "column_name", "is_primary"},
+		colType: []FieldType{TEXT, TEXT, TEXT, TEXT, BOOL},
+	},
+	"column_statistics": {
+		name:    []string{"table_schema", "table_name", "column_name", "row_count", "distinct_count", "null_count", "min_value", "max_value", "analyzed_at"},
+		colType: []FieldType{TEXT, TEXT, TEXT, INT, INT, INT, TEXT, TEXT, DATETIME},
+	},
+}
+
+// infoSchemaView returns the schema of the information_schema view name
+// refers to.
+func infoSchemaView(name string) (schema, bool) {
+	if !strings.HasPrefix(name, infoSchema+".") {
+		return schema{}, false
+	}
+	sch, ok := infoSchemaViews[strings.TrimPrefix(name, infoSchema+".")]
+	return sch, ok
+}
+
+func isInfoSchema(name string) bool {
+	return strings.HasPrefix(name, infoSchema+".")
+}
+
+// lookupTable returns the table name refers to. Views of information_schema
+// are generated on every lookup and only describe the tables user may read.
+func (db *DbEngine) lookupTable(name, user string) (*table, bool) {
+	if isInfoSchema(name) {
+		return db.infoSchemaTable(name, user)
+	}
+	db.lockTables.RLock()
+	defer db.lockTables.RUnlock()
+	t, ok := db.tables[name]
+	return t, ok
+}
+
+func (db *DbEngine) infoSchemaTable(name, user string) (*table, bool) {
+	sch, ok := infoSchemaView(name)
+	if !ok {
+		return nil, false
+	}
+	t := newTable(name, sch)
+	t.funcs = db.lookupFunc
+	add := func(cells ...string) {
+		t.records = append(t.records, record{cells: cells})
+	}
+
+	views := make([]string, 0, len(infoSchemaViews))
+	for v := range infoSchemaViews {
+		views = append(views, v)
+	}
+	sort.Strings(views)
+
+	switch name {
+	case infoSchema + ".tables":
+		for _, tt := range db.visibleTableList(user) {
+			tt.tableLock.RLock()
+			rows := len(tt.records)
+			tt.tableLock.RUnlock()
+			add(defaultSchema, tt.name, "BASE TABLE", strconv.Itoa(rows))
+		}
+		for _, v := range views {
+			add(infoSchema, v, "VIEW", "")
+		}
+	case infoSchema + ".columns":
+		addColumns := func(schemaName, table string, cols []Column) {
+			for i, col := range cols {
+				add(schemaName, table, col.Name, strconv.Itoa(i+1), col.Type.String(), strconv.FormatBool(i == 0))
+			}
+		}
+		for _, n := range db.visibleTables(user) {
+			if cols, err := db.TableColumns(n); err == nil {
+				addColumns(defaultSchema, n, cols)
+			}
+		}
+		for _, v := range views {
+			addColumns(infoSchema, v, columnsOf(infoSchemaViews[v]))
+		}
+	case infoSchema + ".indexes":
+		for _, tt := range db.visibleTableList(user) {
+			tt.tableLock.RLock()
+			for _, idx := range tt.indexes {
+				add(defaultSchema, tt.name, idx.name, tt.sch.name[idx.col], strconv.FormatBool(idx.primary))
+			}
+			tt.tableLock.RUnlock()
+		}
+	case infoSchema + ".column_statistics":
+		// only analyzed tables have statistics
+		for _, tt := range db.visibleTableList(user) {
+			st := tt.statistics()
+			if st == nil {
+				continue
+			}
+			for i, cs := range st.columns {
+				add(defaultSchema, tt.name, tt.sch.name[i], strconv.Itoa(st.rows), strconv.Itoa(cs.distinct),
+					strconv.Itoa(cs.nulls), cs.min, cs.max, st.analyzed.UTC().Format(DateTimeLayout))
+			}
+		}
+	}
+	return t, true
+}
+
+// visibleTables returns the tables user may read.
+func (db *DbEngine) visibleTables(user string) []string {
+	var names []string
+	for _, n := range db.Tables() {
+		if db.CheckPrivilege(user, n, PrivSelect) == nil {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// visibleTableList returns the tables user may read, in order of their
+// names.
+func (db *DbEngine) visibleTableList(user string) []*table {
+	var tables []*table
+	for _, n := range db.visibleTables(user) {
+		db.lockTables.RLock()
+		t, ok := db.tables[n]
+		db.lockTables.RUnlock()
+		if ok {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+func columnsOf(sch schema) []Column {
+	cols := make([]Column, len(sch.name))
+	for i, n := range sch.name {
+		cols[i] = Column{Name: n, Type: sch.colType[i]}
+	}
+	return cols
+}
+
+// isShowStmt tells SHOW and DESCRIBE statements, which are rewritten into
+// queries of information_schema, apart from the ones given to sqlparser.
+func isShowStmt(sql string) bool {
+	f := strings.Fields(sql)
+	if len(f) == 0 {
+		return false
+	}
+	kw := strings.ToUpper(f[0])
+	return kw == "SHOW" || kw == "DESCRIBE" || kw == "DESC"
+}
+
+// parseShow turns
+//
+//	SHOW TABLES
+//	SHOW COLUMNS FROM table
+//	DESCRIBE table, DESC table
+//
+// into a SELECT from information_schema. described is the table whose
+// columns are listed.
+func parseShow(sql string) (q query.Query, described string, err error) {
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	tokens := strings.Fields(sql)
+	upper := make([]string, len(tokens))
+	for i, t := range tokens {
+		upper[i] = strings.ToUpper(t)
+	}
+
+	switch {
+	case len(tokens) == 2 && upper[0] == "SHOW" && upper[1] == "TABLES":
+		return query.Query{
+			Type:      query.Select,
+			TableName: infoSchema + ".tables",
+			Fields:    []string{"table_name"},
+			Conditions: []query.Condition{
+				{Operand1: "table_schema", Operand1IsField: true, Operator: query.Eq, Operand2: defaultSchema},
+			},
+		}, "", nil
+	case len(tokens) == 4 && upper[0] == "SHOW" && upper[1] == "COLUMNS" && upper[2] == "FROM":
+		described = tokens[3]
+	case len(tokens) == 2 && (upper[0] == "DESCRIBE" || upper[0] == "DESC"):
+		described = tokens[1]
+	default:
+		return query.Query{}, "", errorf(ErrSyntax, "expected SHOW TABLES, SHOW COLUMNS FROM <table> or DESCRIBE <table>")
+	}
+
+	schemaName, table := defaultSchema, described
+	if i := strings.IndexByte(described, '.'); i >= 0 {
+		schemaName, table = described[:i], described[i+1:]
+		if schemaName == defaultSchema {
+			described = table
+		}
+	}
+	return query.Query{
+		Type:      query.Select,
+		TableName: infoSchema + ".columns",
+		Fields:    []string{"column_name", "data_type", "is_primary_key"},
+		Conditions: []query.Condition{
+			{Operand1: "table_schema", Operand1IsField: true, Operator: query.Eq, Operand2: schemaName},
+			{Operand1: "table_name", Operand1IsField: true, Operator: query.Eq, Operand2: table},
+		},
+	}, described, nil
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package engine
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file path, creating it if needed,
+// and waits for other processes holding it. It returns the function that
+// releases the lock.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
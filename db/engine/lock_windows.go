@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package engine
+
+import (
+	"os"
+	"time"
+)
+
+// lockFile takes an exclusive lock on the file path by creating it, and
+// waits for other processes holding it. It returns the function that
+// releases the lock. A lock left over by a process that died is taken over
+// after a minute.
+func lockFile(path string) (func(), error) {
+	for start := time.Now(); ; {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if time.Since(start) > time.Minute {
+			os.Remove(path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
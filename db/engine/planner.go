@@ -0,0 +1,361 @@
+package engine
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rrowniak/sqlparser/query"
+)
+
+// Selectivities assumed for conditions statistics don't tell about.
+const (
+	defaultEqSelectivity    = 0.1
+	defaultRangeSelectivity = 1.0 / 3
+	// indexCostFactor is how much more a record found through an index
+	// costs than one visited by a full scan.
+	indexCostFactor = 2.0
+)
+
+// tableStats describe the records of a table when it was last analyzed.
+type tableStats struct {
+	rows     int
+	columns  []columnStats
+	analyzed time.Time
+}
+
+// columnStats describe the values of a column, min and max are "" if it
+// holds NULLs only.
+type columnStats struct {
+	distinct int
+	nulls    int
+	min, max string
+}
+
+// accessPath is how the records matching the conditions of a statement are
+// found: a full scan if idx is nil, otherwise an index lookup (an
+// equality) or a range scan of idx.
+type accessPath struct {
+	idx *index
+	// indexConds are the conditions answered by idx
+	indexConds []query.Condition
+	// filter holds the other conditions, the most selective first
+	filter []query.Condition
+	// rows is the estimated number of matching records
+	rows float64
+}
+
+func (p accessPath) isRange() bool {
+	return p.idx != nil && p.indexConds[0].Operator != query.Eq
+}
+
+// plan chooses the cheapest access path for conds, indexes are considered
+// if useIndexes is set. The table must be locked.
+func (t *table) plan(conds []query.Condition, useIndexes bool) accessPath {
+	n := float64(len(t.records))
+	sel := make([]float64, len(conds))
+	p := accessPath{rows: n}
+	for i, c := range conds {
+		sel[i] = t.selectivity(c)
+		p.rows *= sel[i]
+	}
+
+	used := map[int]bool{}
+	best := n
+	for _, idx := range t.indexes {
+		if !useIndexes || t.sch.colType[idx.col] == DATETIME {
+			continue
+		}
+		eq, ranges := -1, []int(nil)
+		for i, c := range conds {
+			col, op, _, ok := t.literalCond(c)
+			switch {
+			case !ok || col != idx.col:
+			case op == query.Eq && eq == -1:
+				eq = i
+			case op != query.Eq && op != query.Ne && t.sch.colType[col] == INT:
+				ranges = append(ranges, i)
+			}
+		}
+		if eq != -1 {
+			ranges = []int{eq}
+		}
+		if len(ranges) == 0 {
+			continue
+		}
+		found := n
+		for _, i := range ranges {
+			found *= sel[i]
+		}
+		if cost := found * indexCostFactor; cost < best {
+			best = cost
+			p.idx = idx
+			used = map[int]bool{}
+			for _, i := range ranges {
+				used[i] = true
+			}
+		}
+	}
+
+	p.indexConds = nil
+	var rest []int
+	for i, c := range conds {
+		if used[i] {
+			p.indexConds = append(p.indexConds, c)
+		} else {
+			rest = append(rest, i)
+		}
+	}
+	sort.SliceStable(rest, func(a, b int) bool {
+		return sel[rest[a]] < sel[rest[b]]
+	})
+	for _, i := range rest {
+		p.filter = append(p.filter, conds[i])
+	}
+	return p
+}
+
+// positions returns the positions of the records found through the index
+// of p, in table order.
+func (t *table) positions(p accessPath) []int {
+	if !p.isRange() {
+		_, _, v, _ := t.literalCond(p.indexConds[0])
+		key, ok := indexKey(t.sch.colType[p.idx.col], v)
+		if !ok {
+			return nil
+		}
+		return p.idx.lookup(key)
+	}
+	var lo, hi bound
+	for _, c := range p.indexConds {
+		_, op, v, _ := t.literalCond(c)
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			// no INT compares with v
+			return nil
+		}
+		switch op {
+		case query.Gt, query.Gte:
+			if !lo.set || n > lo.v || n == lo.v && op == query.Gt {
+				lo = bound{set: true, v: n, incl: op == query.Gte}
+			}
+		case query.Lt, query.Lte:
+			if !hi.set || n < hi.v || n == hi.v && op == query.Lt {
+				hi = bound{set: true, v: n, incl: op == query.Lte}
+			}
+		}
+	}
+	return p.idx.scanRange(lo, hi)
+}
+
+// literalCond returns the column, operator and value of a condition
+// comparing a column with a value, with the column on the left.
+func (t *table) literalCond(c query.Condition) (col int, op query.Operator, v string, ok bool) {
+	switch {
+	case c.Operand1IsField && !c.Operand2IsField:
+		return t.getFieldIndex(c.Operand1), c.Operator, c.Operand2, true
+	case !c.Operand1IsField && c.Operand2IsField:
+		flipped := map[query.Operator]query.Operator{
+			query.Gt: query.Lt, query.Lt: query.Gt, query.Gte: query.Lte, query.Lte: query.Gte,
+		}
+		op, ok := flipped[c.Operator]
+		if !ok {
+			op = c.Operator
+		}
+		return t.getFieldIndex(c.Operand2), op, c.Operand1, true
+	}
+	return -1, c.Operator, "", false
+}
+
+// selectivity estimates the fraction of the records matching c.
+func (t *table) selectivity(c query.Condition) float64 {
+	col, op, v, ok := t.literalCond(c)
+	if !ok || col == -1 {
+		switch c.Operator {
+		case query.Eq:
+			return defaultEqSelectivity
+		case query.Ne:
+			return 1 - defaultEqSelectivity
+		}
+		return defaultRangeSelectivity
+	}
+
+	eq := defaultEqSelectivity
+	if d := t.distinct(col); d > 0 {
+		eq = 1 / float64(d)
+	}
+	var cs *columnStats
+	if t.planStats != nil {
+		cs = &t.planStats.columns[col]
+	}
+	switch op {
+	case query.Eq:
+		if cs != nil && cs.min != "" && (compareValues(t.sch.colType[col], v, cs.min) < 0 || compareValues(t.sch.colType[col], v, cs.max) > 0) {
+			return 0
+		}
+		return eq
+	case query.Ne:
+		return 1 - eq
+	}
+
+	if cs == nil || cs.min == "" || t.sch.colType[col] != INT {
+		return defaultRangeSelectivity
+	}
+	lo, _ := strconv.Atoi(cs.min)
+	hi, _ := strconv.Atoi(cs.max)
+	x, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	if lo == hi {
+		if evalInt(op, lo, x) {
+			return 1
+		}
+		return 0
+	}
+	below := (float64(x) - float64(lo)) / (float64(hi) - float64(lo))
+	below = math.Max(0, math.Min(1, below))
+	if op == query.Gt || op == query.Gte {
+		return 1 - below
+	}
+	return below
+}
+
+func evalInt(op query.Operator, a, b int) bool {
+	switch op {
+	case query.Eq:
+		return a == b
+	case query.Ne:
+		return a != b
+	case query.Gt:
+		return a > b
+	case query.Lt:
+		return a < b
+	case query.Gte:
+		return a >= b
+	case query.Lte:
+		return a <= b
+	}
+	return false
+}
+
+// distinct returns the number of distinct values of the column col, taken
+// from an index on it or the statistics, or 0 if unknown.
+func (t *table) distinct(col int) int {
+	for _, idx := range t.indexes {
+		if idx.col == col {
+			return len(idx.entries)
+		}
+	}
+	if t.planStats != nil {
+		return t.planStats.columns[col].distinct
+	}
+	return 0
+}
+
+// analyze gathers the statistics of the table.
+func (t *table) analyze() {
+	t.tableLock.RLock()
+	st := &tableStats{rows: len(t.records), columns: make([]columnStats, len(t.sch.name)), analyzed: time.Now()}
+	for c, ft := range t.sch.colType {
+		cs := &st.columns[c]
+		seen := make(map[string]bool)
+		for _, r := range t.records {
+			v := r.cells[c]
+			if v == "" {
+				cs.nulls++
+				continue
+			}
+			if key, ok := indexKey(ft, v); ok {
+				seen[key] = true
+			}
+			if cs.min == "" || compareValues(ft, v, cs.min) < 0 {
+				cs.min = v
+			}
+			if cs.max == "" || compareValues(ft, v, cs.max) > 0 {
+				cs.max = v
+			}
+		}
+		cs.distinct = len(seen)
+	}
+	changes := t.changes
+	t.tableLock.RUnlock()
+
+	t.tableLock.Lock()
+	t.planStats = st
+	t.changes -= changes
+	t.tableLock.Unlock()
+}
+
+// staleStats tells whether more than a tenth of the records changed since
+// the table was last analyzed.
+func (t *table) staleStats() bool {
+	t.tableLock.RLock()
+	defer t.tableLock.RUnlock()
+	if t.planStats == nil {
+		return len(t.records) > 0
+	}
+	return t.changes > t.planStats.rows/10
+}
+
+func (t *table) statistics() *tableStats {
+	t.tableLock.RLock()
+	defer t.tableLock.RUnlock()
+	return t.planStats
+}
+
+// refreshStats analyzes the tables whose statistics are stale, it is run
+// by the compaction loop.
+func (db *DbEngine) refreshStats() {
+	for _, n := range db.Tables() {
+		db.lockTables.RLock()
+		t, ok := db.tables[n]
+		db.lockTables.RUnlock()
+		if ok && t.staleStats() {
+			t.analyze()
+		}
+	}
+}
+
+func isAnalyzeStmt(sql string) bool {
+	f := strings.Fields(sql)
+	return len(f) > 0 && strings.ToUpper(f[0]) == "ANALYZE"
+}
+
+// execAnalyze runs ANALYZE [table], without a table all tables the user
+// may read are analyzed.
+func (db *DbEngine) execAnalyze(req QueryRequest) (res QueryResult) {
+	res.Status = "Syntax error"
+	tokens := strings.Fields(strings.TrimSuffix(strings.TrimSpace(req.Sql), ";"))
+	if len(tokens) > 2 {
+		res.Err = errorf(ErrSyntax, "expected ANALYZE [table]")
+		return
+	}
+
+	names := db.visibleTables(req.User)
+	if len(tokens) == 2 {
+		name := strings.TrimPrefix(tokens[1], defaultSchema+".")
+		res.Status = "Permission denied"
+		if err := db.CheckPrivilege(req.User, name, PrivSelect); err != nil {
+			res.Err = err
+			return
+		}
+		names = []string{name}
+	}
+
+	res.Status = "Logic error"
+	for _, n := range names {
+		db.lockTables.RLock()
+		t, ok := db.tables[n]
+		db.lockTables.RUnlock()
+		if !ok {
+			res.Err = errorf(ErrUndefinedTable, "table %s does not exist", n)
+			return
+		}
+		t.analyze()
+	}
+	res.Status = "OK"
+	return
+}
@@ -0,0 +1,241 @@
+package engine
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/rrowniak/sqlparser/query"
+)
+
+// compoundPart is a SELECT combined with the result of the ones before it
+// by op, which is UNION, INTERSECT or EXCEPT. all keeps duplicates.
+type compoundPart struct {
+	op       string
+	all      bool
+	text     string
+	tmpl     query.Query
+	distinct bool
+}
+
+// splitCompound splits a statement lexed by lexSql at the set operations
+// outside of parentheses, the first part has no op.
+func splitCompound(text string) ([]compoundPart, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	var parts []compoundPart
+	cur := compoundPart{}
+	start, depth := 0, 0
+	for i := 0; i < len(tokens); i++ {
+		tk := tokens[i]
+		switch {
+		case tk.isOp("("):
+			depth++
+		case tk.isOp(")"):
+			depth--
+		case depth == 0 && (tk.isKeyword("UNION") || tk.isKeyword("INTERSECT") || tk.isKeyword("EXCEPT")):
+			cur.text = strings.TrimSpace(text[start:tk.start])
+			parts = append(parts, cur)
+			cur = compoundPart{op: strings.ToUpper(tk.text)}
+			start = tk.end
+			if i+1 < len(tokens) && (tokens[i+1].isKeyword("ALL") || tokens[i+1].isKeyword("DISTINCT")) {
+				i++
+				cur.all = tokens[i].isKeyword("ALL")
+				start = tokens[i].end
+			}
+		}
+	}
+	cur.text = strings.TrimSpace(text[start:])
+	parts = append(parts, cur)
+	for _, p := range parts {
+		if p.text == "" && len(parts) > 1 {
+			return nil, errorf(ErrSyntax, "set operation without a SELECT")
+		}
+	}
+	return parts, nil
+}
+
+// execSetQuery runs a SELECT DISTINCT or SELECTs combined by set
+// operations. INTERSECT is applied first, then UNION and EXCEPT from left
+// to right. The columns of the result are named after the ones of the first
+// SELECT, the others must return as many columns of the same types.
+func (db *DbEngine) execSetQuery(req QueryRequest, ps *parsedStmt, first query.Query) (res QueryResult) {
+	res.Status = "Syntax error"
+	rest, err := ps.bindCompound(req.Args)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	qs := append([]query.Query{first}, rest...)
+
+	res.Status = "Permission denied"
+	for _, q := range qs[1:] {
+		if err := db.CheckPrivilege(req.User, q.TableName, PrivSelect); err != nil {
+			res.Err = err
+			return
+		}
+	}
+
+	res.Status = "Schema error"
+	partCols := make([][]Column, len(qs))
+	for i, q := range qs {
+		c, err := db.resultColumns(q)
+		if err == nil && i > 0 {
+			err = checkCompatible(ps.compound[i-1].op, partCols[0], c)
+		}
+		if err != nil {
+			res.Err = err
+			return
+		}
+		partCols[i] = c
+	}
+	cols := partCols[0]
+
+	res.Status = "Logic error"
+	results := make([][][]string, len(qs))
+	for i, q := range qs {
+		t, ok := db.lookupTable(q.TableName, req.User)
+		if !ok {
+			res.Err = errorf(ErrUndefinedTable, "table %s does not exist", q.TableName)
+			return
+		}
+		r := t.selectQ(q)
+		if r.Err != nil {
+			return r
+		}
+		for _, row := range r.Rows {
+			vals := make([]string, len(cols))
+			for j, col := range partCols[i] {
+				vals[j] = row.Fields[col.Name]
+			}
+			results[i] = append(results[i], vals)
+		}
+		distinct := ps.distinct
+		if i > 0 {
+			distinct = ps.compound[i-1].distinct
+		}
+		if distinct {
+			results[i] = uniqueRows(cols, results[i])
+		}
+	}
+
+	// INTERSECT binds tighter than UNION and EXCEPT
+	terms := [][][]string{results[0]}
+	var ops []compoundPart
+	for i, part := range ps.compound {
+		if part.op == "INTERSECT" {
+			last := len(terms) - 1
+			terms[last] = combineRows(part, cols, terms[last], results[i+1])
+			continue
+		}
+		terms = append(terms, results[i+1])
+		ops = append(ops, part)
+	}
+	rows := terms[0]
+	for i, op := range ops {
+		rows = combineRows(op, cols, rows, terms[i+1])
+	}
+
+	res.Status = "OK"
+	res.Columns = cols
+	for _, vals := range rows {
+		row := Row{Fields: make(map[string]string, len(cols))}
+		for j, c := range cols {
+			row.Fields[c.Name] = vals[j]
+		}
+		res.Rows = append(res.Rows, row)
+	}
+	return
+}
+
+// resultColumns returns the columns of the result of the SELECT q.
+func (db *DbEngine) resultColumns(q query.Query) ([]Column, error) {
+	schema, err := db.TableColumns(q.TableName)
+	if err != nil {
+		return nil, err
+	}
+	proj, _, err := projectFields(q.TableName, schema, q.Fields, q.Aliases, db.lookupFunc)
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]Column, len(proj))
+	for i, p := range proj {
+		cols[i] = p.Column
+	}
+	return cols, nil
+}
+
+// checkCompatible makes sure a SELECT combined by op returns columns like
+// the ones of the first SELECT.
+func checkCompatible(op string, want, got []Column) error {
+	if len(got) != len(want) {
+		return errorf(ErrSyntax, "each %s query must have the same number of columns", op)
+	}
+	for i := range want {
+		if got[i].Type != want[i].Type {
+			return errorf(ErrDatatypeMismatch, "%s types %s and %s cannot be matched", op, want[i].Type, got[i].Type)
+		}
+	}
+	return nil
+}
+
+// combineRows applies the set operation of part to the rows of its left
+// and right operands, keeping the order of the rows.
+func combineRows(part compoundPart, cols []Column, left, right [][]string) [][]string {
+	if part.op == "UNION" {
+		rows := append(append([][]string(nil), left...), right...)
+		if part.all {
+			return rows
+		}
+		return uniqueRows(cols, rows)
+	}
+
+	if !part.all {
+		left = uniqueRows(cols, left)
+	}
+	count := make(map[string]int)
+	for _, r := range right {
+		count[rowKey(cols, r)]++
+	}
+	var rows [][]string
+	for _, r := range left {
+		k := rowKey(cols, r)
+		in := count[k] > 0
+		if part.all && in {
+			count[k]--
+		}
+		if in == (part.op == "INTERSECT") {
+			rows = append(rows, r)
+		}
+	}
+	return rows
+}
+
+// uniqueRows drops the rows equal to one before them, NULLs are equal.
+func uniqueRows(cols []Column, rows [][]string) [][]string {
+	seen := make(map[string]bool, len(rows))
+	var unique [][]string
+	for _, r := range rows {
+		k := rowKey(cols, r)
+		if !seen[k] {
+			seen[k] = true
+			unique = append(unique, r)
+		}
+	}
+	return unique
+}
+
+// rowKey returns a string equal for the rows with equal values, whatever
+// their textual form.
+func rowKey(cols []Column, vals []string) string {
+	var b strings.Builder
+	for i, v := range vals {
+		if x, err := ParseValue(cols[i].Type, v); err == nil {
+			v, _ = FormatValue(x)
+		}
+		b.WriteString(strconv.Quote(v))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
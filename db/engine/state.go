@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// State is the lifecycle stage of the engine.
+type State int32
+
+const (
+	StateStarting State = iota
+	StateReady
+	// StateDraining means the engine is going down, statements in progress
+	// are still completed.
+	StateDraining
+	// StateReadOnly is entered after a failed write to DbDir, statements
+	// changing data or grants are rejected from then on.
+	StateReadOnly
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStarting:
+		return "starting"
+	case StateReady:
+		return "ready"
+	case StateDraining:
+		return "draining"
+	case StateReadOnly:
+		return "read-only"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+func (db *DbEngine) State() State {
+	return State(atomic.LoadInt32(&db.state))
+}
+
+func (db *DbEngine) setState(s State) {
+	atomic.StoreInt32(&db.state, int32(s))
+}
+
+// Drain marks the engine as going down so readiness checks fail while the
+// requests in progress are finished. Call Stop afterwards.
+func (db *DbEngine) Drain() {
+	db.setState(StateDraining)
+}
+
+// Uptime returns the time since Start.
+func (db *DbEngine) Uptime() time.Duration {
+	if db.started.IsZero() {
+		return 0
+	}
+	return time.Since(db.started)
+}
+
+// LastCompaction returns when the periodic compaction last finished, the
+// zero time if it didn't run yet.
+func (db *DbEngine) LastCompaction() time.Time {
+	n := atomic.LoadInt64(&db.lastCompact)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// LastError returns the error that made the engine read-only, if any.
+func (db *DbEngine) LastError() error {
+	db.lockErr.Lock()
+	defer db.lockErr.Unlock()
+	return db.lastErr
+}
+
+func (db *DbEngine) setReadOnly(err error) {
+	db.lockErr.Lock()
+	db.lastErr = err
+	db.lockErr.Unlock()
+	db.setState(StateReadOnly)
+}
+
+// checkWritable fails if the engine went read-only.
+func (db *DbEngine) checkWritable() error {
+	if db.State() == StateReadOnly {
+		return errorf(ErrReadOnly, "database is read-only: %s", db.LastError())
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rrowniak/sqlparser/query"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the statement
+// latency histograms.
+var LatencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30}
+
+// QueryStats describes the statements of one kind that ended with the same
+// status. Buckets holds cumulative counts for LatencyBuckets.
+type QueryStats struct {
+	// Statement is one of select, insert, update, delete, create, drop,
+	// create_index, grant, show, explain, analyze or unknown for statements
+	// that didn't parse.
+	Statement string
+	// Status is "ok" or the error code of failed statements.
+	Status     string
+	Count      uint64
+	SumSeconds float64
+	Buckets    []uint64
+}
+
+// TableStats describes a single table. Bytes is an estimate of the memory
+// taken by its records.
+type TableStats struct {
+	Name  string
+	Rows  int
+	Bytes int
+}
+
+// Stats is a snapshot of the engine state.
+type Stats struct {
+	Queries []QueryStats
+	// QueueDepth is the number of requests waiting for a worker.
+	QueueDepth    int
+	QueueCapacity int
+	// WorkersBusy is the number of statements being executed.
+	WorkersBusy     int
+	WorkersCapacity int
+	// Compactions is the number of periodic compactions run so far, taking
+	// CompactionSeconds in total.
+	Compactions       uint64
+	CompactionSeconds float64
+	Tables            []TableStats
+}
+
+type queryStatsKey struct {
+	statement string
+	status    string
+}
+
+type queryStats struct {
+	lock  *sync.Mutex
+	stats map[queryStatsKey]*QueryStats
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{lock: &sync.Mutex{}, stats: make(map[queryStatsKey]*QueryStats)}
+}
+
+func (qs *queryStats) observe(statement string, err error, d time.Duration) {
+	status := "ok"
+	if err != nil {
+		status = string(ErrorCodeOf(err))
+	}
+	key := queryStatsKey{statement, status}
+
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	s, ok := qs.stats[key]
+	if !ok {
+		s = &QueryStats{Statement: statement, Status: status, Buckets: make([]uint64, len(LatencyBuckets))}
+		qs.stats[key] = s
+	}
+	secs := d.Seconds()
+	s.Count++
+	s.SumSeconds += secs
+	for i, le := range LatencyBuckets {
+		if secs <= le {
+			s.Buckets[i]++
+		}
+	}
+}
+
+func statementName(qt query.Type) string {
+	switch qt {
+	case query.Select:
+		return "select"
+	case query.Insert:
+		return "insert"
+	case query.Update:
+		return "update"
+	case query.Delete:
+		return "delete"
+	case query.Create:
+		return "create"
+	case query.Drop:
+		return "drop"
+	case query.CreateIndex:
+		return "create_index"
+	default:
+		return "unknown"
+	}
+}
+
+// stats estimates the memory taken by the records of the table.
+func (t *table) stats() TableStats {
+	t.tableLock.RLock()
+	defer t.tableLock.RUnlock()
+
+	// a slice header per record and a string header per cell
+	const recordOverhead, cellOverhead = 24, 16
+	ts := TableStats{Name: t.name, Rows: len(t.records)}
+	for _, r := range t.records {
+		ts.Bytes += recordOverhead + len(r.cells)*cellOverhead
+		for _, c := range r.cells {
+			ts.Bytes += len(c)
+		}
+	}
+	return ts
+}
+
+// Stats returns statement counters and the current load and size of the
+// engine.
+func (db *DbEngine) Stats() Stats {
+	var s Stats
+	db.stats.lock.Lock()
+	for _, qs := range db.stats.stats {
+		c := *qs
+		c.Buckets = append([]uint64(nil), qs.Buckets...)
+		s.Queries = append(s.Queries, c)
+	}
+	db.stats.lock.Unlock()
+	sort.Slice(s.Queries, func(i, j int) bool {
+		if s.Queries[i].Statement != s.Queries[j].Statement {
+			return s.Queries[i].Statement < s.Queries[j].Statement
+		}
+		return s.Queries[i].Status < s.Queries[j].Status
+	})
+
+	s.QueueDepth, s.QueueCapacity = len(db.requests), cap(db.requests)
+	s.WorkersBusy, s.WorkersCapacity = len(db.reqWorkersPool), cap(db.reqWorkersPool)
+	s.Compactions = uint64(atomic.LoadInt64(&db.compactions))
+	s.CompactionSeconds = time.Duration(atomic.LoadInt64(&db.compactNanos)).Seconds()
+
+	db.lockTables.RLock()
+	tables := make([]*table, 0, len(db.tables))
+	for _, t := range db.tables {
+		tables = append(tables, t)
+	}
+	db.lockTables.RUnlock()
+	for _, t := range tables {
+		s.Tables = append(s.Tables, t.stats())
+	}
+	sort.Slice(s.Tables, func(i, j int) bool { return s.Tables[i].Name < s.Tables[j].Name })
+	return s
+}
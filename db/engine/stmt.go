@@ -0,0 +1,235 @@
+package engine
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/rrowniak/sqlparser/query"
+)
+
+// Stmt is a statement parsed once and cached by the engine under a handle.
+type Stmt struct {
+	db     *DbEngine
+	handle string
+	params int
+}
+
+// Prepare parses sql and caches the result until Deallocate is called. The
+// statement has no owner, only trusted in-process callers may run it.
+func (db *DbEngine) Prepare(sql string) (*Stmt, error) {
+	return db.PrepareContext(context.Background(), sql)
+}
+
+// PrepareContext is Prepare for the user of ctx, who alone may run or
+// deallocate the statement through its handle. A user may hold at most
+// MaxPreparedStmts statements.
+func (db *DbEngine) PrepareContext(ctx context.Context, sql string) (*Stmt, error) {
+	ps, err := parseStmt(sql)
+	if err != nil {
+		return nil, err
+	}
+	ps.owner = UserFrom(ctx)
+
+	db.lockStmts.Lock()
+	defer db.lockStmts.Unlock()
+	if max := db.cfg.MaxPreparedStmts; max > 0 && db.stmtCount[ps.owner] >= max {
+		return nil, errorf(ErrTooManyRequests, "too many prepared statements, at most %d may be kept", max)
+	}
+	db.lastStmt++
+	handle := "stmt" + strconv.Itoa(db.lastStmt)
+	db.stmts[handle] = ps
+	db.stmtCount[ps.owner]++
+
+	return &Stmt{db: db, handle: handle, params: ps.params}, nil
+}
+
+// Deallocate drops the prepared statement, it returns false if there was
+// no statement with the given handle.
+func (db *DbEngine) Deallocate(handle string) bool {
+	return db.deallocate(handle, "")
+}
+
+// DeallocateContext is Deallocate for the user of ctx, statements of other
+// users are left alone as if they didn't exist.
+func (db *DbEngine) DeallocateContext(ctx context.Context, handle string) bool {
+	return db.deallocate(handle, UserFrom(ctx))
+}
+
+func (db *DbEngine) deallocate(handle, user string) bool {
+	db.lockStmts.Lock()
+	defer db.lockStmts.Unlock()
+	ps, ok := db.stmts[handle]
+	if !ok || !ps.ownedBy(user) {
+		return false
+	}
+	delete(db.stmts, handle)
+	if db.stmtCount[ps.owner]--; db.stmtCount[ps.owner] == 0 {
+		delete(db.stmtCount, ps.owner)
+	}
+	return true
+}
+
+// ExecPrepared runs the statement prepared under handle.
+func (db *DbEngine) ExecPrepared(ctx context.Context, handle string, args ...interface{}) (QueryResult, error) {
+	return db.do(ctx, QueryRequest{Handle: handle, Args: args})
+}
+
+// preparedStmt returns the statement prepared under handle for user.
+func (db *DbEngine) preparedStmt(handle, user string) (*parsedStmt, error) {
+	db.lockStmts.Lock()
+	ps, ok := db.stmts[handle]
+	db.lockStmts.Unlock()
+	if !ok || !ps.ownedBy(user) {
+		return nil, errorf(ErrInvalidStatement, "prepared statement %s does not exist", handle)
+	}
+	return ps, nil
+}
+
+// ownedBy tells whether user may use the statement, the empty user is a
+// trusted in-process caller.
+func (ps *parsedStmt) ownedBy(user string) bool {
+	return user == "" || ps.owner == user
+}
+
+// Columns returns the result columns of a prepared SELECT or EXPLAIN
+// without running it, other statements have none.
+func (s *Stmt) Columns() ([]Column, error) {
+	s.db.lockStmts.Lock()
+	ps, ok := s.db.stmts[s.handle]
+	s.db.lockStmts.Unlock()
+	if !ok {
+		return nil, errorf(ErrInvalidStatement, "prepared statement %s does not exist", s.handle)
+	}
+	if ps.explain {
+		return []Column{{Name: planColumn, Type: TEXT}}, nil
+	}
+	if ps.tmpl.Type != query.Select {
+		return nil, nil
+	}
+
+	cols, err := s.db.resultColumns(ps.tmpl)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range ps.compound {
+		c, err := s.db.resultColumns(part.tmpl)
+		if err == nil {
+			err = checkCompatible(part.op, cols, c)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cols, nil
+}
+
+// ParamTypes returns the type of every parameter, taken from the column it
+// is compared with or assigned to. Parameters without a column are TEXT.
+func (s *Stmt) ParamTypes() ([]FieldType, error) {
+	s.db.lockStmts.Lock()
+	ps, ok := s.db.stmts[s.handle]
+	s.db.lockStmts.Unlock()
+	if !ok {
+		return nil, errorf(ErrInvalidStatement, "prepared statement %s does not exist", s.handle)
+	}
+	types := make([]FieldType, ps.params)
+	for i := range types {
+		types[i] = TEXT
+	}
+	if ps.params == 0 {
+		return types, nil
+	}
+
+	tmpls := []query.Query{ps.tmpl}
+	for _, part := range ps.compound {
+		tmpls = append(tmpls, part.tmpl)
+	}
+	for _, tmpl := range tmpls {
+		if err := s.setParamTypes(ps, tmpl, types); err != nil {
+			return nil, err
+		}
+	}
+	return types, nil
+}
+
+// setParamTypes sets the types of the parameters of tmpl, one of the
+// statements of ps.
+func (s *Stmt) setParamTypes(ps *parsedStmt, tmpl query.Query, types []FieldType) error {
+	schema, err := s.db.TableColumns(tmpl.TableName)
+	if err != nil {
+		return err
+	}
+	typeOf := make(map[string]FieldType, len(schema))
+	for _, c := range schema {
+		typeOf[c.Name] = c.Type
+	}
+	set := func(token, column string) {
+		if p := ps.paramOf(token); p >= 0 {
+			if ft, ok := typeOf[column]; ok {
+				types[p] = ft
+			}
+		}
+	}
+
+	for _, c := range tmpl.Conditions {
+		if c.Operand1IsField {
+			set(c.Operand2, c.Operand1)
+		}
+		if c.Operand2IsField {
+			set(c.Operand1, c.Operand2)
+		}
+	}
+	for col, v := range tmpl.Updates {
+		set(v, col)
+	}
+	fields := tmpl.Fields
+	if len(fields) == 0 {
+		for _, c := range schema {
+			fields = append(fields, c.Name)
+		}
+	}
+	for _, ins := range tmpl.Inserts {
+		for i, v := range ins {
+			if i < len(fields) {
+				set(v, fields[i])
+			}
+		}
+	}
+	return nil
+}
+
+// Table returns the table the statement refers to.
+func (s *Stmt) Table() string {
+	s.db.lockStmts.Lock()
+	defer s.db.lockStmts.Unlock()
+	if ps, ok := s.db.stmts[s.handle]; ok {
+		return ps.tmpl.TableName
+	}
+	return ""
+}
+
+func (s *Stmt) Handle() string {
+	return s.handle
+}
+
+// NumParams returns the number of parameters the statement expects.
+func (s *Stmt) NumParams() int {
+	return s.params
+}
+
+func (s *Stmt) Exec(ctx context.Context, args ...interface{}) (QueryResult, error) {
+	return s.db.ExecPrepared(ctx, s.handle, args...)
+}
+
+func (s *Stmt) Query(ctx context.Context, args ...interface{}) (*Rows, error) {
+	res, err := s.Exec(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return newRows(res), nil
+}
+
+func (s *Stmt) Close() error {
+	s.db.Deallocate(s.handle)
+	return nil
+}
@@ -1,10 +1,10 @@
 package engine
 
 import (
-	"fmt"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/rrowniak/sqlparser/query"
 )
@@ -52,10 +52,37 @@ type table struct {
 	name      string
 	sch       schema
 	records   []record
+	indexes   []*index
+	// planStats are set by ANALYZE, changes counts the records inserted,
+	// updated or deleted since
+	planStats *tableStats
+	changes   int
+	// funcs looks up the functions expressions call, the built-in ones if
+	// it is nil
+	funcs func(name string) *sqlFunc
 }
 
-func (t *table) selectQ(query query.Query) (res QueryResult) {
-	t.tableLock.RLock()
+func (t *table) selectQ(query query.Query) QueryResult {
+	var rows []Row
+	res := t.selectEach(query, nil, func(row Row) bool {
+		rows = append(rows, row)
+		return true
+	})
+	res.Rows = rows
+	return res
+}
+
+// selectEach validates the query, reports the result columns to header
+// (if not nil) and hands every matching row to emit. The table stays
+// read-locked for the whole walk, emit returns false to stop it early.
+func (t *table) selectEach(query query.Query, header func(QueryResult), emit func(Row) bool) QueryResult {
+	return t.selectRows(query, header, emit, nil)
+}
+
+// selectRows is selectEach, st (if not nil) collects what EXPLAIN ANALYZE
+// reports about the scan.
+func (t *table) selectRows(query query.Query, header func(QueryResult), emit func(Row) bool, st *opStats) (res QueryResult) {
+	st.rlock(t.tableLock)
 	defer t.tableLock.RUnlock()
 
 	res.Status = "OK"
@@ -63,29 +90,91 @@ func (t *table) selectQ(query query.Query) (res QueryResult) {
 	if err != nil {
 		res.Err = err
 		res.Status = "Schema error"
+		return
+	}
+
+	proj, aggs, err := projectFields(t.name, columnsOf(t.sch), query.Fields, query.Aliases, t.lookupFunc)
+	if err != nil {
+		res.Err = err
+		res.Status = "Schema error"
+		return
+	}
+	for _, pc := range proj {
+		res.Columns = append(res.Columns, pc.Column)
+	}
+	if header != nil {
+		header(res)
 	}
 
-	t.walkEvery(query.Conditions, func(r *record) {
-		row := Row{Fields: make(map[string]string)}
-		res.Rows = append(res.Rows, row)
-		cells := &res.Rows[len(res.Rows)-1].Fields
-		for _, f := range query.Fields {
-			if f == "*" {
-				for i, ff := range t.sch.name {
-					(*cells)[ff] = r.cells[i]
+	var evalErr error
+	err = t.walkWhile(query.Conditions, st, func(r *record) bool {
+		if len(aggs) > 0 {
+			for _, a := range aggs {
+				if evalErr = a.step(r.cells); evalErr != nil {
+					return false
 				}
-			} else {
-				i := t.getFieldIndex(f)
-				(*cells)[f] = r.cells[i]
 			}
+			return true
+		}
+		var row Row
+		if row, evalErr = projectRow(proj, r.cells); evalErr != nil {
+			return false
 		}
+		return emit(row)
 	})
-
+	if err == nil {
+		err = evalErr
+	}
+	if err == nil && len(aggs) > 0 {
+		// aggregates make a single row out of all matching records
+		err = finishAggregates(aggs)
+		var row Row
+		if err == nil {
+			row, err = projectRow(proj, nil)
+		}
+		if err == nil {
+			emit(row)
+		}
+	}
+	if err != nil {
+		res.Err = err
+		res.Status = "Logic error"
+	}
 	return
 }
 
-func (t *table) updateQ(query query.Query) (res QueryResult) {
-	t.tableLock.Lock()
+// projectRow computes the row of a result from the cells of a record.
+func projectRow(proj []projected, cells []string) (Row, error) {
+	row := Row{Fields: make(map[string]string, len(proj))}
+	for _, pc := range proj {
+		if pc.e == nil {
+			row.Fields[pc.Name] = cells[pc.col]
+			continue
+		}
+		v, err := pc.e.eval(cells)
+		if err != nil {
+			return Row{}, err
+		}
+		row.Fields[pc.Name] = toText(v)
+	}
+	return row, nil
+}
+
+func finishAggregates(aggs []*aggExpr) error {
+	for _, a := range aggs {
+		if err := a.finish(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *table) updateQ(query query.Query) QueryResult {
+	return t.updateRows(query, nil)
+}
+
+func (t *table) updateRows(query query.Query, st *opStats) (res QueryResult) {
+	st.lock(t.tableLock)
 	defer t.tableLock.Unlock()
 
 	res.Status = "OK"
@@ -93,20 +182,76 @@ func (t *table) updateQ(query query.Query) (res QueryResult) {
 	if err != nil {
 		res.Err = err
 		res.Status = "Schema error"
+		return
 	}
 
-	t.walkEvery(query.Conditions, func(r *record) {
+	// expressions see the values the record had before the update, every
+	// new value is checked before any record is changed
+	exprs := make(map[string]expr)
+	for f, v := range query.Updates {
+		if isExpr(v) {
+			if exprs[f], err = t.compile(v); err != nil {
+				res.Err = err
+				res.Status = "Schema error"
+				return
+			}
+		}
+	}
+	var matched []*record
+	err = t.walkEvery(query.Conditions, st, func(r *record) {
+		matched = append(matched, r)
+	})
+	values := make([][]string, len(matched))
+	for n, r := range matched {
+		if err != nil {
+			break
+		}
+		values[n] = append([]string(nil), r.cells...)
 		for f, v := range query.Updates {
 			i := t.getFieldIndex(f)
-			r.cells[i] = v
+			if e := exprs[f]; e != nil {
+				var val interface{}
+				if val, err = e.eval(r.cells); err != nil {
+					break
+				}
+				v = toText(val)
+				if err = t.validateValue(f, v); err != nil {
+					break
+				}
+			}
+			values[n][i] = t.storedValue(i, v)
 		}
-	})
+	}
+	if err == nil {
+		err = t.checkPrimaryKey(matched, values)
+	}
+	if err != nil {
+		res.Err = err
+		res.Status = "Logic error"
+		return
+	}
+	for n, r := range matched {
+		r.cells = values[n]
+	}
+	res.RowsAffected = len(matched)
+	if res.RowsAffected > 0 {
+		changed := make(map[int]bool)
+		for f := range query.Updates {
+			changed[t.getFieldIndex(f)] = true
+		}
+		t.reindex(changed)
+		t.changes += res.RowsAffected
+	}
 
 	return
 }
 
-func (t *table) insertQ(query query.Query) (res QueryResult) {
-	t.tableLock.Lock()
+func (t *table) insertQ(query query.Query) QueryResult {
+	return t.insertRows(query, nil)
+}
+
+func (t *table) insertRows(query query.Query, st *opStats) (res QueryResult) {
+	st.lock(t.tableLock)
 	defer t.tableLock.Unlock()
 
 	res.Status = "OK"
@@ -114,34 +259,74 @@ func (t *table) insertQ(query query.Query) (res QueryResult) {
 	if err != nil {
 		res.Err = err
 		res.Status = "Schema error"
+		return
 	}
 
-	for _, ins := range query.Inserts {
-		var rec record
-		rec.cells = make([]string, len(t.sch.name))
+	values := make([][]string, len(query.Inserts))
+	for n, ins := range query.Inserts {
+		values[n] = make([]string, len(t.sch.name))
 		for i, val := range ins {
-			rec.cells[t.getFieldIndex(query.Fields[i])] = val
+			f := t.getFieldIndex(query.Fields[i])
+			values[n][f] = t.storedValue(f, val)
+		}
+	}
+	if err := t.checkPrimaryKey(nil, values); err != nil {
+		res.Err = err
+		res.Status = "Logic error"
+		return
+	}
+	for _, cells := range values {
+		t.records = append(t.records, record{cells: cells})
+		for _, idx := range t.indexes {
+			t.indexRecord(idx, len(t.records)-1)
 		}
-		t.records = append(t.records, rec)
 	}
+	res.RowsAffected = len(query.Inserts)
+	t.changes += res.RowsAffected
 	return
 }
 
-func (t *table) deleteQ(query query.Query) (res QueryResult) {
-	t.tableLock.Lock()
+func (t *table) deleteQ(query query.Query) QueryResult {
+	return t.deleteRows(query, nil)
+}
+
+func (t *table) deleteRows(query query.Query, st *opStats) (res QueryResult) {
+	st.lock(t.tableLock)
 	defer t.tableLock.Unlock()
 
 	res.Status = "OK"
+	err := t.validate(query)
+	if err != nil {
+		res.Err = err
+		res.Status = "Schema error"
+		return
+	}
 
+	// the records are compacted in place, so they are all visited anyway
+	f, err := t.compileFilter(t.plan(query.Conditions, false).filter)
+	if err != nil {
+		res.Err = err
+		res.Status = "Schema error"
+		return
+	}
+	start := time.Now()
+	del := make([]bool, len(t.records))
+	for i := range t.records {
+		if del[i], err = t.matches(f, &t.records[i]); err != nil {
+			res.Err = err
+			res.Status = "Logic error"
+			return
+		}
+	}
 	deleted := 0
 	swap_cand := len(t.records) - 1
 	for i := 0; i <= swap_cand; i++ {
-		if t.evalConditions(query.Conditions, &t.records[i]) {
+		if del[i] {
 			// find a swap candidate
 			deleted++
 			found := false
 			for j := swap_cand; j > i; j-- {
-				if !t.evalConditions(query.Conditions, &t.records[j]) {
+				if !del[j] {
 					swap_cand = j
 					found = true
 					break
@@ -160,25 +345,48 @@ func (t *table) deleteQ(query query.Query) (res QueryResult) {
 	}
 	if deleted != 0 {
 		t.records = t.records[:len(t.records)-deleted]
+		t.reindex(nil)
+		t.changes += deleted
+	}
+	if st != nil {
+		st.scanned += len(t.records) + deleted
+		st.matched += deleted
+		st.since(start)
 	}
-	// TODO: either indexes have to be updated or tombstones should be leveraged
+	res.RowsAffected = deleted
 	return
 }
 
 func (t *table) dropQ() {
-
+	t.tableLock.Lock()
+	defer t.tableLock.Unlock()
+	t.records = nil
+	t.planStats = nil
+	t.reindex(nil)
 }
 
 func (t *table) createIndexQ(query query.Query) (res QueryResult) {
-	t.tableLock.RLock()
-	defer t.tableLock.RUnlock()
+	t.tableLock.Lock()
+	defer t.tableLock.Unlock()
 
 	err := t.validate(query)
 	if err != nil {
 		res.Err = err
 		res.Status = "Schema error"
+		return
 	}
 
+	res.Status = "Logic error"
+	if len(query.Fields) != 1 {
+		res.Err = errorf(ErrFeatureNotSupported, "indexes on several columns are not supported")
+		return
+	}
+	if t.indexNamed(query.IndexName) != nil {
+		res.Err = errorf(ErrDuplicateObject, "index %s already exists", query.IndexName)
+		return
+	}
+	t.addIndex(query.IndexName, t.getFieldIndex(query.Fields[0]), false)
+	res.Status = "OK"
 	return
 }
 
@@ -193,18 +401,71 @@ func (t *table) getFieldIndex(f string) int {
 }
 
 func (t *table) validate(query query.Query) error {
-	for _, f := range query.Fields {
-		if f == "*" {
+	if _, _, err := projectFields(t.name, columnsOf(t.sch), query.Fields, query.Aliases, t.lookupFunc); err != nil {
+		return err
+	}
+	for f, v := range query.Updates {
+		if t.getFieldIndex(f) == -1 {
+			return errorf(ErrUndefinedColumn, "schema violation: field %s not defined", f)
+		}
+		if isExpr(v) {
+			if _, err := t.compile(v); err != nil {
+				return err
+			}
 			continue
 		}
-		if t.getFieldIndex(f) == -1 {
-			return fmt.Errorf("schema violation: field %s not defined", f)
+		if err := t.validateValue(f, v); err != nil {
+			return err
+		}
+	}
+	for _, ins := range query.Inserts {
+		for i, v := range ins {
+			if i >= len(query.Fields) {
+				break
+			}
+			if err := t.validateValue(query.Fields[i], v); err != nil {
+				return err
+			}
+		}
+	}
+	for i, c := range query.Conditions {
+		if isExpr(c.Operand1) {
+			if _, err := t.compileFilter(query.Conditions[i : i+1]); err != nil {
+				return err
+			}
+			continue
+		}
+		if c.Operand1IsField && t.getFieldIndex(c.Operand1) == -1 {
+			return errorf(ErrUndefinedColumn, "schema violation: field %s not defined", c.Operand1)
+		}
+		if c.Operand2IsField && t.getFieldIndex(c.Operand2) == -1 {
+			return errorf(ErrUndefinedColumn, "schema violation: field %s not defined", c.Operand2)
 		}
 	}
 
 	return nil
 }
 
+func (t *table) validateValue(f, v string) error {
+	i := t.getFieldIndex(f)
+	if i == -1 {
+		return nil
+	}
+	if _, err := ParseValue(t.sch.colType[i], v); err != nil {
+		return errorf(ErrInvalidValue, "schema violation: field %s: %s", f, err)
+	}
+	return nil
+}
+
+// storedValue returns the form the valid value v is kept in by the column
+// i, BOOL values are kept as true or false however they were written.
+func (t *table) storedValue(i int, v string) string {
+	if t.sch.colType[i] == BOOL && v != "" {
+		return strconv.FormatBool(isTrue(v))
+	}
+	return v
+}
+
 func (t *table) evalCondition(cond query.Condition, r *record) bool {
 	vals := make([]string, 2)
 	var fieldTypes []FieldType
@@ -244,8 +505,8 @@ func (t *table) evalCondition(cond query.Condition, r *record) bool {
 			return false
 		}
 	case BOOL:
-		v1 := vals[0] == "true"
-		v2 := vals[1] == "true"
+		v1 := isTrue(vals[0])
+		v2 := isTrue(vals[1])
 		switch cond.Operator {
 		case query.Eq:
 			return v1 == v2
@@ -295,10 +556,170 @@ func (t *table) evalConditions(conds []query.Condition, r *record) bool {
 	return true
 }
 
-func (t *table) walkEvery(conds []query.Condition, visitor func(r *record)) {
+func (t *table) walkEvery(conds []query.Condition, st *opStats, visitor func(r *record)) error {
+	return t.walkWhile(conds, st, func(r *record) bool {
+		visitor(r)
+		return true
+	})
+}
+
+// walkWhile visits matching records, in table order, until visitor
+// returns false. The records are found along the access path chosen by
+// plan, st (if not nil) counts the records scanned and matched.
+func (t *table) walkWhile(conds []query.Condition, st *opStats, visitor func(r *record) bool) error {
+	start := time.Now()
+	defer st.since(start)
+	p := t.plan(conds, true)
+	f, err := t.compileFilter(p.filter)
+	if err != nil {
+		return err
+	}
+	visit := func(i int) (bool, error) {
+		if st != nil {
+			st.scanned++
+		}
+		ok, err := t.matches(f, &t.records[i])
+		if err != nil || !ok {
+			return err == nil, err
+		}
+		if st != nil {
+			st.matched++
+		}
+		return visitor(&t.records[i]), nil
+	}
+	if p.idx != nil {
+		for _, i := range t.positions(p) {
+			if more, err := visit(i); !more {
+				return err
+			}
+		}
+		return nil
+	}
 	for i := range t.records {
-		if t.evalConditions(conds, &t.records[i]) {
-			visitor(&t.records[i])
+		if more, err := visit(i); !more {
+			return err
 		}
 	}
+	return nil
+}
+
+// filter is a compiled WHERE clause, exprs holds the expressions of the
+// conditions that have one.
+type filter struct {
+	conds []query.Condition
+	exprs []expr
+}
+
+func (t *table) compileFilter(conds []query.Condition) (filter, error) {
+	f := filter{conds: conds, exprs: make([]expr, len(conds))}
+	for i, c := range conds {
+		if !isExpr(c.Operand1) {
+			continue
+		}
+		e, err := t.compile(c.Operand1)
+		if err != nil {
+			return f, err
+		}
+		if typ := e.typ(); typ != BOOL && typ != UNKNOWN_FIELD_TYPE {
+			return f, errorf(ErrDatatypeMismatch, "argument of WHERE must be BOOL, not %s", typ)
+		}
+		f.exprs[i] = e
+	}
+	return f, nil
+}
+
+// matches tells whether r satisfies all the conditions of f, conditions
+// evaluating to NULL aren't satisfied.
+func (t *table) matches(f filter, r *record) (bool, error) {
+	for i, c := range f.conds {
+		if e := f.exprs[i]; e != nil {
+			v, err := e.eval(r.cells)
+			if err != nil || v == nil {
+				return false, err
+			}
+			if ok, err := toBool(v); err != nil || !ok {
+				return false, err
+			}
+			continue
+		}
+		if !t.evalCondition(c, r) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// compile compiles the expression s holds for the columns of the table.
+func (t *table) compile(s string) (expr, error) {
+	return compileExpr(exprText(s), t.name, columnsOf(t.sch), t.lookupFunc)
+}
+
+func (t *table) lookupFunc(name string) *sqlFunc {
+	if t.funcs == nil {
+		return builtinFuncs[name]
+	}
+	return t.funcs(name)
+}
+
+// projected is a column of the result of a SELECT, either a column of the
+// table (col >= 0) or an expression.
+type projected struct {
+	Column
+	col int
+	e   expr
+}
+
+// projectFields returns the columns SELECT fields produces from the columns
+// cols of table, "*" stands for all of them. Columns are named after their
+// alias or else the column or the expression. If fields call aggregate
+// functions the calls are returned as well, the result is then a single
+// row computed from them and columns can't be used outside of them.
+func projectFields(table string, cols []Column, fields []string, aliases map[string]string, funcs func(string) *sqlFunc) ([]projected, []*aggExpr, error) {
+	var proj []projected
+	var aggs []*aggExpr
+	bare := ""
+	for _, f := range fields {
+		if f == "*" {
+			for i, c := range cols {
+				proj = append(proj, projected{Column: c, col: i})
+			}
+			bare = f
+			continue
+		}
+		name := f
+		if a, ok := aliases[f]; ok {
+			name = a
+		}
+		if isExpr(f) {
+			e, calls, usesCols, err := compileSelected(exprText(f), table, cols, funcs)
+			if err != nil {
+				return nil, nil, err
+			}
+			if name == f {
+				name = exprText(f)
+			}
+			proj = append(proj, projected{Column: Column{Name: name, Type: resultType(e)}, col: -1, e: e})
+			aggs = append(aggs, calls...)
+			if usesCols {
+				bare = exprText(f)
+			}
+			continue
+		}
+		found := false
+		for i, c := range cols {
+			if c.Name == f {
+				proj = append(proj, projected{Column: Column{Name: name, Type: c.Type}, col: i})
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil, errorf(ErrUndefinedColumn, "schema violation: field %s not defined", f)
+		}
+		bare = f
+	}
+	if len(aggs) > 0 && bare != "" {
+		return nil, nil, errorf(ErrGrouping, "%s must be used in an aggregate function", bare)
+	}
+	return proj, aggs, nil
 }
@@ -676,3 +676,47 @@ func TestSpecificDeletePatern(t *testing.T) {
 		t.Errorf("Unexpected size = %d (%v)", len(ret), ret)
 	}
 }
+
+func TestRowsAffected(t *testing.T) {
+	table := createSimpleTestTable([]int{5, 2, 4, 1, 3})
+
+	q := query.Query{
+		Type:      query.Insert,
+		TableName: table.name,
+		Fields:    []string{"id"},
+		Inserts:   [][]string{{"6"}, {"7"}},
+	}
+	if qr := table.insertQ(q); qr.RowsAffected != 2 {
+		t.Errorf("Expected 2 rows inserted, got %d", qr.RowsAffected)
+	}
+
+	q = query.Query{
+		Type:      query.Update,
+		TableName: table.name,
+		Updates:   map[string]string{"id": "0"},
+		Conditions: []query.Condition{
+			{Operand1: "id", Operand1IsField: true, Operator: query.Gt, Operand2: "5", Operand2IsField: false},
+		},
+	}
+	if qr := table.updateQ(q); qr.RowsAffected != 2 {
+		t.Errorf("Expected 2 rows updated, got %d", qr.RowsAffected)
+	}
+	q.Conditions[0].Operand2 = "100"
+	if qr := table.updateQ(q); qr.RowsAffected != 0 {
+		t.Errorf("Expected no rows updated, got %d", qr.RowsAffected)
+	}
+
+	q = query.Query{
+		Type:      query.Delete,
+		TableName: table.name,
+		Conditions: []query.Condition{
+			{Operand1: "id", Operand1IsField: true, Operator: query.Lt, Operand2: "3", Operand2IsField: false},
+		},
+	}
+	if qr := table.deleteQ(q); qr.RowsAffected != 4 {
+		t.Errorf("Expected 4 rows deleted, got %d", qr.RowsAffected)
+	}
+	if qr := table.deleteQ(q); qr.RowsAffected != 0 {
+		t.Errorf("Expected no rows deleted, got %d", qr.RowsAffected)
+	}
+}
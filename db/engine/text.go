@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+var cellEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+// SplitStatements returns the statements terminated with ';' outside of
+// quoted literals and identifiers, and the text after the last of them.
+// Inside a literal a quote is escaped by doubling it or with a backslash.
+// Empty statements are dropped, rest is empty if only blanks follow the
+// last ';'.
+func SplitStatements(sql string) (stmts []string, rest string) {
+	var quote byte
+	start := 0
+	for i := 0; i < len(sql); i++ {
+		ch := sql[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && quote == '\'' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == ';':
+			if s := strings.TrimSpace(sql[start:i]); s != "" {
+				stmts = append(stmts, s)
+			}
+			start = i + 1
+		}
+	}
+	rest = sql[start:]
+	if strings.TrimSpace(rest) == "" {
+		rest = ""
+	}
+	return stmts, rest
+}
+
+// WriteTable writes res as an aligned table meant for humans, INT columns
+// are right-aligned and control characters in cells are escaped. Results
+// without columns are written as how many rows they changed.
+func WriteTable(w io.Writer, res QueryResult) error {
+	if len(res.Columns) == 0 {
+		_, err := fmt.Fprintf(w, "%s, %d rows affected\n", res.Status, res.RowsAffected)
+		return err
+	}
+
+	widths := make([]int, len(res.Columns))
+	for i, col := range res.Columns {
+		widths[i] = utf8.RuneCountInString(col.Name)
+		for _, r := range res.Rows {
+			if n := utf8.RuneCountInString(cellEscaper.Replace(r.Fields[col.Name])); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	pad := func(s string, i int, right bool) string {
+		fill := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(s))
+		if right {
+			return fill + s
+		}
+		return s + fill
+	}
+
+	var b strings.Builder
+	cells := make([]string, len(res.Columns))
+	for i, col := range res.Columns {
+		cells[i] = " " + pad(col.Name, i, false) + " "
+	}
+	b.WriteString(strings.TrimRight(strings.Join(cells, "|"), " ") + "\n")
+	for i := range res.Columns {
+		cells[i] = strings.Repeat("-", widths[i]+2)
+	}
+	b.WriteString(strings.Join(cells, "+") + "\n")
+	for _, r := range res.Rows {
+		for i, col := range res.Columns {
+			cells[i] = " " + pad(cellEscaper.Replace(r.Fields[col.Name]), i, col.Type == INT) + " "
+		}
+		b.WriteString(strings.TrimRight(strings.Join(cells, "|"), " ") + "\n")
+	}
+	if len(res.Rows) == 1 {
+		b.WriteString("(1 row)\n")
+	} else {
+		fmt.Fprintf(&b, "(%d rows)\n", len(res.Rows))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateTimeLayout is the canonical textual form of DATETIME cells.
+const DateTimeLayout = "2006-01-02 15:04:05"
+
+var dateTimeLayouts = []string{
+	DateTimeLayout,
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC3339,
+}
+
+func (ft FieldType) String() string {
+	switch ft {
+	case TEXT:
+		return "TEXT"
+	case BOOL:
+		return "BOOL"
+	case INT:
+		return "INT"
+	case DATETIME:
+		return "DATETIME"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Column describes a single column of a query result.
+type Column struct {
+	Name string
+	Type FieldType
+}
+
+func parseDateTime(s string) (time.Time, error) {
+	for _, l := range dateTimeLayouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid DATETIME value '%s'", s)
+}
+
+// compareValues orders two non-NULL cells of a column of type ft, values
+// that don't parse are ordered as text.
+func compareValues(ft FieldType, a, b string) int {
+	switch ft {
+	case INT:
+		x, errX := strconv.Atoi(a)
+		y, errY := strconv.Atoi(b)
+		if errX == nil && errY == nil {
+			return compareInts(x, y)
+		}
+	case BOOL:
+		return compareInts(boolRank(isTrue(a)), boolRank(isTrue(b)))
+	case DATETIME:
+		x, errX := parseDateTime(a)
+		y, errY := parseDateTime(b)
+		if errX == nil && errY == nil {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// isTrue tells whether a BOOL cell or literal is true, in any of the
+// spellings ParseValue accepts.
+func isTrue(s string) bool {
+	b, _ := strconv.ParseBool(s)
+	return b
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ParseFieldType returns the type named s or UNKNOWN_FIELD_TYPE.
+func ParseFieldType(s string) FieldType {
+	return fieldTypeFromString(s)
+}
+
+// ParseValue converts a textual cell into a Go value according to its type:
+// TEXT -> string, INT -> int64, BOOL -> bool, DATETIME -> time.Time.
+// Empty cells of non-TEXT columns are NULLs and yield nil.
+func ParseValue(ft FieldType, s string) (interface{}, error) {
+	if ft == TEXT {
+		return s, nil
+	}
+	if s == "" {
+		return nil, nil
+	}
+
+	switch ft {
+	case INT:
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid INT value '%s'", s)
+		}
+		return v, nil
+	case BOOL:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BOOL value '%s'", s)
+		}
+		return v, nil
+	case DATETIME:
+		return parseDateTime(s)
+	default:
+		return s, nil
+	}
+}
+
+// FormatValue converts a Go value into its textual cell representation.
+func FormatValue(a interface{}) (string, error) {
+	switch v := a.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int8:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int16:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(DateTimeLayout), nil
+	case fmt.Stringer:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", a)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"strings"
 
 	"gopicosql/db/engine"
 
@@ -10,23 +12,83 @@ import (
 )
 
 func printHelp() {
-	fmt.Printf("Usage: %s <CONFIG_FILE>\n", os.Args[0])
+	fmt.Printf("Usage: %s [CONFIG_FILE]\n", os.Args[0])
+	fmt.Printf("       %s [CONFIG_FILE] useradd <NAME> [superuser]   (password read from stdin)\n", os.Args[0])
+	fmt.Printf("       %s [CONFIG_FILE] userdel <NAME>\n", os.Args[0])
+	fmt.Printf("       %s [CONFIG_FILE] apikey <NAME>\n", os.Args[0])
 }
 
-func main() {
-	if len(os.Args) > 2 {
+// isUserCommand tells whether arg names a user management command.
+func isUserCommand(arg string) bool {
+	return arg == "useradd" || arg == "userdel" || arg == "apikey"
+}
+
+// loadConfig reads the configuration file filename, the defaults if
+// filename is empty.
+func loadConfig(filename string) *engine.Cfg {
+	if filename == "" {
+		return engine.NewConfigDefault()
+	}
+	cfg, err := engine.NewConfig(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return cfg
+}
+
+// manageUsers runs one of the user management commands against the
+// database in the DbDir of cfg.
+func manageUsers(cfg *engine.Cfg, args []string) error {
+	db, err := engine.NewDbEngine(cfg)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "useradd" && (len(args) == 2 || len(args) == 3 && args[2] == "superuser"):
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			return err
+		}
+		return db.CreateUser(args[1], strings.TrimRight(password, "\r\n"), len(args) == 3)
+	case args[0] == "userdel" && len(args) == 2:
+		return db.DropUser(args[1])
+	case args[0] == "apikey" && len(args) == 2:
+		key, err := db.CreateApiKey(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	default:
 		printHelp()
 		os.Exit(1)
 	}
+	return nil
+}
 
-	var cfg *engine.Cfg
+func main() {
+	args := os.Args[1:]
+	cfgFile := ""
+	if len(args) > 0 && !isUserCommand(args[0]) {
+		cfgFile, args = args[0], args[1:]
+	}
+	if len(args) > 0 && isUserCommand(args[0]) {
+		if err := manageUsers(loadConfig(cfgFile), args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	if len(os.Args) == 1 {
-		cfg = engine.NewConfigDefault()
-	} else {
-		cfg = engine.NewConfig(os.Args[1])
+	if len(args) > 0 {
+		printHelp()
+		os.Exit(1)
 	}
 
+	cfg := loadConfig(cfgFile)
 	s, err := rest.NewServer(cfg)
 
 	if err != nil {
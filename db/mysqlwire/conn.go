@@ -0,0 +1,313 @@
+package mysqlwire
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopicosql/db/engine"
+)
+
+// codeProtocolViolation is reported for packets the server can't make
+// sense of.
+const codeProtocolViolation engine.ErrorCode = "08S01"
+
+// Commands.
+const (
+	comQuit            = 0x01
+	comInitDB          = 0x02
+	comQuery           = 0x03
+	comPing            = 0x0e
+	comStmtPrepare     = 0x16
+	comStmtExecute     = 0x17
+	comStmtSendLong    = 0x18
+	comStmtClose       = 0x19
+	comStmtReset       = 0x1a
+	comSetOption       = 0x1b
+	comResetConnection = 0x1f
+)
+
+// statement is a statement created by COM_STMT_PREPARE. Statements the
+// engine can't prepare, like SET or GRANT, are run from sql on every
+// execution and take no parameters.
+type statement struct {
+	sql        string
+	stmt       *engine.Stmt
+	paramTypes []engine.FieldType
+	cols       []engine.Column
+	// boundTypes are the parameter types sent with the last execution,
+	// clients send them only when they change
+	boundTypes []byte
+}
+
+type conn struct {
+	srv *Server
+	nc  net.Conn
+	r   *bufio.Reader
+	w   *bufio.Writer
+	tls bool
+	id  uint32
+	seq byte
+	// user is the authenticated user, empty while the engine has no users
+	user     string
+	stmts    map[uint32]*statement
+	lastStmt uint32
+
+	lock *sync.Mutex
+	// idle is set while waiting for a command
+	idle bool
+}
+
+func (c *conn) serve() {
+	defer c.srv.removeConn(c)
+	defer c.close()
+
+	c.seq = 0xff
+	if err := c.handshake(); err != nil {
+		if err != io.EOF && !c.srv.isClosing() {
+			c.srv.logf("MySQL connection from %s failed: %s", c.nc.RemoteAddr(), err)
+		}
+		return
+	}
+
+	for {
+		if err := c.w.Flush(); err != nil {
+			return
+		}
+		if !c.setIdle(true) {
+			c.closeIfIdle()
+			return
+		}
+		payload, err := c.readPacket()
+		if err != nil {
+			if err != io.EOF && !c.srv.isClosing() {
+				c.srv.logf("MySQL connection from %s: %s", c.nc.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(payload) == 0 || payload[0] == comQuit || !c.setIdle(false) {
+			return
+		}
+		if err := c.dispatch(payload[0], &reader{b: payload[1:]}); err != nil {
+			if err != io.EOF {
+				c.srv.logf("MySQL connection from %s: %s", c.nc.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// close deallocates the prepared statements of the connection and closes it.
+func (c *conn) close() {
+	for _, st := range c.stmts {
+		if st.stmt != nil {
+			st.stmt.Close()
+		}
+	}
+	c.lock.Lock()
+	c.nc.Close()
+	c.lock.Unlock()
+}
+
+// setIdle records whether the connection waits for a command, it returns
+// false if the connection should go away because the server shuts down.
+func (c *conn) setIdle(idle bool) bool {
+	c.lock.Lock()
+	c.idle = idle
+	c.lock.Unlock()
+	return !c.srv.isClosing()
+}
+
+// closeIfIdle is called by Shutdown. The protocol has no way to tell an
+// idle client why, it finds out on its next command.
+func (c *conn) closeIfIdle() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.idle {
+		c.nc.Close()
+	}
+}
+
+// readPacket reads a packet, a new command starts a new sequence.
+func (c *conn) readPacket() ([]byte, error) {
+	return readPacket(c.r, &c.seq)
+}
+
+func (c *conn) writePacket(payload []byte) error {
+	return writePacket(c.w, &c.seq, payload)
+}
+
+func (c *conn) writeOk(affected int) error {
+	p := &packet{}
+	p.int1(0x00).lenenc(uint64(affected)).lenenc(0).int2(statusAutocommit).int2(0)
+	return c.writePacket(p.b)
+}
+
+func (c *conn) writeEOF() error {
+	p := &packet{}
+	p.int1(0xfe).int2(0).int2(statusAutocommit)
+	return c.writePacket(p.b)
+}
+
+func (c *conn) writeErrorCode(number int, code engine.ErrorCode, msg string) error {
+	state := string(code)
+	if len(state) != 5 {
+		state = "HY000"
+	}
+	p := &packet{}
+	p.int1(0xff).int2(number).int1('#').bytes([]byte(state)).bytes([]byte(msg))
+	return c.writePacket(p.b)
+}
+
+func (c *conn) writeError(err error) error {
+	code, msg := engine.ErrorCodeOf(err), err.Error()
+	if e, ok := err.(*engine.Error); ok {
+		msg = e.Msg
+	}
+	return c.writeErrorCode(errorNumberOf(code), code, msg)
+}
+
+// fatal reports an error that ends the connection.
+func (c *conn) fatal(number int, code engine.ErrorCode, msg string) error {
+	c.writeErrorCode(number, code, msg)
+	c.w.Flush()
+	return io.EOF
+}
+
+func (c *conn) dispatch(cmd byte, r *reader) error {
+	switch cmd {
+	case comQuery:
+		return c.query(string(r.rest()))
+	case comInitDB, comPing, comStmtReset, comSetOption:
+		return c.writeOk(0)
+	case comResetConnection:
+		for id := range c.stmts {
+			c.dropStatement(id)
+		}
+		return c.writeOk(0)
+	case comStmtPrepare:
+		if err := c.prepare(string(r.rest())); err != nil {
+			return c.writeError(err)
+		}
+		return nil
+	case comStmtExecute:
+		if err := c.execute(r); err != nil {
+			return c.writeError(err)
+		}
+		return nil
+	case comStmtClose:
+		c.dropStatement(r.int4())
+		return nil
+	case comStmtSendLong:
+		// long parameters are not supported, the execution fails on
+		// the missing value instead
+		return nil
+	default:
+		return c.writeErrorCode(1047, codeProtocolViolation, fmt.Sprintf("unknown command %d", cmd)) // ER_UNKNOWN_COM_ERROR
+	}
+}
+
+// commandOf returns the first word of a statement in upper case.
+func commandOf(sql string) string {
+	words := strings.Fields(strings.ToUpper(sql))
+	if len(words) > 0 {
+		return words[0]
+	}
+	return ""
+}
+
+// isUtility reports whether a statement is run without preparing it.
+func isUtility(sql string) bool {
+	switch commandOf(sql) {
+	case "", "SET", "USE", "GRANT", "REVOKE", "BEGIN", "START", "COMMIT", "ROLLBACK":
+		return true
+	}
+	return false
+}
+
+// run executes a statement, either from sql or prepared under handle.
+// Statements only changing session settings succeed without effect.
+func (c *conn) run(sql, handle string, args []interface{}) (engine.QueryResult, error) {
+	switch commandOf(sql) {
+	case "SET", "USE":
+		return engine.QueryResult{}, nil
+	case "BEGIN", "START", "COMMIT", "ROLLBACK":
+		return engine.QueryResult{}, &engine.Error{Code: engine.ErrFeatureNotSupported, Msg: "transactions are not supported"}
+	case "":
+		return engine.QueryResult{}, &engine.Error{Code: engine.ErrSyntax, Msg: "query was empty"}
+	}
+
+	ctx, cancel := context.WithCancel(engine.WithUser(context.Background(), c.user))
+	if secs := c.srv.cfg.QueryTimeoutSecs; secs > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(secs)*time.Second)
+	}
+	defer cancel()
+	return c.srv.db.ExecRequest(ctx, engine.QueryRequest{Sql: sql, Handle: handle, Args: args})
+}
+
+// query runs COM_QUERY and sends the result with the text protocol.
+func (c *conn) query(sql string) error {
+	res, err := c.run(sql, "", nil)
+	if err != nil {
+		return c.writeError(err)
+	}
+	if res.Columns == nil {
+		return c.writeOk(res.RowsAffected)
+	}
+
+	var rows [][]byte
+	for _, row := range res.Rows {
+		p := &packet{}
+		for _, col := range res.Columns {
+			v, err := textValue(col, row.Fields[col.Name])
+			if err != nil {
+				return c.writeError(&engine.Error{Code: engine.ErrInvalidValue, Msg: fmt.Sprintf("column %s: %s", col.Name, err)})
+			}
+			if v == nil {
+				p.int1(0xfb)
+			} else {
+				p.lenencString(v)
+			}
+		}
+		rows = append(rows, p.b)
+	}
+	return c.writeResultSet(commandTable(sql), res.Columns, rows)
+}
+
+// commandTable returns the table a SELECT reads, it's reported in the
+// column definitions.
+func commandTable(sql string) string {
+	words := strings.Fields(sql)
+	for i, w := range words {
+		if strings.EqualFold(w, "FROM") && i+1 < len(words) {
+			return strings.TrimRight(words[i+1], ";")
+		}
+	}
+	return ""
+}
+
+func (c *conn) writeResultSet(table string, cols []engine.Column, rows [][]byte) error {
+	p := &packet{}
+	if err := c.writePacket(p.lenenc(uint64(len(cols))).b); err != nil {
+		return err
+	}
+	for _, col := range cols {
+		if err := c.writePacket(columnDefinition(table, col)); err != nil {
+			return err
+		}
+	}
+	if err := c.writeEOF(); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := c.writePacket(row); err != nil {
+			return err
+		}
+	}
+	return c.writeEOF()
+}
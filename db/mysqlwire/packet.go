@@ -0,0 +1,214 @@
+package mysqlwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// maxPacketSize is the largest payload of a single packet, longer payloads
+// are split.
+const maxPacketSize = 1<<24 - 1
+
+// maxMessageSize bounds the commands accepted from clients.
+const maxMessageSize = 1 << 26
+
+// readPacket reads a payload, joining packets split for being too long.
+// seq is set to the sequence id of the last packet.
+func readPacket(r io.Reader, seq *byte) ([]byte, error) {
+	var payload []byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		n := int(uint32(hdr[0]) | uint32(hdr[1])<<8 | uint32(hdr[2])<<16)
+		if len(payload)+n > maxMessageSize {
+			return nil, fmt.Errorf("packet too large")
+		}
+		*seq = hdr[3]
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		payload = append(payload, buf...)
+		if n < maxPacketSize {
+			return payload, nil
+		}
+	}
+}
+
+// writePacket writes a payload as one or more packets, seq is incremented
+// for every packet written.
+func writePacket(w io.Writer, seq *byte, payload []byte) error {
+	for {
+		n := len(payload)
+		if n > maxPacketSize {
+			n = maxPacketSize
+		}
+		*seq++
+		hdr := []byte{byte(n), byte(n >> 8), byte(n >> 16), *seq}
+		if _, err := w.Write(append(hdr, payload[:n]...)); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if n < maxPacketSize {
+			return nil
+		}
+	}
+}
+
+// reader decodes the fields of a packet. The first decoding error is kept
+// and reported by err, later reads return zero values.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("malformed packet")
+	}
+	r.b = nil
+}
+
+func (r *reader) next(n int) []byte {
+	if n < 0 || len(r.b) < n {
+		r.fail()
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) int1() int {
+	if b := r.next(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *reader) int2() int {
+	if b := r.next(2); b != nil {
+		return int(binary.LittleEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *reader) int4() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) int8() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// lenenc reads a length-encoded integer.
+func (r *reader) lenenc() uint64 {
+	switch v := r.int1(); v {
+	case 0xfc:
+		return uint64(r.int2())
+	case 0xfd:
+		if b := r.next(3); b != nil {
+			return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16
+		}
+		return 0
+	case 0xfe:
+		return r.int8()
+	default:
+		return uint64(v)
+	}
+}
+
+func (r *reader) lenencString() []byte {
+	n := r.lenenc()
+	if n > uint64(len(r.b)) {
+		r.fail()
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *reader) string() string {
+	i := bytes.IndexByte(r.b, 0)
+	if i < 0 {
+		r.fail()
+		return ""
+	}
+	s := string(r.b[:i])
+	r.b = r.b[i+1:]
+	return s
+}
+
+func (r *reader) rest() []byte {
+	v := r.b
+	r.b = nil
+	return v
+}
+
+// packet builds the payload of a single packet.
+type packet struct {
+	b []byte
+}
+
+func (p *packet) int1(v int) *packet {
+	p.b = append(p.b, byte(v))
+	return p
+}
+
+func (p *packet) int2(v int) *packet {
+	p.b = append(p.b, byte(v), byte(v>>8))
+	return p
+}
+
+func (p *packet) int4(v uint32) *packet {
+	p.b = append(p.b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	return p
+}
+
+func (p *packet) int8(v uint64) *packet {
+	for i := 0; i < 8; i++ {
+		p.b = append(p.b, byte(v>>(8*i)))
+	}
+	return p
+}
+
+func (p *packet) lenenc(v uint64) *packet {
+	switch {
+	case v < 0xfb:
+		return p.int1(int(v))
+	case v < 1<<16:
+		return p.int1(0xfc).int2(int(v))
+	case v < 1<<24:
+		p.int1(0xfd)
+		p.b = append(p.b, byte(v), byte(v>>8), byte(v>>16))
+		return p
+	default:
+		return p.int1(0xfe).int8(v)
+	}
+}
+
+func (p *packet) lenencString(s []byte) *packet {
+	p.lenenc(uint64(len(s)))
+	p.b = append(p.b, s...)
+	return p
+}
+
+func (p *packet) string(s string) *packet {
+	p.b = append(p.b, s...)
+	p.b = append(p.b, 0)
+	return p
+}
+
+func (p *packet) bytes(b []byte) *packet {
+	p.b = append(p.b, b...)
+	return p
+}
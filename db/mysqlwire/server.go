@@ -0,0 +1,321 @@
+// Package mysqlwire serves the database over the MySQL client/server
+// protocol, so MySQL clients and drivers can be used to run statements.
+//
+// COM_QUERY runs statements with the text protocol, COM_STMT_PREPARE and
+// COM_STMT_EXECUTE run '?' parameterized statements with the binary
+// protocol. Columns are reported as VAR_STRING (TEXT), LONGLONG (INT),
+// TINY (BOOL) and DATETIME (DATETIME).
+package mysqlwire
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"gopicosql/db/engine"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown.
+var ErrServerClosed = errors.New("mysqlwire: server closed")
+
+// serverVersion is reported in the handshake, clients check it to decide
+// which features they may use.
+const serverVersion = "8.0.0-gopicosql"
+
+// Capability flags.
+const (
+	clientLongPassword               = 0x00000001
+	clientFoundRows                  = 0x00000002
+	clientLongFlag                   = 0x00000004
+	clientConnectWithDB              = 0x00000008
+	clientProtocol41                 = 0x00000200
+	clientSSL                        = 0x00000800
+	clientTransactions               = 0x00002000
+	clientSecureConnection           = 0x00008000
+	clientMultiResults               = 0x00020000
+	clientPluginAuth                 = 0x00080000
+	clientPluginAuthLenencClientData = 0x00200000
+)
+
+const serverCapabilities = clientLongPassword | clientFoundRows | clientLongFlag | clientConnectWithDB |
+	clientProtocol41 | clientTransactions | clientSecureConnection | clientMultiResults |
+	clientPluginAuth | clientPluginAuthLenencClientData
+
+const statusAutocommit = 0x0002
+
+const (
+	authNativePassword = "mysql_native_password"
+	// authClearPassword is switched to once the engine has users, the
+	// passwords are stored as bcrypt hashes so the scrambled ones can't
+	// be checked.
+	authClearPassword = "mysql_clear_password"
+)
+
+// Server accepts MySQL protocol connections and runs their statements on
+// the engine.
+type Server struct {
+	db  *engine.DbEngine
+	cfg *engine.Cfg
+	// tlsConfig is offered to clients in the handshake. When set,
+	// unencrypted connections are refused.
+	tlsConfig *tls.Config
+	// ErrorLog receives connection errors, they are dropped if nil.
+	ErrorLog *log.Logger
+
+	lock    *sync.Mutex
+	ln      net.Listener
+	conns   map[uint32]*conn
+	lastID  uint32
+	closing bool
+	wg      sync.WaitGroup
+}
+
+func NewServer(db *engine.DbEngine, cfg *engine.Cfg, tlsConfig *tls.Config) *Server {
+	return &Server{
+		db:        db,
+		cfg:       cfg,
+		tlsConfig: tlsConfig,
+		lock:      &sync.Mutex{},
+		conns:     make(map[uint32]*conn),
+	}
+}
+
+func (s *Server) logf(format string, a ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, a...)
+	}
+}
+
+// Serve accepts connections on ln until Shutdown is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.ln = ln
+	s.lock.Unlock()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		c, ok := s.newConn(nc)
+		if !ok {
+			nc.Close()
+			return ErrServerClosed
+		}
+		go c.serve()
+	}
+}
+
+func (s *Server) newConn(nc net.Conn) (*conn, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		return nil, false
+	}
+	s.lastID++
+	c := &conn{
+		srv:   s,
+		nc:    nc,
+		r:     bufio.NewReader(nc),
+		w:     bufio.NewWriter(nc),
+		id:    s.lastID,
+		stmts: make(map[uint32]*statement),
+		lock:  &sync.Mutex{},
+		idle:  true,
+	}
+	s.conns[c.id] = c
+	s.wg.Add(1)
+	return c, true
+}
+
+func (s *Server) removeConn(c *conn) {
+	s.lock.Lock()
+	delete(s.conns, c.id)
+	s.lock.Unlock()
+	s.wg.Done()
+}
+
+func (s *Server) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closing
+}
+
+// Shutdown stops accepting connections and closes idle ones, busy
+// connections are closed once their statements complete. If ctx is done
+// first, the remaining connections are closed right away.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.closing = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for _, c := range s.conns {
+		c.closeIfIdle()
+	}
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		for _, c := range s.conns {
+			c.lock.Lock()
+			c.nc.Close()
+			c.lock.Unlock()
+		}
+		s.lock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// newSalt returns the auth plugin data sent in the handshake, clients
+// expect printable bytes.
+func newSalt() []byte {
+	salt := make([]byte, 20)
+	rand.Read(salt)
+	for i := range salt {
+		salt[i] = '!' + salt[i]%94
+	}
+	return salt
+}
+
+// handshake greets the client, switches to TLS if asked to and checks the
+// credentials.
+func (c *conn) handshake() error {
+	caps := uint32(serverCapabilities)
+	if c.srv.tlsConfig != nil {
+		caps |= clientSSL
+	}
+	salt := newSalt()
+	p := &packet{}
+	p.int1(10).string(serverVersion).int4(c.id).bytes(salt[:8]).int1(0).
+		int2(int(caps & 0xffff)).int1(charsetUtf8mb4).int2(statusAutocommit).int2(int(caps >> 16)).
+		int1(len(salt) + 1).bytes(make([]byte, 10)).bytes(salt[8:]).int1(0).string(authNativePassword)
+	if err := c.writePacket(p.b); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	payload, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	r := &reader{b: payload}
+	clientCaps := r.int4()
+	r.next(4 + 1 + 23)
+	if r.err != nil {
+		return c.fatal(errUnknown, codeProtocolViolation, "malformed handshake response")
+	}
+	if clientCaps&clientProtocol41 == 0 {
+		return c.fatal(errUnknown, engine.ErrFeatureNotSupported, "client protocol 4.1 is required")
+	}
+
+	if len(r.b) == 0 && clientCaps&clientSSL != 0 && c.srv.tlsConfig != nil {
+		tc := tls.Server(c.nc, c.srv.tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			return err
+		}
+		c.lock.Lock()
+		c.nc, c.tls = tc, true
+		c.lock.Unlock()
+		c.r, c.w = bufio.NewReader(tc), bufio.NewWriter(tc)
+		if payload, err = c.readPacket(); err != nil {
+			return err
+		}
+		r = &reader{b: payload}
+		r.next(4 + 4 + 1 + 23)
+	}
+	if c.srv.tlsConfig != nil && !c.tls {
+		// ER_SECURE_TRANSPORT_REQUIRED
+		return c.fatal(3159, engine.ErrInvalidAuthorization, "connections using insecure transport are prohibited")
+	}
+
+	user := r.string()
+	var auth []byte
+	switch {
+	case clientCaps&clientPluginAuthLenencClientData != 0:
+		auth = r.lenencString()
+	case clientCaps&clientSecureConnection != 0:
+		auth = r.next(r.int1())
+	default:
+		auth = []byte(r.string())
+	}
+	if clientCaps&clientConnectWithDB != 0 && len(r.b) > 0 {
+		r.string()
+	}
+	plugin := authNativePassword
+	if clientCaps&clientPluginAuth != 0 && len(r.b) > 0 {
+		plugin = r.string()
+	}
+	if r.err != nil {
+		return c.fatal(errUnknown, codeProtocolViolation, "malformed handshake response")
+	}
+
+	if err := c.authenticate(user, plugin, auth); err != nil {
+		return err
+	}
+	return c.writeOk(0)
+}
+
+// authenticate checks the password once the engine has users, an API key
+// is accepted as the password too.
+func (c *conn) authenticate(user, plugin string, auth []byte) error {
+	if !c.srv.db.AuthEnabled() {
+		return nil
+	}
+
+	if plugin != authClearPassword {
+		p := &packet{}
+		p.int1(0xfe).string(authClearPassword).int1(0)
+		if err := c.writePacket(p.b); err != nil {
+			return err
+		}
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		var err error
+		if auth, err = c.readPacket(); err != nil {
+			return err
+		}
+	}
+	password := string(auth)
+	if n := len(password); n > 0 && password[n-1] == 0 {
+		password = password[:n-1]
+	}
+
+	err := c.srv.db.Authenticate(user, password)
+	if err != nil {
+		if keyUser, keyErr := c.srv.db.AuthenticateKey(password); keyErr == nil && keyUser == user {
+			err = nil
+		}
+	}
+	if err != nil {
+		return c.fatal(errorNumberOf(engine.ErrInvalidAuthorization), engine.ErrInvalidAuthorization,
+			"access denied for user "+user)
+	}
+	c.user = user
+	return nil
+}
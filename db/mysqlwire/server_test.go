@@ -0,0 +1,276 @@
+package mysqlwire
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"gopicosql/db/engine"
+)
+
+type testClient struct {
+	t   *testing.T
+	nc  net.Conn
+	r   *bufio.Reader
+	seq byte
+}
+
+func startTestServer(t *testing.T, db *engine.DbEngine, cfg *engine.Cfg) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	s := NewServer(db, cfg, nil)
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return ln.Addr().String()
+}
+
+func openTestDb(t *testing.T, cfg *engine.Cfg) *engine.DbEngine {
+	db, err := engine.Open(cfg)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	t.Cleanup(db.Stop)
+	ctx := context.Background()
+	db.Exec(ctx, "CREATE TABLE t (id INT, name TEXT, ok BOOL, at DATETIME)")
+	db.Exec(ctx, "INSERT INTO t (id, name, ok, at) VALUES ('1', 'a', 'true', '2022-01-06 12:30:00')")
+	db.Exec(ctx, "INSERT INTO t (id, name) VALUES ('2', 'b')")
+	return db
+}
+
+// dial connects and sends the handshake response, the reply is left to
+// the caller.
+func dial(t *testing.T, addr, user string) *testClient {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Cannot connect: %s", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	c := &testClient{t: t, nc: nc, r: bufio.NewReader(nc)}
+
+	greeting := c.read()
+	if greeting[0] != 10 {
+		t.Fatalf("Expected protocol 10, got %d", greeting[0])
+	}
+	caps := clientProtocol41 | clientSecureConnection | clientPluginAuth | clientPluginAuthLenencClientData
+	p := &packet{}
+	p.int4(uint32(caps)).int4(1 << 24).int1(charsetUtf8mb4).bytes(make([]byte, 23)).
+		string(user).lenencString(nil).string(authNativePassword)
+	c.write(p.b)
+	return c
+}
+
+func (c *testClient) read() []byte {
+	b, err := readPacket(c.r, &c.seq)
+	if err != nil {
+		c.t.Fatalf("Cannot read: %s", err)
+	}
+	return b
+}
+
+func (c *testClient) write(payload []byte) {
+	if err := writePacket(c.nc, &c.seq, payload); err != nil {
+		c.t.Fatalf("Cannot write: %s", err)
+	}
+}
+
+func (c *testClient) command(cmd byte, payload []byte) []byte {
+	c.seq = 0xff
+	c.write(append([]byte{cmd}, payload...))
+	return c.read()
+}
+
+func (c *testClient) expectOk(b []byte) int {
+	if b[0] != 0x00 {
+		c.t.Fatalf("Expected OK, got %v", b)
+	}
+	r := &reader{b: b[1:]}
+	return int(r.lenenc())
+}
+
+func (c *testClient) expectError(b []byte, number int, state engine.ErrorCode) {
+	if b[0] != 0xff {
+		c.t.Fatalf("Expected ERR, got %v", b)
+	}
+	r := &reader{b: b[1:]}
+	if n := r.int2(); n != number {
+		c.t.Errorf("Expected error %d, got %d", number, n)
+	}
+	r.int1()
+	if s := string(r.next(5)); s != string(state) {
+		c.t.Errorf("Expected SQLSTATE %s, got %s", state, s)
+	}
+}
+
+func (c *testClient) expectEOF() {
+	if b := c.read(); b[0] != 0xfe || len(b) != 5 {
+		c.t.Fatalf("Expected EOF, got %v", b)
+	}
+}
+
+// columns reads n column definitions and the EOF after them and returns
+// their names and types.
+func (c *testClient) columns(n int) ([]string, []byte) {
+	var names []string
+	var types []byte
+	for i := 0; i < n; i++ {
+		r := &reader{b: c.read()}
+		for j := 0; j < 4; j++ {
+			r.lenencString()
+		}
+		names = append(names, string(r.lenencString()))
+		r.lenencString()
+		r.lenenc()
+		r.int2()
+		r.int4()
+		types = append(types, byte(r.int1()))
+	}
+	c.expectEOF()
+	return names, types
+}
+
+func TestTextQuery(t *testing.T) {
+	addr := startTestServer(t, openTestDb(t, nil), engine.NewConfigDefault())
+	c := dial(t, addr, "alice")
+	c.expectOk(c.read())
+
+	if n := c.expectOk(c.command(comQuery, []byte("UPDATE t SET name = 'c' WHERE id >= '1'"))); n != 2 {
+		t.Errorf("Expected 2 affected rows, got %d", n)
+	}
+
+	b := c.command(comQuery, []byte("SELECT * FROM t"))
+	if n := (&reader{b: b}).lenenc(); n != 4 {
+		t.Fatalf("Expected 4 columns, got %d", n)
+	}
+	names, types := c.columns(4)
+	wantTypes := []byte{typeLongLong, typeVarString, typeTiny, typeDateTime}
+	for i, name := range []string{"id", "name", "ok", "at"} {
+		if names[i] != name || types[i] != wantTypes[i] {
+			t.Errorf("Expected column %s of type %d, got %s of type %d", name, wantTypes[i], names[i], types[i])
+		}
+	}
+
+	want := [][]string{{"1", "c", "1", "2022-01-06 12:30:00"}, {"2", "c", "NULL", "NULL"}}
+	for _, w := range want {
+		r := &reader{b: c.read()}
+		for i, v := range w {
+			got := "NULL"
+			if len(r.b) > 0 && r.b[0] == 0xfb {
+				r.int1()
+			} else {
+				got = string(r.lenencString())
+			}
+			if got != v {
+				t.Errorf("Expected %s in column %d, got %s", v, i, got)
+			}
+		}
+	}
+	c.expectEOF()
+
+	c.expectError(c.command(comQuery, []byte("SELECT * FROM nope")), 1146, engine.ErrUndefinedTable)
+	c.expectError(c.command(comQuery, []byte("BEGIN")), 1235, engine.ErrFeatureNotSupported)
+	c.expectOk(c.command(comQuery, []byte("SET NAMES utf8mb4")))
+	c.expectOk(c.command(comPing, nil))
+}
+
+func TestPreparedStatements(t *testing.T) {
+	addr := startTestServer(t, openTestDb(t, nil), engine.NewConfigDefault())
+	c := dial(t, addr, "alice")
+	c.expectOk(c.read())
+
+	b := c.command(comStmtPrepare, []byte("SELECT id, name FROM t WHERE id >= ?"))
+	r := &reader{b: b}
+	if r.int1() != 0x00 {
+		t.Fatalf("Expected OK, got %v", b)
+	}
+	id, ncols, nparams := r.int4(), r.int2(), r.int2()
+	if ncols != 2 || nparams != 1 {
+		t.Fatalf("Expected 2 columns and 1 parameter, got %d and %d", ncols, nparams)
+	}
+	if _, types := c.columns(1); types[0] != typeLongLong {
+		t.Errorf("Expected a LONGLONG parameter, got type %d", types[0])
+	}
+	c.columns(2)
+
+	execute := func(bind bool, v int64) *packet {
+		p := &packet{}
+		p.int4(id).int1(0).int4(1).int1(0)
+		if bind {
+			p.int1(1).int1(typeLongLong).int1(0)
+		} else {
+			p.int1(0)
+		}
+		return p.int8(uint64(v))
+	}
+	rows := func(b []byte) []int64 {
+		if n := (&reader{b: b}).lenenc(); n != 2 {
+			t.Fatalf("Expected 2 columns, got %d", n)
+		}
+		c.columns(2)
+		var ids []int64
+		for {
+			b := c.read()
+			if b[0] == 0xfe {
+				return ids
+			}
+			r := &reader{b: b[2:]}
+			ids = append(ids, int64(r.int8()))
+			if name := string(r.lenencString()); name == "" {
+				t.Errorf("Expected a name")
+			}
+		}
+	}
+
+	if ids := rows(c.command(comStmtExecute, execute(true, 2).b)); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("Expected id 2, got %v", ids)
+	}
+	// parameter types are kept from the previous execution
+	if ids := rows(c.command(comStmtExecute, execute(false, 1).b)); len(ids) != 2 {
+		t.Errorf("Expected 2 rows, got %v", ids)
+	}
+
+	b = c.command(comStmtPrepare, []byte("INSERT INTO t (id, name) VALUES (?, ?)"))
+	insID := binary.LittleEndian.Uint32(b[1:])
+	c.columns(2)
+	p := &packet{}
+	p.int4(insID).int1(0).int4(1).int1(0).int1(1).int1(typeLongLong).int1(0).int1(typeString).int1(0).
+		int8(3).lenencString([]byte("x"))
+	if n := c.expectOk(c.command(comStmtExecute, p.b)); n != 1 {
+		t.Errorf("Expected 1 affected row, got %d", n)
+	}
+
+	c.seq = 0xff
+	c.write((&packet{}).int1(comStmtClose).int4(id).b)
+	c.expectError(c.command(comStmtExecute, execute(true, 1).b), 1243, engine.ErrInvalidStatement)
+}
+
+func TestAuthentication(t *testing.T) {
+	cfg := engine.NewConfigDefault()
+	cfg.DbDir = t.TempDir()
+	db := openTestDb(t, cfg)
+	if err := db.CreateUser("bob", "s3cret", false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	addr := startTestServer(t, db, cfg)
+
+	login := func(password string) *testClient {
+		c := dial(t, addr, "bob")
+		b := c.read()
+		r := &reader{b: b}
+		if r.int1() != 0xfe || r.string() != authClearPassword {
+			t.Fatalf("Expected a switch to %s, got %v", authClearPassword, b)
+		}
+		c.write((&packet{}).string(password).b)
+		return c
+	}
+
+	c := login("wrong")
+	c.expectError(c.read(), 1045, engine.ErrInvalidAuthorization)
+
+	c = login("s3cret")
+	c.expectOk(c.read())
+	c.expectError(c.command(comQuery, []byte("SELECT * FROM t")), 1142, engine.ErrInsufficientPrivilege)
+}
@@ -0,0 +1,151 @@
+package mysqlwire
+
+import (
+	"context"
+	"fmt"
+
+	"gopicosql/db/engine"
+)
+
+func (c *conn) dropStatement(id uint32) {
+	if st, ok := c.stmts[id]; ok && st.stmt != nil {
+		st.stmt.Close()
+	}
+	delete(c.stmts, id)
+}
+
+// prepare handles COM_STMT_PREPARE, parameters and columns are described
+// with the types of the columns they refer to.
+func (c *conn) prepare(sql string) error {
+	st := &statement{sql: sql}
+	if !isUtility(sql) {
+		stmt, err := c.srv.db.PrepareContext(engine.WithUser(context.Background(), c.user), sql)
+		if err != nil {
+			return err
+		}
+		st.stmt = stmt
+		if err := c.describe(st); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	c.lastStmt++
+	id := c.lastStmt
+	c.stmts[id] = st
+
+	p := &packet{}
+	p.int1(0x00).int4(id).int2(len(st.cols)).int2(len(st.paramTypes)).int1(0).int2(0)
+	if err := c.writePacket(p.b); err != nil {
+		return err
+	}
+	if len(st.paramTypes) > 0 {
+		for _, ft := range st.paramTypes {
+			if err := c.writePacket(columnDefinition("", engine.Column{Name: "?", Type: ft})); err != nil {
+				return err
+			}
+		}
+		if err := c.writeEOF(); err != nil {
+			return err
+		}
+	}
+	if len(st.cols) > 0 {
+		table := st.stmt.Table()
+		for _, col := range st.cols {
+			if err := c.writePacket(columnDefinition(table, col)); err != nil {
+				return err
+			}
+		}
+		if err := c.writeEOF(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) describe(st *statement) error {
+	var err error
+	if st.paramTypes, err = st.stmt.ParamTypes(); err != nil {
+		return err
+	}
+	if st.cols, err = st.stmt.Columns(); err != nil {
+		return err
+	}
+	if st.cols != nil {
+		return c.srv.db.CheckPrivilege(c.user, st.stmt.Table(), engine.PrivSelect)
+	}
+	return nil
+}
+
+// execute handles COM_STMT_EXECUTE and sends the result with the binary
+// protocol.
+func (c *conn) execute(r *reader) error {
+	id := r.int4()
+	r.int1() // cursor flags, results are always sent in full
+	r.int4() // iteration count, always 1
+	if r.err != nil {
+		return &engine.Error{Code: codeProtocolViolation, Msg: "malformed COM_STMT_EXECUTE packet"}
+	}
+	st, ok := c.stmts[id]
+	if !ok {
+		return &engine.Error{Code: engine.ErrInvalidStatement, Msg: fmt.Sprintf("unknown prepared statement handler %d", id)}
+	}
+
+	n := len(st.paramTypes)
+	args := make([]interface{}, n)
+	if n > 0 {
+		nulls := r.next((n + 7) / 8)
+		if r.int1() == 1 {
+			st.boundTypes = r.next(2 * n)
+		}
+		if r.err == nil && st.boundTypes == nil {
+			return &engine.Error{Code: engine.ErrWrongParamCount, Msg: "parameters were not bound"}
+		}
+		for i := range args {
+			if r.err != nil {
+				break
+			}
+			if nulls[i/8]&(1<<(i%8)) != 0 {
+				continue
+			}
+			v, err := readBinaryParam(r, st.boundTypes[2*i], st.boundTypes[2*i+1]&flagUnsigned != 0)
+			if err != nil {
+				return &engine.Error{Code: engine.ErrInvalidParameter, Msg: fmt.Sprintf("parameter %d: %s", i+1, err)}
+			}
+			args[i] = paramValue(st.paramTypes[i], v)
+		}
+	}
+	if r.err != nil {
+		return &engine.Error{Code: codeProtocolViolation, Msg: "malformed COM_STMT_EXECUTE packet"}
+	}
+
+	handle := ""
+	if st.stmt != nil {
+		handle = st.stmt.Handle()
+	}
+	res, err := c.run(st.sql, handle, args)
+	if err != nil {
+		return err
+	}
+	if res.Columns == nil {
+		return c.writeOk(res.RowsAffected)
+	}
+
+	var rows [][]byte
+	for _, row := range res.Rows {
+		// the NULL bitmap of binary rows starts at bit 2
+		nulls := make([]byte, (len(res.Columns)+7+2)/8)
+		values := &packet{}
+		for i, col := range res.Columns {
+			ok, err := appendBinaryValue(values, col, row.Fields[col.Name])
+			if err != nil {
+				return &engine.Error{Code: engine.ErrInvalidValue, Msg: fmt.Sprintf("column %s: %s", col.Name, err)}
+			}
+			if !ok {
+				nulls[(i+2)/8] |= 1 << ((i + 2) % 8)
+			}
+		}
+		p := &packet{}
+		rows = append(rows, p.int1(0x00).bytes(nulls).bytes(values.b).b)
+	}
+	return c.writeResultSet(st.stmt.Table(), res.Columns, rows)
+}
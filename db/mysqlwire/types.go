@@ -0,0 +1,243 @@
+package mysqlwire
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"gopicosql/db/engine"
+)
+
+// Column types of the client/server protocol.
+const (
+	typeTiny       = 0x01
+	typeShort      = 0x02
+	typeLong       = 0x03
+	typeFloat      = 0x04
+	typeDouble     = 0x05
+	typeNull       = 0x06
+	typeTimestamp  = 0x07
+	typeLongLong   = 0x08
+	typeInt24      = 0x09
+	typeDate       = 0x0a
+	typeDateTime   = 0x0c
+	typeYear       = 0x0d
+	typeVarchar    = 0x0f
+	typeBit        = 0x10
+	typeJSON       = 0xf5
+	typeNewDecimal = 0xf6
+	typeEnum       = 0xf7
+	typeSet        = 0xf8
+	typeTinyBlob   = 0xf9
+	typeMediumBlob = 0xfa
+	typeLongBlob   = 0xfb
+	typeBlob       = 0xfc
+	typeVarString  = 0xfd
+	typeString     = 0xfe
+)
+
+const (
+	charsetUtf8mb4 = 45
+	charsetBinary  = 63
+
+	flagBinary   = 128
+	flagUnsigned = 0x80
+)
+
+// timestampLayout accepts the textual timestamps sent by clients, with or
+// without fractional seconds.
+const timestampLayout = "2006-01-02 15:04:05.999999999"
+
+// columnType describes how a column is announced in a column definition.
+type columnType struct {
+	typ     byte
+	charset int
+	length  uint32
+	flags   int
+}
+
+func columnTypeOf(ft engine.FieldType) columnType {
+	switch ft {
+	case engine.INT:
+		return columnType{typeLongLong, charsetBinary, 20, flagBinary}
+	case engine.BOOL:
+		return columnType{typeTiny, charsetBinary, 1, flagBinary}
+	case engine.DATETIME:
+		return columnType{typeDateTime, charsetBinary, 19, flagBinary}
+	default:
+		return columnType{typeVarString, charsetUtf8mb4, 1 << 18, 0}
+	}
+}
+
+// columnDefinition builds the packet describing a result column.
+func columnDefinition(table string, col engine.Column) []byte {
+	ct := columnTypeOf(col.Type)
+	p := &packet{}
+	p.lenencString([]byte("def")).
+		lenencString(nil).
+		lenencString([]byte(table)).
+		lenencString([]byte(table)).
+		lenencString([]byte(col.Name)).
+		lenencString([]byte(col.Name)).
+		lenenc(0x0c).
+		int2(ct.charset).
+		int4(ct.length).
+		int1(int(ct.typ)).
+		int2(ct.flags).
+		int1(0).
+		int2(0)
+	return p.b
+}
+
+// textValue converts a cell to the text protocol, nil is a NULL.
+func textValue(col engine.Column, cell string) ([]byte, error) {
+	v, err := engine.ParseValue(col.Type, cell)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return []byte("1"), nil
+		}
+		return []byte("0"), nil
+	case time.Time:
+		return []byte(v.Format(engine.DateTimeLayout)), nil
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("unexpected value %T", v)
+}
+
+// appendBinaryValue appends a non-NULL cell in the binary protocol, it
+// returns false for NULLs.
+func appendBinaryValue(p *packet, col engine.Column, cell string) (bool, error) {
+	v, err := engine.ParseValue(col.Type, cell)
+	if err != nil || v == nil {
+		return false, err
+	}
+	switch v := v.(type) {
+	case int64:
+		p.int8(uint64(v))
+	case bool:
+		if v {
+			p.int1(1)
+		} else {
+			p.int1(0)
+		}
+	case time.Time:
+		p.int1(7).int2(v.Year()).int1(int(v.Month())).int1(v.Day()).
+			int1(v.Hour()).int1(v.Minute()).int1(v.Second())
+	case string:
+		p.lenencString([]byte(v))
+	default:
+		return false, fmt.Errorf("unexpected value %T", v)
+	}
+	return true, nil
+}
+
+// readBinaryParam decodes a parameter of COM_STMT_EXECUTE.
+func readBinaryParam(r *reader, typ byte, unsigned bool) (interface{}, error) {
+	switch typ {
+	case typeTiny:
+		v := r.int1()
+		if unsigned {
+			return int64(v), nil
+		}
+		return int64(int8(v)), nil
+	case typeShort, typeYear:
+		v := r.int2()
+		if unsigned {
+			return int64(v), nil
+		}
+		return int64(int16(v)), nil
+	case typeLong, typeInt24:
+		v := r.int4()
+		if unsigned {
+			return int64(v), nil
+		}
+		return int64(int32(v)), nil
+	case typeLongLong:
+		v := r.int8()
+		if unsigned {
+			return v, nil
+		}
+		return int64(v), nil
+	case typeFloat:
+		return math.Float32frombits(r.int4()), nil
+	case typeDouble:
+		return math.Float64frombits(r.int8()), nil
+	case typeDate, typeDateTime, typeTimestamp:
+		return readBinaryTime(r), nil
+	case typeVarchar, typeVarString, typeString, typeTinyBlob, typeMediumBlob, typeLongBlob,
+		typeBlob, typeNewDecimal, typeJSON, typeEnum, typeSet, typeBit:
+		return string(r.lenencString()), nil
+	case typeNull:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("parameter type %d is not supported", typ)
+}
+
+func readBinaryTime(r *reader) time.Time {
+	var year, month, day, hour, min, sec, usec int
+	n := r.int1()
+	if n >= 4 {
+		year, month, day = r.int2(), r.int1(), r.int1()
+	}
+	if n >= 7 {
+		hour, min, sec = r.int1(), r.int1(), r.int1()
+	}
+	if n >= 11 {
+		usec = int(r.int4())
+	}
+	return time.Date(year, time.Month(month), day, hour, min, sec, usec*1000, time.UTC)
+}
+
+// paramValue adapts a parameter to the column it's compared with or stored
+// in. Clients send timestamps as strings, possibly with fractional seconds
+// the engine doesn't accept.
+func paramValue(ft engine.FieldType, v interface{}) interface{} {
+	if s, ok := v.(string); ok && ft == engine.DATETIME {
+		if t, err := time.Parse(timestampLayout, s); err == nil {
+			return t
+		}
+	}
+	return v
+}
+
+// errorNumbers maps engine error codes to MySQL error numbers, the code
+// itself is sent as SQLSTATE.
+var errorNumbers = map[engine.ErrorCode]int{
+	engine.ErrSyntax:                1064, // ER_PARSE_ERROR
+	engine.ErrUndefinedTable:        1146, // ER_NO_SUCH_TABLE
+	engine.ErrUndefinedColumn:       1054, // ER_BAD_FIELD_ERROR
+	engine.ErrDuplicateTable:        1050, // ER_TABLE_EXISTS_ERROR
+	engine.ErrInvalidAuthorization:  1045, // ER_ACCESS_DENIED_ERROR
+	engine.ErrInsufficientPrivilege: 1142, // ER_TABLEACCESS_DENIED_ERROR
+	engine.ErrWrongParamCount:       1210, // ER_WRONG_ARGUMENTS
+	engine.ErrInvalidStatement:      1243, // ER_UNKNOWN_STMT_HANDLER
+	engine.ErrInvalidValue:          1366, // ER_TRUNCATED_WRONG_VALUE_FOR_FIELD
+	engine.ErrInvalidParameter:      1366,
+	engine.ErrConstraintViolation:   1062, // ER_DUP_ENTRY
+	engine.ErrUndefinedFunction:     1305, // ER_SP_DOES_NOT_EXIST
+	engine.ErrDivisionByZero:        1365, // ER_DIVISION_BY_ZERO
+	engine.ErrGrouping:              1140, // ER_MIX_OF_GROUP_FUNC_AND_FIELDS
+	engine.ErrFeatureNotSupported:   1235, // ER_NOT_SUPPORTED_YET
+	engine.ErrReadOnly:              1290, // ER_OPTION_PREVENTS_STATEMENT
+	engine.ErrTooManyRequests:       1040, // ER_CON_COUNT_ERROR
+	engine.ErrQueryTimeout:          3024, // ER_QUERY_TIMEOUT
+	engine.ErrShutdown:              1053, // ER_SERVER_SHUTDOWN
+}
+
+// errUnknown is ER_UNKNOWN_ERROR.
+const errUnknown = 1105
+
+func errorNumberOf(code engine.ErrorCode) int {
+	if n, ok := errorNumbers[code]; ok {
+		return n
+	}
+	return errUnknown
+}
@@ -0,0 +1,331 @@
+package pgwire
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopicosql/db/engine"
+)
+
+// codeProtocolViolation is reported for messages the server can't make
+// sense of.
+const codeProtocolViolation engine.ErrorCode = "08P01"
+
+// statement is a statement created by a Parse message. Statements the
+// engine can't prepare, like SET or GRANT, are run from sql on every
+// Execute and take no parameters.
+type statement struct {
+	sql       string
+	stmt      *engine.Stmt
+	paramOIDs []int
+	cols      []engine.Column
+}
+
+// portal is a statement bound to parameters by a Bind message. The result
+// is kept after the first Execute so it can be fetched in parts.
+type portal struct {
+	stmt     *statement
+	args     []interface{}
+	formats  []int
+	executed bool
+	tag      string
+	cols     []engine.Column
+	rows     []engine.Row
+}
+
+type conn struct {
+	srv    *Server
+	nc     net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	tls    bool
+	pid    uint32
+	secret uint32
+	// user is the authenticated user, empty while the engine has no users
+	user    string
+	stmts   map[string]*statement
+	portals map[string]*portal
+	// skipping is set after an error in the extended query flow, messages
+	// are then ignored until Sync
+	skipping bool
+
+	lock *sync.Mutex
+	// idle is set while waiting for a query after ReadyForQuery
+	idle   bool
+	cancel context.CancelFunc
+}
+
+func (c *conn) serve() {
+	defer c.srv.removeConn(c)
+	defer c.close()
+
+	if err := c.startup(); err != nil {
+		if err != io.EOF && !c.srv.isClosing() {
+			c.srv.logf("PostgreSQL connection from %s failed: %s", c.nc.RemoteAddr(), err)
+		}
+		return
+	}
+
+	for {
+		typ, body, err := readMessage(c.r)
+		if err != nil {
+			if err != io.EOF && !c.srv.isClosing() {
+				c.srv.logf("PostgreSQL connection from %s: %s", c.nc.RemoteAddr(), err)
+			}
+			return
+		}
+		if typ == msgTerminate || !c.setIdle(false) {
+			return
+		}
+		if err := c.handle(typ, body); err != nil {
+			if err != io.EOF {
+				c.srv.logf("PostgreSQL connection from %s: %s", c.nc.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// close deallocates the prepared statements of the connection and closes it.
+func (c *conn) close() {
+	for _, st := range c.stmts {
+		if st.stmt != nil {
+			st.stmt.Close()
+		}
+	}
+	c.lock.Lock()
+	c.nc.Close()
+	c.lock.Unlock()
+}
+
+// setIdle records whether the connection waits for a query, it returns
+// false if the connection should go away because the server shuts down.
+func (c *conn) setIdle(idle bool) bool {
+	c.lock.Lock()
+	c.idle = idle
+	c.lock.Unlock()
+	return !c.srv.isClosing()
+}
+
+// closeIfIdle is called by Shutdown, the client is told why the
+// connection goes away.
+func (c *conn) closeIfIdle() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.idle {
+		c.nc.Write(errorMessage("FATAL", engine.ErrShutdown, "terminating connection due to server shutdown").bytes())
+		c.nc.Close()
+	}
+}
+
+func (c *conn) cancelQuery() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+func (c *conn) send(m *message) {
+	c.w.Write(m.bytes())
+}
+
+func errorMessage(severity string, code engine.ErrorCode, msg string) *message {
+	return newMessage(msgErrorResponse).
+		byte('S').string(severity).
+		byte('V').string(severity).
+		byte('C').string(string(code)).
+		byte('M').string(msg).
+		byte(0)
+}
+
+func (c *conn) sendError(err error) {
+	code, msg := engine.ErrorCodeOf(err), err.Error()
+	if e, ok := err.(*engine.Error); ok {
+		msg = e.Msg
+	}
+	if err == context.Canceled {
+		code, msg = engine.ErrQueryTimeout, "canceling statement due to user request"
+	}
+	c.send(errorMessage("ERROR", code, msg))
+}
+
+// fatal reports an error that ends the connection.
+func (c *conn) fatal(code engine.ErrorCode, format string, a ...interface{}) error {
+	c.send(errorMessage("FATAL", code, fmt.Sprintf(format, a...)))
+	c.w.Flush()
+	return io.EOF
+}
+
+func (c *conn) readyForQuery() error {
+	c.send(newMessage(msgReadyForQuery).byte('I'))
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if !c.setIdle(true) {
+		c.closeIfIdle()
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *conn) handle(typ byte, body []byte) error {
+	switch typ {
+	case msgQuery:
+		r := &reader{b: body}
+		sql := r.string()
+		if r.err != nil {
+			return c.fatal(codeProtocolViolation, "malformed query message")
+		}
+		return c.simpleQuery(sql)
+	case msgSync:
+		c.skipping = false
+		c.portals = make(map[string]*portal)
+		return c.readyForQuery()
+	case msgFlush:
+		return c.w.Flush()
+	case msgParse, msgBind, msgDescribe, msgExecute, msgClose:
+		if c.skipping {
+			return nil
+		}
+		if err := c.extended(typ, &reader{b: body}); err != nil {
+			c.sendError(err)
+			c.skipping = true
+		}
+		return nil
+	default:
+		return c.fatal(codeProtocolViolation, "unexpected message '%c'", typ)
+	}
+}
+
+// run executes a statement, either from sql or prepared under handle, and
+// returns the command tag of the result.
+func (c *conn) run(sql, handle string, args []interface{}) (engine.QueryResult, string, error) {
+	verb, object := commandOf(sql)
+	switch verb {
+	case "SET":
+		return engine.QueryResult{}, "SET", nil
+	case "BEGIN", "START", "COMMIT", "END", "ROLLBACK":
+		return engine.QueryResult{}, "", &engine.Error{Code: engine.ErrFeatureNotSupported, Msg: "transactions are not supported"}
+	}
+
+	ctx, cancel := context.WithCancel(engine.WithUser(context.Background(), c.user))
+	if secs := c.srv.cfg.QueryTimeoutSecs; secs > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(secs)*time.Second)
+	}
+	c.lock.Lock()
+	c.cancel = cancel
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		c.cancel = nil
+		c.lock.Unlock()
+		cancel()
+	}()
+
+	res, err := c.srv.db.ExecRequest(ctx, engine.QueryRequest{Sql: sql, Handle: handle, Args: args})
+	if err != nil {
+		return res, "", err
+	}
+
+	var tag string
+	switch verb {
+	case "SELECT":
+		tag = fmt.Sprintf("SELECT %d", len(res.Rows))
+	case "INSERT":
+		tag = fmt.Sprintf("INSERT 0 %d", res.RowsAffected)
+	case "UPDATE", "DELETE":
+		tag = fmt.Sprintf("%s %d", verb, res.RowsAffected)
+	case "CREATE", "DROP":
+		tag = verb + " " + object
+	default:
+		tag = verb
+	}
+	return res, tag, nil
+}
+
+// commandOf returns the first two words of a statement in upper case.
+func commandOf(sql string) (verb, object string) {
+	words := strings.Fields(strings.ToUpper(sql))
+	if len(words) > 0 {
+		verb = words[0]
+	}
+	if len(words) > 1 {
+		object = words[1]
+	}
+	return verb, object
+}
+
+// splitStatements splits a query string on semicolons outside of quoted
+// literals and identifiers. Empty statements are dropped.
+func splitStatements(sql string) []string {
+	stmts, rest := engine.SplitStatements(sql)
+	if rest != "" {
+		stmts = append(stmts, strings.TrimSpace(rest))
+	}
+	return stmts
+}
+
+func (c *conn) simpleQuery(sql string) error {
+	stmts := splitStatements(sql)
+	if len(stmts) == 0 {
+		c.send(newMessage(msgEmptyQueryResponse))
+	}
+	for _, s := range stmts {
+		res, tag, err := c.run(s, "", nil)
+		if err == nil && res.Columns != nil {
+			c.sendRowDescription(res.Columns, nil)
+			_, err = c.sendRows(res.Columns, res.Rows, nil)
+		}
+		if err != nil {
+			c.sendError(err)
+			break
+		}
+		c.send(newMessage(msgCommandComplete).string(tag))
+	}
+	return c.readyForQuery()
+}
+
+// formatOf returns the format of column i given the format codes of a Bind
+// message: none means text, a single code applies to all columns.
+func formatOf(formats []int, i int) int {
+	switch len(formats) {
+	case 0:
+		return formatText
+	case 1:
+		return formats[0]
+	default:
+		return formats[i]
+	}
+}
+
+func (c *conn) sendRowDescription(cols []engine.Column, formats []int) {
+	m := newMessage(msgRowDescription).int16(len(cols))
+	for i, col := range cols {
+		oid := oidOf(col.Type)
+		m.string(col.Name).int32(0).int16(0).int32(oid).int16(typeSize(oid)).int32(-1).int16(formatOf(formats, i))
+	}
+	c.send(m)
+}
+
+// sendRows sends rows as DataRow messages and returns how many were sent.
+func (c *conn) sendRows(cols []engine.Column, rows []engine.Row, formats []int) (int, error) {
+	for n, row := range rows {
+		m := newMessage(msgDataRow).int16(len(cols))
+		for i, col := range cols {
+			v, err := encodeValue(col, row.Fields[col.Name], formatOf(formats, i))
+			if err != nil {
+				return n, &engine.Error{Code: engine.ErrInvalidValue, Msg: fmt.Sprintf("column %s: %s", col.Name, err)}
+			}
+			m.value(v)
+		}
+		c.send(m)
+	}
+	return len(rows), nil
+}
@@ -0,0 +1,276 @@
+package pgwire
+
+import (
+	"context"
+	"fmt"
+
+	"gopicosql/db/engine"
+)
+
+func protocolError(format string, a ...interface{}) error {
+	return &engine.Error{Code: codeProtocolViolation, Msg: fmt.Sprintf(format, a...)}
+}
+
+// extended handles the messages of the extended query flow. The returned
+// error is sent to the client, which then has to Sync.
+func (c *conn) extended(typ byte, r *reader) error {
+	var err error
+	switch typ {
+	case msgParse:
+		err = c.parse(r)
+	case msgBind:
+		err = c.bind(r)
+	case msgDescribe:
+		err = c.describe(r)
+	case msgExecute:
+		err = c.execute(r)
+	case msgClose:
+		err = c.closeObject(r)
+	}
+	if err == nil && r.err != nil {
+		err = protocolError("malformed message '%c'", typ)
+	}
+	return err
+}
+
+// isUtility reports whether a statement is run without preparing it.
+func isUtility(sql string) bool {
+	switch verb, _ := commandOf(sql); verb {
+	case "", "SET", "GRANT", "REVOKE", "BEGIN", "START", "COMMIT", "END", "ROLLBACK":
+		return true
+	}
+	return false
+}
+
+func (c *conn) parse(r *reader) error {
+	name, sql := r.string(), r.string()
+	n := r.int16()
+	if n < 0 {
+		return protocolError("invalid parameter type count %d", n)
+	}
+	oids := make([]int, n)
+	for i := range oids {
+		oids[i] = r.int32()
+	}
+	if r.err != nil {
+		return nil
+	}
+
+	if _, ok := c.stmts[name]; ok {
+		if name != "" {
+			return &engine.Error{Code: engine.ErrDuplicateObject, Msg: fmt.Sprintf("prepared statement %s already exists", name)}
+		}
+		c.dropStatement(name)
+	}
+
+	st := &statement{sql: sql}
+	if !isUtility(sql) {
+		stmt, err := c.srv.db.PrepareContext(engine.WithUser(context.Background(), c.user), sql)
+		if err != nil {
+			return err
+		}
+		st.stmt = stmt
+		if err := c.describeStatement(st, oids); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	c.stmts[name] = st
+	c.send(newMessage(msgParseComplete))
+	return nil
+}
+
+// describeStatement resolves the parameter and result types of st.
+// Parameter types given by the client take precedence.
+func (c *conn) describeStatement(st *statement, oids []int) error {
+	types, err := st.stmt.ParamTypes()
+	if err != nil {
+		return err
+	}
+	st.paramOIDs = make([]int, len(types))
+	for i, ft := range types {
+		st.paramOIDs[i] = oidOf(ft)
+		if i < len(oids) && oids[i] != oidUnspecified {
+			st.paramOIDs[i] = oids[i]
+		}
+	}
+
+	st.cols, err = st.stmt.Columns()
+	if err != nil {
+		return err
+	}
+	if st.cols != nil {
+		return c.srv.db.CheckPrivilege(c.user, st.stmt.Table(), engine.PrivSelect)
+	}
+	return nil
+}
+
+func (c *conn) dropStatement(name string) {
+	if st, ok := c.stmts[name]; ok && st.stmt != nil {
+		st.stmt.Close()
+	}
+	delete(c.stmts, name)
+}
+
+// readFormats reads the format codes of a Bind message, n is the number of
+// values they apply to.
+func readFormats(r *reader, n int) ([]int, error) {
+	count := r.int16()
+	if count < 0 {
+		return nil, protocolError("invalid format code count %d", count)
+	}
+	formats := make([]int, count)
+	for i := range formats {
+		formats[i] = r.int16()
+		if formats[i] != formatText && formats[i] != formatBinary {
+			return nil, protocolError("invalid format code %d", formats[i])
+		}
+	}
+	if len(formats) > 1 && len(formats) != n {
+		return nil, protocolError("got %d format codes for %d values", len(formats), n)
+	}
+	return formats, nil
+}
+
+func (c *conn) bind(r *reader) error {
+	portalName, stmtName := r.string(), r.string()
+	st, ok := c.stmts[stmtName]
+	if !ok {
+		return &engine.Error{Code: engine.ErrInvalidStatement, Msg: fmt.Sprintf("prepared statement %s does not exist", stmtName)}
+	}
+	if _, ok := c.portals[portalName]; ok && portalName != "" {
+		return &engine.Error{Code: engine.ErrDuplicateObject, Msg: fmt.Sprintf("portal %s already exists", portalName)}
+	}
+
+	paramFormats, err := readFormats(r, len(st.paramOIDs))
+	if err != nil {
+		return err
+	}
+	n := r.int16()
+	if r.err == nil && n != len(st.paramOIDs) {
+		return &engine.Error{Code: engine.ErrWrongParamCount, Msg: fmt.Sprintf("expected %d parameters, got %d", len(st.paramOIDs), n)}
+	}
+	args := make([]interface{}, n)
+	for i := range args {
+		v := r.bytes(r.int32())
+		if r.err != nil {
+			return nil
+		}
+		if args[i], err = decodeParam(st.paramOIDs[i], formatOf(paramFormats, i), v); err != nil {
+			return &engine.Error{Code: engine.ErrInvalidParameter, Msg: fmt.Sprintf("parameter %d: %s", i+1, err)}
+		}
+	}
+	formats, err := readFormats(r, len(st.cols))
+	if err != nil {
+		return err
+	}
+	if r.err != nil {
+		return nil
+	}
+
+	c.portals[portalName] = &portal{stmt: st, args: args, formats: formats}
+	c.send(newMessage(msgBindComplete))
+	return nil
+}
+
+func (c *conn) describe(r *reader) error {
+	kind, name := r.byte(), r.string()
+	if r.err != nil {
+		return nil
+	}
+
+	switch kind {
+	case 'S':
+		st, ok := c.stmts[name]
+		if !ok {
+			return &engine.Error{Code: engine.ErrInvalidStatement, Msg: fmt.Sprintf("prepared statement %s does not exist", name)}
+		}
+		m := newMessage(msgParameterDescription).int16(len(st.paramOIDs))
+		for _, oid := range st.paramOIDs {
+			m.int32(oid)
+		}
+		c.send(m)
+		c.sendDescription(st.cols, nil)
+	case 'P':
+		p, ok := c.portals[name]
+		if !ok {
+			return &engine.Error{Code: engine.ErrInvalidStatement, Msg: fmt.Sprintf("portal %s does not exist", name)}
+		}
+		c.sendDescription(p.stmt.cols, p.formats)
+	default:
+		return protocolError("invalid Describe kind '%c'", kind)
+	}
+	return nil
+}
+
+func (c *conn) sendDescription(cols []engine.Column, formats []int) {
+	if cols == nil {
+		c.send(newMessage(msgNoData))
+		return
+	}
+	c.sendRowDescription(cols, formats)
+}
+
+func (c *conn) execute(r *reader) error {
+	name, maxRows := r.string(), r.int32()
+	if r.err != nil {
+		return nil
+	}
+	p, ok := c.portals[name]
+	if !ok {
+		return &engine.Error{Code: engine.ErrInvalidStatement, Msg: fmt.Sprintf("portal %s does not exist", name)}
+	}
+
+	if !p.executed {
+		if verb, _ := commandOf(p.stmt.sql); verb == "" {
+			c.send(newMessage(msgEmptyQueryResponse))
+			return nil
+		}
+		handle := ""
+		if p.stmt.stmt != nil {
+			handle = p.stmt.stmt.Handle()
+		}
+		res, tag, err := c.run(p.stmt.sql, handle, p.args)
+		if err != nil {
+			return err
+		}
+		p.executed, p.tag, p.cols, p.rows = true, tag, res.Columns, res.Rows
+	}
+
+	if p.cols == nil {
+		c.send(newMessage(msgCommandComplete).string(p.tag))
+		return nil
+	}
+	rows := p.rows
+	if maxRows > 0 && maxRows < len(rows) {
+		rows = rows[:maxRows]
+	}
+	n, err := c.sendRows(p.cols, rows, p.formats)
+	p.rows = p.rows[n:]
+	if err != nil {
+		return err
+	}
+	if maxRows > 0 && len(p.rows) > 0 {
+		c.send(newMessage(msgPortalSuspended))
+		return nil
+	}
+	c.send(newMessage(msgCommandComplete).string(fmt.Sprintf("SELECT %d", n)))
+	return nil
+}
+
+func (c *conn) closeObject(r *reader) error {
+	kind, name := r.byte(), r.string()
+	if r.err != nil {
+		return nil
+	}
+	switch kind {
+	case 'S':
+		c.dropStatement(name)
+	case 'P':
+		delete(c.portals, name)
+	default:
+		return protocolError("invalid Close kind '%c'", kind)
+	}
+	c.send(newMessage(msgCloseComplete))
+	return nil
+}
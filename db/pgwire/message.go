@@ -0,0 +1,206 @@
+package pgwire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// maxMessageSize bounds the messages accepted from clients.
+const maxMessageSize = 1 << 26
+
+// Backend message types.
+const (
+	msgAuthentication       = 'R'
+	msgBackendKeyData       = 'K'
+	msgBindComplete         = '2'
+	msgCloseComplete        = '3'
+	msgCommandComplete      = 'C'
+	msgDataRow              = 'D'
+	msgEmptyQueryResponse   = 'I'
+	msgErrorResponse        = 'E'
+	msgNoData               = 'n'
+	msgParameterDescription = 't'
+	msgParameterStatus      = 'S'
+	msgParseComplete        = '1'
+	msgPortalSuspended      = 's'
+	msgReadyForQuery        = 'Z'
+	msgRowDescription       = 'T'
+)
+
+// Frontend message types.
+const (
+	msgBind      = 'B'
+	msgClose     = 'C'
+	msgDescribe  = 'D'
+	msgExecute   = 'E'
+	msgFlush     = 'H'
+	msgParse     = 'P'
+	msgPassword  = 'p'
+	msgQuery     = 'Q'
+	msgSync      = 'S'
+	msgTerminate = 'X'
+)
+
+// Codes of the messages a connection starts with.
+const (
+	protocolVersion3 = 196608
+	sslRequestCode   = 80877103
+	gssEncRequest    = 80877104
+	cancelRequest    = 80877102
+)
+
+const (
+	authOk                = 0
+	authCleartextPassword = 3
+)
+
+// readStartup reads a message without a type byte, only sent at the start
+// of a connection.
+func readStartup(r io.Reader) (code uint32, body []byte, err error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 8 || n > maxMessageSize {
+		return 0, nil, fmt.Errorf("invalid startup message length %d", n)
+	}
+	body = make([]byte, n-8)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(hdr[4:]), body, nil
+}
+
+func readMessage(r *bufio.Reader) (typ byte, body []byte, err error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n < 4 || n > maxMessageSize {
+		return 0, nil, fmt.Errorf("invalid length %d of message '%c'", n, hdr[0])
+	}
+	body = make([]byte, n-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], body, nil
+}
+
+// reader decodes the fields of a message body. The first decoding error is
+// kept and reported by err, later reads return zero values.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("malformed message")
+	}
+	r.b = nil
+}
+
+func (r *reader) byte() byte {
+	if len(r.b) < 1 {
+		r.fail()
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) int16() int {
+	if len(r.b) < 2 {
+		r.fail()
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(r.b))
+	r.b = r.b[2:]
+	return int(v)
+}
+
+func (r *reader) int32() int {
+	if len(r.b) < 4 {
+		r.fail()
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(r.b))
+	r.b = r.b[4:]
+	return int(v)
+}
+
+func (r *reader) string() string {
+	i := bytes.IndexByte(r.b, 0)
+	if i < 0 {
+		r.fail()
+		return ""
+	}
+	s := string(r.b[:i])
+	r.b = r.b[i+1:]
+	return s
+}
+
+// bytes reads n bytes, a negative n is a NULL and yields nil.
+func (r *reader) bytes(n int) []byte {
+	if n < 0 {
+		return nil
+	}
+	if len(r.b) < n {
+		r.fail()
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+// message builds a single backend message.
+type message struct {
+	b []byte
+}
+
+func newMessage(typ byte) *message {
+	return &message{b: []byte{typ, 0, 0, 0, 0}}
+}
+
+func (m *message) byte(v byte) *message {
+	m.b = append(m.b, v)
+	return m
+}
+
+func (m *message) int16(v int) *message {
+	m.b = append(m.b, byte(v>>8), byte(v))
+	return m
+}
+
+func (m *message) int32(v int) *message {
+	m.b = append(m.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	return m
+}
+
+func (m *message) string(s string) *message {
+	m.b = append(m.b, s...)
+	m.b = append(m.b, 0)
+	return m
+}
+
+// value appends a length-prefixed value, nil is written as NULL.
+func (m *message) value(v []byte) *message {
+	if v == nil {
+		return m.int32(-1)
+	}
+	m.int32(len(v))
+	m.b = append(m.b, v...)
+	return m
+}
+
+func (m *message) bytes() []byte {
+	binary.BigEndian.PutUint32(m.b[1:5], uint32(len(m.b)-1))
+	return m.b
+}
@@ -0,0 +1,300 @@
+// Package pgwire serves the database over version 3 of the PostgreSQL
+// frontend/backend protocol, so psql and the usual PostgreSQL drivers can
+// be used as clients.
+//
+// Both the simple and the extended query flow are supported. Columns are
+// reported as text (TEXT), int8 (INT), bool (BOOL) and timestamp
+// (DATETIME), values are sent in text or binary format as requested.
+package pgwire
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"gopicosql/db/engine"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown.
+var ErrServerClosed = errors.New("pgwire: server closed")
+
+// Server accepts PostgreSQL protocol connections and runs their
+// statements on the engine.
+type Server struct {
+	db  *engine.DbEngine
+	cfg *engine.Cfg
+	// tlsConfig is offered to clients sending SSLRequest. When set,
+	// unencrypted connections are refused.
+	tlsConfig *tls.Config
+	// ErrorLog receives connection errors, they are dropped if nil.
+	ErrorLog *log.Logger
+
+	lock    *sync.Mutex
+	ln      net.Listener
+	conns   map[uint32]*conn
+	lastPid uint32
+	closing bool
+	wg      sync.WaitGroup
+}
+
+func NewServer(db *engine.DbEngine, cfg *engine.Cfg, tlsConfig *tls.Config) *Server {
+	return &Server{
+		db:        db,
+		cfg:       cfg,
+		tlsConfig: tlsConfig,
+		lock:      &sync.Mutex{},
+		conns:     make(map[uint32]*conn),
+	}
+}
+
+func (s *Server) logf(format string, a ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, a...)
+	}
+}
+
+// Serve accepts connections on ln until Shutdown is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.ln = ln
+	s.lock.Unlock()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closing := s.closing
+			s.lock.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		c, ok := s.newConn(nc)
+		if !ok {
+			nc.Close()
+			return ErrServerClosed
+		}
+		go c.serve()
+	}
+}
+
+func (s *Server) newConn(nc net.Conn) (*conn, bool) {
+	var secret [4]byte
+	rand.Read(secret[:])
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		return nil, false
+	}
+	s.lastPid++
+	c := &conn{
+		srv:     s,
+		nc:      nc,
+		r:       bufio.NewReader(nc),
+		w:       bufio.NewWriter(nc),
+		pid:     s.lastPid,
+		secret:  binary.BigEndian.Uint32(secret[:]),
+		stmts:   make(map[string]*statement),
+		portals: make(map[string]*portal),
+		lock:    &sync.Mutex{},
+		idle:    true,
+	}
+	s.conns[c.pid] = c
+	s.wg.Add(1)
+	return c, true
+}
+
+func (s *Server) removeConn(c *conn) {
+	s.lock.Lock()
+	delete(s.conns, c.pid)
+	s.lock.Unlock()
+	s.wg.Done()
+}
+
+func (s *Server) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closing
+}
+
+// cancel stops the statement running on the connection identified by a
+// CancelRequest.
+func (s *Server) cancel(pid, secret uint32) {
+	s.lock.Lock()
+	c, ok := s.conns[pid]
+	s.lock.Unlock()
+	if ok && c.secret == secret {
+		c.cancelQuery()
+	}
+}
+
+// Shutdown stops accepting connections and closes idle ones, busy
+// connections are closed once their statements complete. If ctx is done
+// first, the remaining connections are closed right away.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.closing = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for _, c := range s.conns {
+		c.closeIfIdle()
+	}
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		for _, c := range s.conns {
+			c.lock.Lock()
+			c.nc.Close()
+			c.lock.Unlock()
+		}
+		s.lock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// startup handles the messages sent before the first query: encryption
+// negotiation, the startup parameters and authentication.
+func (c *conn) startup() error {
+	var params map[string]string
+	for params == nil {
+		code, body, err := readStartup(c.r)
+		if err != nil {
+			return err
+		}
+		r := &reader{b: body}
+
+		switch code {
+		case sslRequestCode:
+			if c.srv.tlsConfig == nil || c.tls {
+				if _, err := c.nc.Write([]byte{'N'}); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := c.nc.Write([]byte{'S'}); err != nil {
+				return err
+			}
+			tc := tls.Server(c.nc, c.srv.tlsConfig)
+			if err := tc.Handshake(); err != nil {
+				return err
+			}
+			c.lock.Lock()
+			c.nc, c.tls = tc, true
+			c.lock.Unlock()
+			c.r, c.w = bufio.NewReader(tc), bufio.NewWriter(tc)
+		case gssEncRequest:
+			if _, err := c.nc.Write([]byte{'N'}); err != nil {
+				return err
+			}
+		case cancelRequest:
+			pid, secret := uint32(r.int32()), uint32(r.int32())
+			if r.err == nil {
+				c.srv.cancel(pid, secret)
+			}
+			return io.EOF
+		case protocolVersion3:
+			params = make(map[string]string)
+			for {
+				k := r.string()
+				if k == "" || r.err != nil {
+					break
+				}
+				params[k] = r.string()
+			}
+			if r.err != nil {
+				return c.fatal(codeProtocolViolation, "malformed startup message")
+			}
+		default:
+			return c.fatal(engine.ErrFeatureNotSupported, "unsupported frontend protocol %d.%d", code>>16, code&0xffff)
+		}
+	}
+
+	if c.srv.tlsConfig != nil && !c.tls {
+		return c.fatal(engine.ErrInvalidAuthorization, "SSL connection is required")
+	}
+	if err := c.authenticate(params["user"]); err != nil {
+		return err
+	}
+
+	c.send(newMessage(msgAuthentication).int32(authOk))
+	for _, p := range [][2]string{
+		{"server_version", serverVersion},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"TimeZone", "UTC"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+		{"session_authorization", params["user"]},
+	} {
+		c.send(newMessage(msgParameterStatus).string(p[0]).string(p[1]))
+	}
+	c.send(newMessage(msgBackendKeyData).int32(int(c.pid)).int32(int(c.secret)))
+	return c.readyForQuery()
+}
+
+// serverVersion is reported to clients, some of them refuse to talk to
+// servers older than they support.
+const serverVersion = "14.0"
+
+// authenticate asks for a password once the engine has users. An API key
+// is accepted as the password too.
+func (c *conn) authenticate(user string) error {
+	if !c.srv.db.AuthEnabled() {
+		return nil
+	}
+	if user == "" {
+		return c.fatal(engine.ErrInvalidAuthorization, "no user name given")
+	}
+
+	c.send(newMessage(msgAuthentication).int32(authCleartextPassword))
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	typ, body, err := readMessage(c.r)
+	if err != nil {
+		return err
+	}
+	if typ != msgPassword {
+		return c.fatal(codeProtocolViolation, "expected password message, got '%c'", typ)
+	}
+	r := &reader{b: body}
+	password := r.string()
+
+	err = c.srv.db.Authenticate(user, password)
+	if err != nil {
+		if keyUser, keyErr := c.srv.db.AuthenticateKey(password); keyErr == nil && keyUser == user {
+			err = nil
+		}
+	}
+	if err != nil {
+		return c.fatal(engine.ErrInvalidAuthorization, "password authentication failed for user %s", user)
+	}
+	c.user = user
+	return nil
+}
@@ -0,0 +1,328 @@
+package pgwire
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"gopicosql/db/engine"
+)
+
+type testClient struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+type backendMsg struct {
+	typ  byte
+	body []byte
+}
+
+// startTestServer serves db on a random port and returns its address.
+func startTestServer(t *testing.T, db *engine.DbEngine, cfg *engine.Cfg) (*Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	s := NewServer(db, cfg, nil)
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s, ln.Addr().String()
+}
+
+func openTestDb(t *testing.T, cfg *engine.Cfg) *engine.DbEngine {
+	db, err := engine.Open(cfg)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	t.Cleanup(db.Stop)
+	return db
+}
+
+func dial(t *testing.T, addr, user string) *testClient {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Cannot connect: %s", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	c := &testClient{t: t, nc: nc, r: bufio.NewReader(nc)}
+
+	body := (&message{}).int32(protocolVersion3).string("user").string(user).string("database").string("test").byte(0).b
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, uint32(len(body)+4))
+	nc.Write(append(hdr, body...))
+	return c
+}
+
+func (c *testClient) send(m *message) {
+	if _, err := c.nc.Write(m.bytes()); err != nil {
+		c.t.Fatalf("Cannot send: %s", err)
+	}
+}
+
+// readUntil reads messages up to and including one of type last.
+func (c *testClient) readUntil(last byte) []backendMsg {
+	var msgs []backendMsg
+	for {
+		typ, body, err := readMessage(c.r)
+		if err != nil {
+			c.t.Fatalf("Cannot read: %s (got %s)", err, types(msgs))
+		}
+		msgs = append(msgs, backendMsg{typ, body})
+		if typ == last {
+			return msgs
+		}
+	}
+}
+
+func types(msgs []backendMsg) string {
+	var b strings.Builder
+	for _, m := range msgs {
+		b.WriteByte(m.typ)
+	}
+	return b.String()
+}
+
+func (c *testClient) expect(last byte, want string) []backendMsg {
+	msgs := c.readUntil(last)
+	if got := types(msgs); got != want {
+		c.t.Fatalf("Expected messages %s, got %s", want, got)
+	}
+	return msgs
+}
+
+func (c *testClient) query(sql string, want string) []backendMsg {
+	c.send(newMessage(msgQuery).string(sql))
+	return c.expect(msgReadyForQuery, want)
+}
+
+// errorField returns a field of an ErrorResponse.
+func errorField(m backendMsg, field byte) string {
+	r := &reader{b: m.body}
+	for {
+		f := r.byte()
+		if f == 0 || r.err != nil {
+			return ""
+		}
+		if v := r.string(); f == field {
+			return v
+		}
+	}
+}
+
+func dataRow(m backendMsg) []string {
+	r := &reader{b: m.body}
+	vals := make([]string, r.int16())
+	for i := range vals {
+		if v := r.bytes(r.int32()); v == nil {
+			vals[i] = "NULL"
+		} else {
+			vals[i] = string(v)
+		}
+	}
+	return vals
+}
+
+func TestSimpleQuery(t *testing.T) {
+	_, addr := startTestServer(t, openTestDb(t, nil), engine.NewConfigDefault())
+	c := dial(t, addr, "alice")
+	c.expect(msgReadyForQuery, "RSSSSSSSSKZ")
+
+	msgs := c.query("CREATE TABLE t (id INT, name TEXT, ok BOOL, at DATETIME); "+
+		"INSERT INTO t (id, name, ok, at) VALUES ('1', 'a;b', 'true', '2022-01-06 12:30:00'); "+
+		"INSERT INTO t (id, name) VALUES ('2', 'x');"+
+		"SELECT * FROM t", "CCCTDDCZ")
+
+	tags := []string{"CREATE TABLE", "INSERT 0 1", "INSERT 0 1"}
+	for i, tag := range tags {
+		if got := (&reader{b: msgs[i].body}).string(); got != tag {
+			t.Errorf("Expected tag '%s', got '%s'", tag, got)
+		}
+	}
+	if got := (&reader{b: msgs[6].body}).string(); got != "SELECT 2" {
+		t.Errorf("Expected tag 'SELECT 2', got '%s'", got)
+	}
+
+	r := &reader{b: msgs[3].body}
+	wantCols := []struct {
+		name string
+		oid  int
+	}{{"id", oidInt8}, {"name", oidText}, {"ok", oidBool}, {"at", oidTimestamp}}
+	if n := r.int16(); n != len(wantCols) {
+		t.Fatalf("Expected %d columns, got %d", len(wantCols), n)
+	}
+	for _, want := range wantCols {
+		name := r.string()
+		r.int32()
+		r.int16()
+		oid := r.int32()
+		r.int16()
+		r.int32()
+		r.int16()
+		if name != want.name || oid != want.oid {
+			t.Errorf("Expected column %s of type %d, got %s of type %d", want.name, want.oid, name, oid)
+		}
+	}
+
+	if got := strings.Join(dataRow(msgs[4]), ","); got != "1,a;b,t,2022-01-06 12:30:00" {
+		t.Errorf("Unexpected row %s", got)
+	}
+	if got := strings.Join(dataRow(msgs[5]), ","); got != "2,x,NULL,NULL" {
+		t.Errorf("Unexpected row %s", got)
+	}
+
+	// an error skips the rest of the query string
+	msgs = c.query("SELECT * FROM nope; DROP TABLE t", "EZ")
+	if code := errorField(msgs[0], 'C'); code != string(engine.ErrUndefinedTable) {
+		t.Errorf("Expected code %s, got %s", engine.ErrUndefinedTable, code)
+	}
+	c.query("SELECT id FROM t", "TDDCZ")
+	c.query(" ; ", "IZ")
+	c.query("SET search_path TO public", "CZ")
+}
+
+func TestExtendedQuery(t *testing.T) {
+	db := openTestDb(t, nil)
+	ctx := context.Background()
+	db.Exec(ctx, "CREATE TABLE t (id INT, name TEXT)")
+	for i := 1; i <= 3; i++ {
+		db.Exec(ctx, "INSERT INTO t (id, name) VALUES (?, ?)", i, "n")
+	}
+	_, addr := startTestServer(t, db, engine.NewConfigDefault())
+	c := dial(t, addr, "alice")
+	c.expect(msgReadyForQuery, "RSSSSSSSSKZ")
+
+	param := make([]byte, 8)
+	binary.BigEndian.PutUint64(param, 2)
+	c.send(newMessage(msgParse).string("sel").string("SELECT id, name FROM t WHERE id >= $1").int16(0))
+	c.send(newMessage(msgDescribe).byte('S').string("sel"))
+	c.send(newMessage(msgBind).string("").string("sel").int16(1).int16(formatBinary).int16(1).value(param).int16(1).int16(formatBinary))
+	c.send(newMessage(msgExecute).string("").int32(1))
+	c.send(newMessage(msgExecute).string("").int32(0))
+	c.send(newMessage(msgSync))
+	msgs := c.expect(msgReadyForQuery, "1tT2DsDCZ")
+
+	r := &reader{b: msgs[1].body}
+	if n, oid := r.int16(), r.int32(); n != 1 || oid != oidInt8 {
+		t.Errorf("Expected a single int8 parameter, got %d of type %d", n, oid)
+	}
+	r = &reader{b: msgs[4].body}
+	r.int16()
+	if id := r.bytes(r.int32()); len(id) != 8 || binary.BigEndian.Uint64(id) != 2 {
+		t.Errorf("Expected binary id 2, got %v", id)
+	}
+	if got := (&reader{b: msgs[7].body}).string(); got != "SELECT 1" {
+		t.Errorf("Expected tag 'SELECT 1', got '%s'", got)
+	}
+
+	// text parameters of an INSERT
+	c.send(newMessage(msgParse).string("").string("INSERT INTO t (id, name) VALUES ($1, $2)").int16(0))
+	c.send(newMessage(msgBind).string("").string("").int16(0).int16(2).value([]byte("4")).value([]byte("m")).int16(0))
+	c.send(newMessage(msgDescribe).byte('P').string(""))
+	c.send(newMessage(msgExecute).string("").int32(0))
+	c.send(newMessage(msgClose).byte('S').string("sel"))
+	c.send(newMessage(msgSync))
+	msgs = c.expect(msgReadyForQuery, "12nC3Z")
+	if got := (&reader{b: msgs[3].body}).string(); got != "INSERT 0 1" {
+		t.Errorf("Expected tag 'INSERT 0 1', got '%s'", got)
+	}
+
+	// after an error messages are ignored until Sync
+	c.send(newMessage(msgParse).string("").string("SELECT FROM").int16(0))
+	c.send(newMessage(msgBind).string("").string("").int16(0).int16(0).int16(0))
+	c.send(newMessage(msgExecute).string("").int32(0))
+	c.send(newMessage(msgSync))
+	msgs = c.expect(msgReadyForQuery, "EZ")
+	if code := errorField(msgs[0], 'C'); code != string(engine.ErrSyntax) {
+		t.Errorf("Expected code %s, got %s", engine.ErrSyntax, code)
+	}
+
+	c.send(newMessage(msgBind).string("").string("sel").int16(0).int16(0).int16(0))
+	c.send(newMessage(msgSync))
+	c.expect(msgReadyForQuery, "EZ")
+
+	c.query("SELECT id FROM t WHERE id = '4'", "TDCZ")
+}
+
+func TestNegativeCounts(t *testing.T) {
+	db := openTestDb(t, nil)
+	db.Exec(context.Background(), "CREATE TABLE t (id INT)")
+	_, addr := startTestServer(t, db, engine.NewConfigDefault())
+	c := dial(t, addr, "alice")
+	c.expect(msgReadyForQuery, "RSSSSSSSSKZ")
+
+	c.send(newMessage(msgParse).string("").string("SELECT id FROM t").int16(-1))
+	c.send(newMessage(msgSync))
+	msgs := c.expect(msgReadyForQuery, "EZ")
+	if code := errorField(msgs[0], 'C'); code != string(codeProtocolViolation) {
+		t.Errorf("Expected code %s, got %s", codeProtocolViolation, code)
+	}
+
+	c.send(newMessage(msgParse).string("s").string("SELECT id FROM t").int16(0))
+	c.send(newMessage(msgBind).string("").string("s").int16(-1))
+	c.send(newMessage(msgSync))
+	c.expect(msgReadyForQuery, "1EZ")
+	c.send(newMessage(msgBind).string("").string("s").int16(0).int16(0).int16(-2))
+	c.send(newMessage(msgSync))
+	c.expect(msgReadyForQuery, "EZ")
+
+	// the connection survives
+	c.query("SELECT id FROM t", "TCZ")
+}
+
+func TestPasswordAuthentication(t *testing.T) {
+	cfg := engine.NewConfigDefault()
+	cfg.DbDir = t.TempDir()
+	db := openTestDb(t, cfg)
+	db.Exec(context.Background(), "CREATE TABLE t (id INT)")
+	if err := db.CreateUser("bob", "s3cret", false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, addr := startTestServer(t, db, cfg)
+
+	c := dial(t, addr, "bob")
+	c.expect(msgAuthentication, "R")
+	c.send(newMessage(msgPassword).string("wrong"))
+	msgs := c.expect(msgErrorResponse, "E")
+	if code := errorField(msgs[0], 'C'); code != string(engine.ErrInvalidAuthorization) {
+		t.Errorf("Expected code %s, got %s", engine.ErrInvalidAuthorization, code)
+	}
+	if sev := errorField(msgs[0], 'S'); sev != "FATAL" {
+		t.Errorf("Expected FATAL, got %s", sev)
+	}
+
+	c = dial(t, addr, "bob")
+	c.expect(msgAuthentication, "R")
+	c.send(newMessage(msgPassword).string("s3cret"))
+	c.expect(msgReadyForQuery, "RSSSSSSSSKZ")
+
+	msgs = c.query("SELECT * FROM t", "EZ")
+	if code := errorField(msgs[0], 'C'); code != string(engine.ErrInsufficientPrivilege) {
+		t.Errorf("Expected code %s, got %s", engine.ErrInsufficientPrivilege, code)
+	}
+	if _, err := db.Exec(context.Background(), "GRANT SELECT ON t TO bob"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c.query("SELECT * FROM t", "TCZ")
+}
+
+func TestShutdown(t *testing.T) {
+	s, addr := startTestServer(t, openTestDb(t, nil), engine.NewConfigDefault())
+	c := dial(t, addr, "alice")
+	c.expect(msgReadyForQuery, "RSSSSSSSSKZ")
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	msgs := c.expect(msgErrorResponse, "E")
+	if code := errorField(msgs[0], 'C'); code != string(engine.ErrShutdown) {
+		t.Errorf("Expected code %s, got %s", engine.ErrShutdown, code)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("Expected the listener to be closed")
+	}
+}
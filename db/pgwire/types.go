@@ -0,0 +1,150 @@
+package pgwire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopicosql/db/engine"
+)
+
+// Type OIDs as defined in the pg_type catalog.
+const (
+	oidUnspecified = 0
+	oidBool        = 16
+	oidInt8        = 20
+	oidInt2        = 21
+	oidInt4        = 23
+	oidText        = 25
+	oidVarchar     = 1043
+	oidTimestamp   = 1114
+	oidTimestampTz = 1184
+)
+
+const (
+	formatText   = 0
+	formatBinary = 1
+)
+
+// timestampLayout accepts the textual timestamps sent by clients, with or
+// without fractional seconds.
+const timestampLayout = "2006-01-02 15:04:05.999999999"
+
+// pgEpoch is the origin of binary timestamps.
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func oidOf(ft engine.FieldType) int {
+	switch ft {
+	case engine.INT:
+		return oidInt8
+	case engine.BOOL:
+		return oidBool
+	case engine.DATETIME:
+		return oidTimestamp
+	default:
+		return oidText
+	}
+}
+
+// typeSize is the typlen reported in RowDescription, -1 for variable size.
+func typeSize(oid int) int {
+	switch oid {
+	case oidInt8, oidTimestamp:
+		return 8
+	case oidBool:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// encodeValue converts a cell to the wire format of its column, nil is a
+// NULL.
+func encodeValue(col engine.Column, cell string, format int) ([]byte, error) {
+	v, err := engine.ParseValue(col.Type, cell)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, nil
+	}
+
+	if format == formatBinary {
+		switch v := v.(type) {
+		case int64:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, uint64(v))
+			return b, nil
+		case bool:
+			if v {
+				return []byte{1}, nil
+			}
+			return []byte{0}, nil
+		case time.Time:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, uint64(v.Sub(pgEpoch)/time.Microsecond))
+			return b, nil
+		case string:
+			return []byte(v), nil
+		}
+	}
+
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return []byte("t"), nil
+		}
+		return []byte("f"), nil
+	case time.Time:
+		return []byte(v.Format(engine.DateTimeLayout)), nil
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("unexpected value %T", v)
+}
+
+// decodeParam converts a bound parameter into an argument for the engine.
+func decodeParam(oid int, format int, b []byte) (interface{}, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	if format == formatText {
+		switch oid {
+		case oidTimestamp, oidTimestampTz:
+			if t, err := time.Parse(timestampLayout, string(b)); err == nil {
+				return t, nil
+			}
+		}
+		return string(b), nil
+	}
+
+	switch oid {
+	case oidInt8, oidInt4, oidInt2:
+		switch len(b) {
+		case 8:
+			return int64(binary.BigEndian.Uint64(b)), nil
+		case 4:
+			return int64(int32(binary.BigEndian.Uint32(b))), nil
+		case 2:
+			return int64(int16(binary.BigEndian.Uint16(b))), nil
+		}
+	case oidBool:
+		if len(b) == 1 {
+			return b[0] != 0, nil
+		}
+	case oidTimestamp, oidTimestampTz:
+		if len(b) == 8 {
+			us := int64(binary.BigEndian.Uint64(b))
+			return pgEpoch.Add(time.Duration(us) * time.Microsecond), nil
+		}
+	case oidText, oidVarchar, oidUnspecified:
+		return string(b), nil
+	default:
+		return nil, fmt.Errorf("binary format of type %d is not supported", oid)
+	}
+	return nil, fmt.Errorf("invalid binary value of type %d", oid)
+}
@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopicosql/db/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bucketIdleAfter is how long a client may stay silent before its token
+// bucket is forgotten, by then the bucket would be full again anyway.
+const bucketIdleAfter = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client. Buckets hold up to burst
+// tokens and are refilled with rate tokens per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	lock      *sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		lock:    &sync.Mutex{},
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of client. If there is none it
+// returns how long the client should wait for the next one.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastPrune) > bucketIdleAfter {
+		for c, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdleAfter {
+				delete(l.buckets, c)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// admission is a middleware rejecting requests over the per-client rate
+// limit or over MaxRestRequests requests in progress with 429, so excess
+// load is turned away instead of queueing up in front of the engine.
+type admission struct {
+	slots   chan struct{}
+	limiter *rateLimiter
+}
+
+func newAdmission(cfg *engine.Cfg) *admission {
+	a := &admission{}
+	if cfg.MaxRestRequests > 0 {
+		a.slots = make(chan struct{}, cfg.MaxRestRequests)
+	}
+	if cfg.RateLimitPerSec > 0 {
+		a.limiter = newRateLimiter(cfg.RateLimitPerSec, cfg.RateLimitBurst)
+	}
+	return a
+}
+
+func (a *admission) handle(c *gin.Context) {
+	if a.limiter != nil {
+		if ok, wait := a.limiter.allow(c.ClientIP()); !ok {
+			rejectRequest(c, wait, "rate limit exceeded")
+			return
+		}
+	}
+
+	if a.slots != nil {
+		select {
+		case a.slots <- struct{}{}:
+			defer func() { <-a.slots }()
+		default:
+			rejectRequest(c, time.Second, "too many requests in progress")
+			return
+		}
+	}
+	c.Next()
+}
+
+func rejectRequest(c *gin.Context, wait time.Duration, msg string) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	WarningLogger.Printf("Rejected request from %s: %s", c.ClientIP(), msg)
+	c.Header("Retry-After", strconv.Itoa(secs))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"result": "rejected",
+		"error":  msg,
+		"code":   string(engine.ErrTooManyRequests),
+	})
+}
@@ -0,0 +1,53 @@
+package rest
+
+import (
+	"strings"
+
+	"gopicosql/db/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authenticate is a middleware resolving the user of a request either from
+// an API key (X-API-Key or a bearer token) or from HTTP basic credentials.
+// The user travels to the engine with the request context. As long as no
+// user exists all requests are let through.
+func (s *Server) authenticate(c *gin.Context) {
+	if !s.db.AuthEnabled() {
+		c.Next()
+		return
+	}
+
+	user, err := s.requestUser(c)
+	if err != nil {
+		WarningLogger.Printf("Rejected request from %s: %s", c.ClientIP(), err)
+		c.Header("WWW-Authenticate", `Basic realm="gopicosql"`)
+		c.AbortWithStatusJSON(httpStatusOf(err), gin.H{
+			"result": "unauthorized",
+			"error":  err.Error(),
+			"code":   string(engine.ErrorCodeOf(err)),
+		})
+		return
+	}
+
+	c.Request = c.Request.WithContext(engine.WithUser(c.Request.Context(), user))
+	c.Next()
+}
+
+func (s *Server) requestUser(c *gin.Context) (string, error) {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return s.db.AuthenticateKey(key)
+	}
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return s.db.AuthenticateKey(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if name, password, ok := c.Request.BasicAuth(); ok {
+		return name, s.db.Authenticate(name, password)
+	}
+	return "", &engine.Error{Code: engine.ErrInvalidAuthorization, Msg: "authentication required"}
+}
+
+// visibleTo tells whether the request may see the table in listings.
+func (s *Server) visibleTo(c *gin.Context, table string) bool {
+	return s.db.CheckPrivilege(engine.UserFrom(c.Request.Context()), table, engine.PrivSelect) == nil
+}
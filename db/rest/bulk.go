@@ -0,0 +1,264 @@
+package rest
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopicosql/db/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// importTable loads a CSV document into a table. The header row names the
+// columns, columns missing from it are left empty. The import is all or
+// nothing: the records are checked against the schema and inserted by a
+// single statement, if it fails no record is kept. With create=true a
+// missing table is created, column types are inferred from the data, and
+// dropped again if the import fails.
+func (s *Server) importTable(c *gin.Context) {
+	name := c.Param("name")
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(s.cfg.QueryTimeoutSecs)*time.Second)
+	defer cancel()
+
+	body := c.Request.Body
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			s.writeQueryResult(c, engine.QueryResult{Status: "malformed request", Err: &engine.Error{Code: engine.ErrSyntax, Msg: err.Error()}})
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			s.writeQueryResult(c, engine.QueryResult{Status: "malformed request", Err: err})
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	header, records, err := readCsv(body)
+	if err != nil {
+		WarningLogger.Printf("Received malformed CSV for table %s: %s", name, err)
+		s.writeQueryResult(c, engine.QueryResult{Status: "malformed request", Err: err})
+		return
+	}
+	InfoLogger.Printf("Received import of %d records into table %s", len(records), name)
+
+	created := false
+	cols, err := s.db.TableColumns(name)
+	if engine.ErrorCodeOf(err) == engine.ErrUndefinedTable && c.Query("create") == "true" {
+		cols, err = s.createTableFor(ctx, name, header, records)
+		created = err == nil
+	}
+	if err != nil {
+		s.writeQueryResult(c, engine.QueryResult{Status: "Schema error", Err: err})
+		return
+	}
+
+	if err := validateCsv(cols, header, records); err != nil {
+		s.writeQueryResult(c, engine.QueryResult{Status: "Schema error", Err: err})
+		return
+	}
+
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(header)), ", ") + ")"
+	values := make([]string, 0, len(records))
+	args := make([]interface{}, 0, len(records)*len(header))
+	for _, rec := range records {
+		values = append(values, placeholders)
+		for _, v := range rec {
+			args = append(args, v)
+		}
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", name, strings.Join(header, ", "), strings.Join(values, ", "))
+	res, err := s.db.Exec(ctx, query, args...)
+	if err != nil {
+		ErrorLogger.Printf("Import into table %s failed, nothing imported: %s", name, err)
+		if created {
+			if _, err := s.db.Exec(context.Background(), "DROP TABLE "+name); err != nil {
+				ErrorLogger.Printf("Dropping table %s after the failed import: %s", name, err)
+			}
+		}
+		s.writeQueryResult(c, engine.QueryResult{Status: "Import error", Err: err})
+		return
+	}
+	s.writeQueryResult(c, res)
+}
+
+func readCsv(r io.Reader) (header []string, records [][]string, err error) {
+	cr := csv.NewReader(r)
+	header, err = cr.Read()
+	if err == io.EOF {
+		return nil, nil, &engine.Error{Code: engine.ErrSyntax, Msg: "CSV header missing"}
+	}
+	if err != nil {
+		return nil, nil, &engine.Error{Code: engine.ErrSyntax, Msg: err.Error()}
+	}
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	seen := make(map[string]bool)
+	for i, h := range header {
+		header[i] = strings.TrimSpace(h)
+		if !identifierRe.MatchString(header[i]) {
+			return nil, nil, &engine.Error{Code: engine.ErrSyntax, Msg: fmt.Sprintf("invalid column name '%s' in CSV header", h)}
+		}
+		if seen[header[i]] {
+			return nil, nil, &engine.Error{Code: engine.ErrInvalidParameter, Msg: fmt.Sprintf("column %s repeated in CSV header", header[i])}
+		}
+		seen[header[i]] = true
+	}
+
+	records, err = cr.ReadAll()
+	if err != nil {
+		return nil, nil, &engine.Error{Code: engine.ErrSyntax, Msg: err.Error()}
+	}
+	return header, records, nil
+}
+
+// validateCsv checks that every CSV column exists and every value matches
+// its column type. Lines are numbered from the header (line 1).
+func validateCsv(cols []engine.Column, header []string, records [][]string) error {
+	types := make([]engine.FieldType, len(header))
+	for i, h := range header {
+		types[i] = engine.UNKNOWN_FIELD_TYPE
+		for _, col := range cols {
+			if col.Name == h {
+				types[i] = col.Type
+			}
+		}
+		if types[i] == engine.UNKNOWN_FIELD_TYPE {
+			return &engine.Error{Code: engine.ErrUndefinedColumn, Msg: fmt.Sprintf("schema violation: field %s not defined", h)}
+		}
+	}
+	for n, rec := range records {
+		for i, v := range rec {
+			if _, err := engine.ParseValue(types[i], v); err != nil {
+				return &engine.Error{Code: engine.ErrInvalidValue, Msg: fmt.Sprintf("line %d: field %s: %s", n+2, header[i], err)}
+			}
+		}
+	}
+	return nil
+}
+
+// createTableFor creates a table for the CSV columns. A column gets the
+// narrowest type all its non-empty values parse as, TEXT otherwise.
+func (s *Server) createTableFor(ctx context.Context, name string, header []string, records [][]string) ([]engine.Column, error) {
+	if !identifierRe.MatchString(name) {
+		return nil, &engine.Error{Code: engine.ErrSyntax, Msg: fmt.Sprintf("invalid table name '%s'", name)}
+	}
+
+	cols := make([]engine.Column, len(header))
+	defs := make([]string, len(header))
+	for i, h := range header {
+		cols[i] = engine.Column{Name: h, Type: inferType(records, i)}
+		defs[i] = h + " " + cols[i].Type.String()
+	}
+	if _, err := s.db.Exec(ctx, fmt.Sprintf("CREATE TABLE %s (%s)", name, strings.Join(defs, ", "))); err != nil {
+		return nil, err
+	}
+	InfoLogger.Printf("Created table %s (%s)", name, strings.Join(defs, ", "))
+	return cols, nil
+}
+
+func inferType(records [][]string, col int) engine.FieldType {
+	candidates := []engine.FieldType{engine.INT, engine.BOOL, engine.DATETIME}
+	seen := false
+	for _, rec := range records {
+		if rec[col] == "" {
+			continue
+		}
+		seen = true
+		kept := candidates[:0]
+		for _, ft := range candidates {
+			if _, err := engine.ParseValue(ft, rec[col]); err == nil {
+				kept = append(kept, ft)
+			}
+		}
+		candidates = kept
+		if len(candidates) == 0 {
+			break
+		}
+	}
+	if !seen || len(candidates) == 0 {
+		return engine.TEXT
+	}
+	return candidates[0]
+}
+
+// exportTable writes all records of a table as CSV, rows are streamed as
+// they are read.
+func (s *Server) exportTable(c *gin.Context) {
+	name := c.Param("name")
+	if _, err := s.db.TableColumns(name); err != nil {
+		writeTextError(c, mimeCsv, err)
+		return
+	}
+	InfoLogger.Printf("Received export of table %s", name)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(s.cfg.QueryTimeoutSecs)*time.Second)
+	defer cancel()
+	rows, err := s.db.QueryStream(ctx, "SELECT * FROM "+name)
+	if err != nil {
+		writeTextError(c, mimeCsv, err)
+		return
+	}
+	defer rows.Close()
+
+	cols := rows.Columns()
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", mimeCsv+"; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", name))
+
+	w := csv.NewWriter(c.Writer)
+	record := make([]string, len(cols))
+	for i, col := range cols {
+		record[i] = col.Name
+	}
+	w.Write(record)
+	n := 0
+	for rows.Next() {
+		for i, col := range cols {
+			record[i] = rows.Row().Fields[col.Name]
+		}
+		if err := w.Write(record); err != nil {
+			WarningLogger.Printf("Export of table %s aborted: %s", name, err)
+			return
+		}
+		n++
+		if n%flushEvery == 0 {
+			w.Flush()
+			c.Writer.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		WarningLogger.Printf("Export of table %s aborted after %d rows: %s", name, n, err)
+		w.Flush()
+		abortResponse(c)
+		return
+	}
+	w.Flush()
+}
+
+// abortResponse closes the connection of a response whose header was
+// already sent, so the client sees a cut-off transfer instead of a
+// complete but truncated body.
+func abortResponse(c *gin.Context) {
+	// gin panics if the underlying writer can't be hijacked
+	defer func() {
+		if r := recover(); r != nil {
+			WarningLogger.Printf("Response to %s can't be aborted: %v", c.Request.URL.Path, r)
+		}
+	}()
+	conn, _, err := c.Writer.Hijack()
+	if err != nil {
+		WarningLogger.Printf("Response to %s can't be aborted: %s", c.Request.URL.Path, err)
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,189 @@
+package rest
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopicosql/db/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+type outputFormat int
+
+const (
+	formatJson outputFormat = iota
+	formatNdjson
+	formatCsv
+	formatTsv
+	formatText
+)
+
+const (
+	mimeCsv  = "text/csv"
+	mimeTsv  = "text/tab-separated-values"
+	mimeText = "text/plain"
+)
+
+var formatNames = map[string]outputFormat{
+	"json":   formatJson,
+	"ndjson": formatNdjson,
+	"csv":    formatCsv,
+	"tsv":    formatTsv,
+	"text":   formatText,
+	"table":  formatText,
+}
+
+// negotiateFormat picks the response format, an explicit format parameter
+// (query string or request body) wins over the Accept header.
+func negotiateFormat(c *gin.Context, req sqlRequest) (outputFormat, error) {
+	name := c.Query("format")
+	if name == "" {
+		name = req.Format
+	}
+	if name != "" {
+		f, ok := formatNames[strings.ToLower(name)]
+		if !ok {
+			return formatJson, &engine.Error{Code: engine.ErrInvalidParameter, Msg: "unsupported format " + name}
+		}
+		return f, nil
+	}
+
+	return acceptedFormat(c.GetHeader("Accept")), nil
+}
+
+// formatMimes are the media types of the formats, in the order formats are
+// preferred when the Accept header rates them equally.
+var formatMimes = []struct {
+	mime   string
+	format outputFormat
+}{
+	{"application/json", formatJson},
+	{mimeNdjson, formatNdjson},
+	{mimeCsv, formatCsv},
+	{mimeTsv, formatTsv},
+	{mimeText, formatText},
+}
+
+// acceptedFormat picks the format with the highest quality in an Accept
+// header, each rated by the most specific media range matching it. JSON
+// is picked for an empty header or if none of the formats is acceptable.
+func acceptedFormat(accept string) outputFormat {
+	if strings.TrimSpace(accept) == "" {
+		return formatJson
+	}
+	best, bestQ := formatJson, 0.0
+	for _, f := range formatMimes {
+		q, specificity := 0.0, -1
+		for _, r := range strings.Split(accept, ",") {
+			params := strings.Split(r, ";")
+			mime := strings.ToLower(strings.TrimSpace(params[0]))
+			s := -1
+			switch {
+			case mime == f.mime:
+				s = 2
+			case mime == f.mime[:strings.Index(f.mime, "/")]+"/*":
+				s = 1
+			case mime == "*/*":
+				s = 0
+			}
+			if s <= specificity {
+				continue
+			}
+			specificity, q = s, 1
+			for _, p := range params[1:] {
+				p = strings.TrimSpace(p)
+				if len(p) > 2 && strings.EqualFold(p[:2], "q=") {
+					if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+						q = v
+					}
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = f.format, q
+		}
+	}
+	return best
+}
+
+func (s *Server) writeFormatted(c *gin.Context, format outputFormat, qr engine.QueryResult) {
+	switch format {
+	case formatCsv:
+		writeDelimited(c, qr, mimeCsv, ',')
+	case formatTsv:
+		writeDelimited(c, qr, mimeTsv, '\t')
+	case formatText:
+		writeTextTable(c, qr)
+	default:
+		s.writeQueryResult(c, qr)
+	}
+}
+
+// writeTextError reports a failed statement to clients asking for one of
+// the text formats.
+func writeTextError(c *gin.Context, mime string, err error) {
+	c.Data(httpStatusOf(err), mime+"; charset=utf-8",
+		[]byte(fmt.Sprintf("ERROR: %s: %s\n", engine.ErrorCodeOf(err), err)))
+}
+
+// writeDelimited writes a CSV or TSV document with a header row, columns
+// follow the order of the query (schema order for '*').
+func writeDelimited(c *gin.Context, qr engine.QueryResult, mime string, sep rune) {
+	if qr.Err != nil {
+		writeTextError(c, mime, qr.Err)
+		return
+	}
+
+	c.Header("X-Rows-Affected", strconv.Itoa(qr.RowsAffected))
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", mime+"; charset=utf-8")
+
+	record := make([]string, len(qr.Columns))
+	if sep == '\t' {
+		for i, col := range qr.Columns {
+			record[i] = escapeTsv(col.Name)
+		}
+		c.Writer.WriteString(strings.Join(record, "\t") + "\n")
+		for _, r := range qr.Rows {
+			for i, col := range qr.Columns {
+				record[i] = escapeTsv(r.Fields[col.Name])
+			}
+			c.Writer.WriteString(strings.Join(record, "\t") + "\n")
+		}
+		return
+	}
+
+	w := csv.NewWriter(c.Writer)
+	for i, col := range qr.Columns {
+		record[i] = col.Name
+	}
+	w.Write(record)
+	for _, r := range qr.Rows {
+		for i, col := range qr.Columns {
+			record[i] = r.Fields[col.Name]
+		}
+		w.Write(record)
+	}
+	w.Flush()
+}
+
+var tsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+func escapeTsv(s string) string {
+	return tsvEscaper.Replace(s)
+}
+
+// writeTextTable writes the result as an aligned table meant for humans.
+func writeTextTable(c *gin.Context, qr engine.QueryResult) {
+	if qr.Err != nil {
+		writeTextError(c, mimeText, qr.Err)
+		return
+	}
+	var b strings.Builder
+	engine.WriteTable(&b, qr)
+	c.Data(http.StatusOK, mimeText+"; charset=utf-8", []byte(b.String()))
+}
@@ -0,0 +1,91 @@
+package rest
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"gopicosql/db/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version is the version of the build, it's set at link time with
+// -ldflags "-X gopicosql/db/rest.Version=<version>".
+var Version = "dev"
+
+const apiVersion = "1.0"
+
+// engineState returns the state of the engine or "error" if it couldn't
+// be set up.
+func (s *Server) engineState() string {
+	if s.db == nil {
+		return "error"
+	}
+	return s.db.State().String()
+}
+
+// requireEngine answers 503 to the requests needing the engine while it
+// couldn't be set up.
+func (s *Server) requireEngine(c *gin.Context) {
+	if s.db == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"result": "unavailable",
+			"error":  "database engine is not running: " + s.lastLog,
+			"code":   string(engine.ErrShutdown),
+		})
+		return
+	}
+	c.Next()
+}
+
+// queryHealth is the liveness probe, it fails only if the engine is
+// missing or stopped and a restart is the way out.
+func (s *Server) queryHealth(c *gin.Context) {
+	code := http.StatusOK
+	if s.db == nil || s.db.State() == engine.StateStopped {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"status": s.engineState()})
+}
+
+// queryReadiness is the readiness probe, it succeeds only while the engine
+// accepts all kinds of statements.
+func (s *Server) queryReadiness(c *gin.Context) {
+	code := http.StatusOK
+	if s.db == nil || s.db.State() != engine.StateReady {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"status": s.engineState()})
+}
+
+func (s *Server) queryStatus(c *gin.Context) {
+	if s.db == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "error", "last_log": s.lastLog, "version": Version})
+		return
+	}
+
+	lastLog := ""
+	if err := s.db.LastError(); err != nil {
+		lastLog = err.Error()
+	}
+	var lastCompaction interface{}
+	if t := s.db.LastCompaction(); !t.IsZero() {
+		lastCompaction = t.UTC().Format(time.RFC3339)
+	}
+	st := s.db.Stats()
+	c.JSON(http.StatusOK, gin.H{
+		"status":          s.engineState(),
+		"last_log":        lastLog,
+		"last_compaction": lastCompaction,
+		"version":         Version,
+		"uptime_secs":     int64(s.db.Uptime().Seconds()),
+		"tables":          len(st.Tables),
+		"queue_depth":     st.QueueDepth,
+		"workers_busy":    st.WorkersBusy,
+	})
+}
+
+func (s *Server) queryVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"db_version": Version, "API_version": apiVersion, "go_version": runtime.Version()})
+}
@@ -0,0 +1,99 @@
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopicosql/db/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+const mimePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	b bytes.Buffer
+}
+
+func (m *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(&m.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a single sample, labels are given as name, value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.b.WriteString(name)
+	if len(labels) > 0 {
+		m.b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.b.WriteByte(',')
+			}
+			fmt.Fprintf(&m.b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		m.b.WriteByte('}')
+	}
+	m.b.WriteByte(' ')
+	m.b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	m.b.WriteByte('\n')
+}
+
+func (m *metricsWriter) gauge(name, help string, value float64) {
+	m.header(name, "gauge", help)
+	m.sample(name, value)
+}
+
+// queryMetrics reports the engine state, once auth is enabled only to
+// authenticated users and with the series of the tables they may read.
+func (s *Server) queryMetrics(c *gin.Context) {
+	st := s.db.Stats()
+	var m metricsWriter
+
+	m.header("gopicosql_queries_total", "counter", "Statements executed by type and status.")
+	for _, q := range st.Queries {
+		m.sample("gopicosql_queries_total", float64(q.Count), "statement", q.Statement, "status", q.Status)
+	}
+
+	m.header("gopicosql_query_duration_seconds", "histogram", "Statement execution time by type and status.")
+	for _, q := range st.Queries {
+		for i, le := range engine.LatencyBuckets {
+			m.sample("gopicosql_query_duration_seconds_bucket", float64(q.Buckets[i]),
+				"statement", q.Statement, "status", q.Status, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		m.sample("gopicosql_query_duration_seconds_bucket", float64(q.Count),
+			"statement", q.Statement, "status", q.Status, "le", "+Inf")
+		m.sample("gopicosql_query_duration_seconds_sum", q.SumSeconds, "statement", q.Statement, "status", q.Status)
+		m.sample("gopicosql_query_duration_seconds_count", float64(q.Count), "statement", q.Statement, "status", q.Status)
+	}
+
+	m.gauge("gopicosql_request_queue_depth", "Requests waiting for a worker.", float64(st.QueueDepth))
+	m.gauge("gopicosql_request_queue_capacity", "Size of the request queue.", float64(st.QueueCapacity))
+	m.gauge("gopicosql_workers_busy", "Statements being executed.", float64(st.WorkersBusy))
+	m.gauge("gopicosql_workers_capacity", "Size of the worker pool.", float64(st.WorkersCapacity))
+
+	m.header("gopicosql_compaction_duration_seconds", "summary", "Time taken by the periodic compactions.")
+	m.sample("gopicosql_compaction_duration_seconds_sum", st.CompactionSeconds)
+	m.sample("gopicosql_compaction_duration_seconds_count", float64(st.Compactions))
+
+	var tables []engine.TableStats
+	for _, t := range st.Tables {
+		if s.visibleTo(c, t.Name) {
+			tables = append(tables, t)
+		}
+	}
+	m.header("gopicosql_table_rows", "gauge", "Records stored in a table.")
+	for _, t := range tables {
+		m.sample("gopicosql_table_rows", float64(t.Rows), "table", t.Name)
+	}
+	m.header("gopicosql_table_bytes", "gauge", "Approximate memory taken by the records of a table.")
+	for _, t := range tables {
+		m.sample("gopicosql_table_bytes", float64(t.Bytes), "table", t.Name)
+	}
+
+	c.Data(http.StatusOK, mimePrometheus, m.b.Bytes())
+}
@@ -0,0 +1,383 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopicosql/db/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The resource endpoints expose tables and rows as REST resources. Rows
+// are addressed by the value of the first column of the table, the primary
+// key. Every call is translated into a statement run by the engine.
+
+type tableResponse struct {
+	Name       string        `json:"name"`
+	PrimaryKey string        `json:"primary_key"`
+	Columns    []queryColumn `json:"columns"`
+}
+
+type rowObject map[string]interface{}
+
+// filterOps maps the operator of a filter given as 'col[op]=value' onto SQL.
+var filterOps = map[string]string{
+	"eq":  "=",
+	"ne":  "!=",
+	"gt":  ">",
+	"lt":  "<",
+	"gte": ">=",
+	"lte": "<=",
+}
+
+func writeResourceError(c *gin.Context, err error) {
+	c.IndentedJSON(httpStatusOf(err), gin.H{
+		"result": "error",
+		"error":  err.Error(),
+		"code":   string(engine.ErrorCodeOf(err)),
+	})
+}
+
+func newTableResponse(name string, cols []engine.Column) tableResponse {
+	tr := tableResponse{Name: name, Columns: make([]queryColumn, 0, len(cols))}
+	if len(cols) > 0 {
+		tr.PrimaryKey = cols[0].Name
+	}
+	for _, col := range cols {
+		tr.Columns = append(tr.Columns, queryColumn{Name: col.Name, Type: col.Type.String()})
+	}
+	return tr
+}
+
+func (s *Server) listTables(c *gin.Context) {
+	tables := make([]tableResponse, 0)
+	for _, name := range s.db.Tables() {
+		if !s.visibleTo(c, name) {
+			continue
+		}
+		cols, err := s.db.TableColumns(name)
+		if err != nil {
+			// dropped in the meantime
+			continue
+		}
+		tables = append(tables, newTableResponse(name, cols))
+	}
+	c.IndentedJSON(http.StatusOK, tables)
+}
+
+func (s *Server) describeTable(c *gin.Context) {
+	name := c.Param("name")
+	cols, err := s.db.TableColumns(name)
+	if err == nil {
+		err = s.db.CheckPrivilege(engine.UserFrom(c.Request.Context()), name, engine.PrivSelect)
+	}
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, newTableResponse(name, cols))
+}
+
+func (s *Server) resourceCtx(c *gin.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request.Context(), time.Duration(s.cfg.QueryTimeoutSecs)*time.Second)
+}
+
+func columnOf(cols []engine.Column, name string) (engine.Column, error) {
+	for _, col := range cols {
+		if col.Name == name {
+			return col, nil
+		}
+	}
+	return engine.Column{}, &engine.Error{Code: engine.ErrUndefinedColumn, Msg: fmt.Sprintf("schema violation: field %s not defined", name)}
+}
+
+// parseFilters turns query parameters into WHERE conditions, 'col=value'
+// compares for equality, 'col[op]=value' uses one of filterOps.
+func parseFilters(cols []engine.Column, q url.Values) (conds []string, args []interface{}, err error) {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name, op := k, "eq"
+		if i := strings.IndexByte(k, '['); i > 0 && strings.HasSuffix(k, "]") {
+			name, op = k[:i], k[i+1:len(k)-1]
+		}
+		sqlOp, ok := filterOps[op]
+		if !ok {
+			return nil, nil, &engine.Error{Code: engine.ErrInvalidParameter, Msg: fmt.Sprintf("unsupported filter operator %s", op)}
+		}
+		if _, err := columnOf(cols, name); err != nil {
+			return nil, nil, err
+		}
+		for _, v := range q[k] {
+			conds = append(conds, fmt.Sprintf("%s %s ?", name, sqlOp))
+			args = append(args, v)
+		}
+	}
+	return conds, args, nil
+}
+
+func (s *Server) selectRows(ctx context.Context, table string, cols []engine.Column, conds []string, args []interface{}) ([]rowObject, error) {
+	sql := "SELECT * FROM " + table
+	if len(conds) > 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	res, err := s.db.Exec(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]rowObject, 0, len(res.Rows))
+	for _, r := range res.Rows {
+		objs = append(objs, toRowObject(cols, r))
+	}
+	return objs, nil
+}
+
+func toRowObject(cols []engine.Column, r engine.Row) rowObject {
+	obj := make(rowObject, len(cols))
+	for i, v := range typedRow(cols, r) {
+		obj[cols[i].Name] = v
+	}
+	return obj
+}
+
+// readRowObjects reads a single JSON object or an array of them.
+func readRowObjects(c *gin.Context) ([]rowObject, error) {
+	var doc interface{}
+	dec := json.NewDecoder(c.Request.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, &engine.Error{Code: engine.ErrSyntax, Msg: "invalid JSON request: " + err.Error()}
+	}
+
+	items, ok := doc.([]interface{})
+	if !ok {
+		items = []interface{}{doc}
+	}
+	objs := make([]rowObject, 0, len(items))
+	for _, it := range items {
+		obj, ok := it.(map[string]interface{})
+		if !ok || len(obj) == 0 {
+			return nil, &engine.Error{Code: engine.ErrInvalidParameter, Msg: "row objects expected"}
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+func (s *Server) listRows(c *gin.Context) {
+	name := c.Param("name")
+	cols, err := s.db.TableColumns(name)
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+	conds, args, err := parseFilters(cols, c.Request.URL.Query())
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+
+	ctx, cancel := s.resourceCtx(c)
+	defer cancel()
+	objs, err := s.selectRows(ctx, name, cols, conds, args)
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, objs)
+}
+
+// insertRows inserts all objects with a single statement, keys missing
+// from an object are left empty.
+func (s *Server) insertRows(c *gin.Context) {
+	name := c.Param("name")
+	cols, err := s.db.TableColumns(name)
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+	objs, err := readRowObjects(c)
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+
+	used := make(map[string]bool)
+	for _, obj := range objs {
+		for k := range obj {
+			if _, err := columnOf(cols, k); err != nil {
+				writeResourceError(c, err)
+				return
+			}
+			used[k] = true
+		}
+	}
+	var fields []engine.Column
+	for _, col := range cols {
+		if used[col.Name] {
+			fields = append(fields, col)
+		}
+	}
+
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.Name
+	}
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(fields)), ", ") + ")"
+	values := make([]string, 0, len(objs))
+	var args []interface{}
+	for _, obj := range objs {
+		values = append(values, placeholders)
+		for _, f := range fields {
+			args = append(args, obj[f.Name])
+		}
+	}
+
+	ctx, cancel := s.resourceCtx(c)
+	defer cancel()
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", name, strings.Join(names, ", "), strings.Join(values, ", "))
+	if _, err := s.db.Exec(ctx, sql, args...); err != nil {
+		writeResourceError(c, err)
+		return
+	}
+
+	created := make([]rowObject, 0, len(objs))
+	for _, obj := range objs {
+		r := engine.Row{Fields: make(map[string]string, len(cols))}
+		for k, v := range obj {
+			r.Fields[k], _ = engine.FormatValue(v)
+		}
+		created = append(created, toRowObject(cols, r))
+	}
+	if len(created) == 1 {
+		c.Header("Location", fmt.Sprintf("/tables/%s/rows/%s", name, url.PathEscape(primaryKeyOf(cols, objs[0]))))
+		c.IndentedJSON(http.StatusCreated, created[0])
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, created)
+}
+
+// primaryKeyOf returns the primary key of obj as text.
+func primaryKeyOf(cols []engine.Column, obj rowObject) string {
+	v, _ := engine.FormatValue(obj[cols[0].Name])
+	return v
+}
+
+func (s *Server) getRow(c *gin.Context) {
+	name := c.Param("name")
+	cols, err := s.db.TableColumns(name)
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+
+	ctx, cancel := s.resourceCtx(c)
+	defer cancel()
+	obj, err := s.rowByKey(ctx, name, cols, c.Param("pk"))
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, obj)
+}
+
+func (s *Server) rowByKey(ctx context.Context, table string, cols []engine.Column, pk string) (rowObject, error) {
+	objs, err := s.selectRows(ctx, table, cols, []string{cols[0].Name + " = ?"}, []interface{}{pk})
+	if err != nil {
+		return nil, err
+	}
+	if len(objs) == 0 {
+		return nil, &engine.Error{Code: engine.ErrNoData, Msg: fmt.Sprintf("row %s not found in table %s", pk, table)}
+	}
+	return objs[0], nil
+}
+
+func (s *Server) updateRow(c *gin.Context) {
+	name := c.Param("name")
+	cols, err := s.db.TableColumns(name)
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+	objs, err := readRowObjects(c)
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+	if len(objs) != 1 {
+		writeResourceError(c, &engine.Error{Code: engine.ErrInvalidParameter, Msg: "a single row object expected"})
+		return
+	}
+	obj := objs[0]
+
+	var sets []string
+	var args []interface{}
+	for _, col := range cols {
+		if v, ok := obj[col.Name]; ok {
+			sets = append(sets, col.Name+" = ?")
+			args = append(args, v)
+		}
+	}
+	for k := range obj {
+		if _, err := columnOf(cols, k); err != nil {
+			writeResourceError(c, err)
+			return
+		}
+	}
+
+	pk := c.Param("pk")
+	ctx, cancel := s.resourceCtx(c)
+	defer cancel()
+	sql := fmt.Sprintf("UPDATE %s SET %s WHERE %s = ?", name, strings.Join(sets, ", "), cols[0].Name)
+	res, err := s.db.Exec(ctx, sql, append(args, pk)...)
+	if err == nil && res.RowsAffected == 0 {
+		err = &engine.Error{Code: engine.ErrNoData, Msg: fmt.Sprintf("row %s not found in table %s", pk, name)}
+	}
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+
+	if _, ok := obj[cols[0].Name]; ok {
+		pk = primaryKeyOf(cols, obj)
+	}
+	updated, err := s.rowByKey(ctx, name, cols, pk)
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, updated)
+}
+
+func (s *Server) deleteRow(c *gin.Context) {
+	name := c.Param("name")
+	cols, err := s.db.TableColumns(name)
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+
+	pk := c.Param("pk")
+	ctx, cancel := s.resourceCtx(c)
+	defer cancel()
+	res, err := s.db.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s = ?", name, cols[0].Name), pk)
+	if err == nil && res.RowsAffected == 0 {
+		err = &engine.Error{Code: engine.ErrNoData, Msg: fmt.Sprintf("row %s not found in table %s", pk, name)}
+	}
+	if err != nil {
+		writeResourceError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
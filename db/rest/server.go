@@ -1,11 +1,20 @@
 package rest
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"gopicosql/db/engine"
+	"gopicosql/db/mysqlwire"
+	"gopicosql/db/pgwire"
+	"gopicosql/db/rpc"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -28,10 +37,16 @@ func NewServer(cfg *engine.Cfg) (*Server, error) {
 }
 
 type Server struct {
-	cfg     *engine.Cfg
-	db      *engine.DbEngine
-	status  string
+	cfg *engine.Cfg
+	db  *engine.DbEngine
+	// lastLog is the reason the engine couldn't be set up
 	lastLog string
+	// pg serves the PostgreSQL protocol if PgPort is set
+	pg *pgwire.Server
+	// mysql serves the MySQL protocol if MySqlPort is set
+	mysql *mysqlwire.Server
+	// grpc serves the gRPC API if GrpcPort is set
+	grpc *rpc.Server
 }
 
 func (s *Server) setUpDbEng() error {
@@ -44,78 +59,402 @@ func (s *Server) setUpDbEng() error {
 	return nil
 }
 
-func (s *Server) Run() {
-	// configure Gin server
+func (s *Server) setUpRouter() *gin.Engine {
 	router := gin.Default()
-	router.POST("/query", s.execSqlQuery)
+	if err := router.SetTrustedProxies(s.cfg.TrustedProxies); err != nil {
+		ErrorLogger.Printf("Invalid trusted proxies, trusting none: %s", err)
+		router.SetTrustedProxies(nil)
+	}
 	router.GET("/status", s.queryStatus)
 	router.GET("/version", s.queryVersion)
+	router.GET("/healthz", s.queryHealth)
+	router.GET("/readyz", s.queryReadiness)
+	router.GET("/metrics", s.requireEngine, s.authenticate, s.queryMetrics)
+
+	api := router.Group("/", s.requireEngine, newAdmission(s.cfg).handle, s.authenticate)
+	api.POST("/query", s.execSqlQuery)
+	api.POST("/prepare", s.prepareSqlQuery)
+	api.DELETE("/prepare/:handle", s.deallocateSqlQuery)
+	api.GET("/tables", s.listTables)
+	api.GET("/tables/:name", s.describeTable)
+	api.GET("/tables/:name/rows", s.listRows)
+	api.POST("/tables/:name/rows", s.insertRows)
+	api.GET("/tables/:name/rows/:pk", s.getRow)
+	api.PATCH("/tables/:name/rows/:pk", s.updateRow)
+	api.DELETE("/tables/:name/rows/:pk", s.deleteRow)
+	api.POST("/tables/:name/import", s.importTable)
+	api.GET("/tables/:name/export", s.exportTable)
+	return router
+}
+
+// drainTimeout bounds the time requests in progress get to finish once
+// the server is asked to stop.
+const drainTimeout = 30 * time.Second
+
+func (s *Server) Run() {
+	// configure Gin server
+	router := s.setUpRouter()
 
 	err := s.setUpDbEng()
 	if err != nil {
-		s.status = "error"
 		s.lastLog = err.Error()
+		ErrorLogger.Printf("Cannot start database engine: %s", err)
+	}
+
+	addr := fmt.Sprintf("%s:%d", s.cfg.ServHost, s.cfg.ServPort)
+	tlsConfig, err := newTlsConfig(s.cfg)
+	if err != nil {
+		ErrorLogger.Printf("Invalid TLS configuration: %s", err)
+		return
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		ErrorLogger.Printf("Cannot listen on %s: %s", addr, err)
+		return
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+		InfoLogger.Printf("Listening and serving HTTPS on %s", addr)
 	} else {
-		defer s.db.Stop()
-		s.status = "running"
+		InfoLogger.Printf("Listening and serving HTTP on %s", addr)
+	}
+
+	if s.db != nil && s.cfg.PgPort > 0 {
+		s.servePg(tlsConfig)
+	}
+	if s.db != nil && s.cfg.MySqlPort > 0 {
+		s.serveMySql(tlsConfig)
+	}
+	if s.db != nil && s.cfg.GrpcPort > 0 {
+		s.serveGrpc(tlsConfig)
+	}
+
+	srv := &http.Server{Handler: router}
+	drained := make(chan struct{})
+	go s.drainOnSignal(srv, drained)
+
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		ErrorLogger.Printf("Server stopped: %s", err)
+		return
+	}
+	<-drained
+}
+
+// servePg starts the PostgreSQL protocol listener next to the REST API.
+func (s *Server) servePg(tlsConfig *tls.Config) {
+	addr := fmt.Sprintf("%s:%d", s.cfg.ServHost, s.cfg.PgPort)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		ErrorLogger.Printf("Cannot listen on %s: %s", addr, err)
+		return
 	}
+	s.pg = pgwire.NewServer(s.db, s.cfg, tlsConfig)
+	s.pg.ErrorLog = ErrorLogger
+	InfoLogger.Printf("Listening for PostgreSQL connections on %s", addr)
+	go func() {
+		if err := s.pg.Serve(ln); err != pgwire.ErrServerClosed {
+			ErrorLogger.Printf("PostgreSQL listener stopped: %s", err)
+		}
+	}()
+}
 
-	router.Run(fmt.Sprintf("%s:%d", s.cfg.ServHost, s.cfg.ServPort))
+// serveMySql starts the MySQL protocol listener next to the REST API.
+func (s *Server) serveMySql(tlsConfig *tls.Config) {
+	addr := fmt.Sprintf("%s:%d", s.cfg.ServHost, s.cfg.MySqlPort)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		ErrorLogger.Printf("Cannot listen on %s: %s", addr, err)
+		return
+	}
+	s.mysql = mysqlwire.NewServer(s.db, s.cfg, tlsConfig)
+	s.mysql.ErrorLog = ErrorLogger
+	InfoLogger.Printf("Listening for MySQL connections on %s", addr)
+	go func() {
+		if err := s.mysql.Serve(ln); err != mysqlwire.ErrServerClosed {
+			ErrorLogger.Printf("MySQL listener stopped: %s", err)
+		}
+	}()
+}
+
+// serveGrpc starts the gRPC API next to the REST API.
+func (s *Server) serveGrpc(tlsConfig *tls.Config) {
+	addr := fmt.Sprintf("%s:%d", s.cfg.ServHost, s.cfg.GrpcPort)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		ErrorLogger.Printf("Cannot listen on %s: %s", addr, err)
+		return
+	}
+	s.grpc = rpc.NewServer(s.db, s.cfg, tlsConfig)
+	InfoLogger.Printf("Listening for gRPC calls on %s", addr)
+	go func() {
+		if err := s.grpc.Serve(ln); err != nil {
+			ErrorLogger.Printf("gRPC listener stopped: %s", err)
+		}
+	}()
+}
+
+// drainOnSignal waits for SIGINT or SIGTERM, then fails readiness checks,
+// lets requests in progress finish and stops the engine.
+func (s *Server) drainOnSignal(srv *http.Server, drained chan struct{}) {
+	defer close(drained)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	InfoLogger.Printf("Received %s, draining", <-sig)
+
+	if s.db != nil {
+		s.db.Drain()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		WarningLogger.Printf("Requests still in progress after %s: %s", drainTimeout, err)
+	}
+	if s.pg != nil {
+		if err := s.pg.Shutdown(ctx); err != nil {
+			WarningLogger.Printf("PostgreSQL connections still busy after %s: %s", drainTimeout, err)
+		}
+	}
+	if s.mysql != nil {
+		if err := s.mysql.Shutdown(ctx); err != nil {
+			WarningLogger.Printf("MySQL connections still busy after %s: %s", drainTimeout, err)
+		}
+	}
+	if s.grpc != nil {
+		if err := s.grpc.Shutdown(ctx); err != nil {
+			WarningLogger.Printf("gRPC calls still in progress after %s: %s", drainTimeout, err)
+		}
+	}
+	if s.db != nil {
+		s.db.Stop()
+	}
 }
 
 type queryRow struct {
 	Fields map[string]string `json:"fields"`
 }
 
+type queryColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
 type queryResponse struct {
-	Result string     `json:"result"`
-	Error  string     `json:"error"`
-	Rows   []queryRow `json:"rows"`
+	Result       string        `json:"result"`
+	Error        string        `json:"error"`
+	Code         string        `json:"code,omitempty"`
+	RowsAffected int           `json:"rows_affected"`
+	Columns      []queryColumn `json:"columns,omitempty"`
+	Rows         []queryRow    `json:"rows"`
 }
 
-func (s *Server) execSqlQuery(c *gin.Context) {
-	resp := queryResponse{}
-	status := http.StatusOK
+// typedQueryResponse is returned to JSON requests, values in rows follow
+// the order of columns and are encoded as native JSON types.
+type typedQueryResponse struct {
+	Result       string          `json:"result"`
+	Error        string          `json:"error"`
+	Code         string          `json:"code,omitempty"`
+	RowsAffected int             `json:"rows_affected"`
+	Columns      []queryColumn   `json:"columns"`
+	Rows         [][]interface{} `json:"rows"`
+}
 
-	sql := c.PostForm("sql")
+// sqlRequest is the body of /query and /prepare requests, it's read either
+// from form fields or from a JSON document.
+type sqlRequest struct {
+	Sql    string        `json:"sql"`
+	Handle string        `json:"handle"`
+	Params []interface{} `json:"params"`
+	Format string        `json:"format"`
+}
 
-	if sql == "" {
+func isJsonRequest(c *gin.Context) bool {
+	return c.ContentType() == gin.MIMEJSON
+}
+
+func readSqlRequest(c *gin.Context) (sqlRequest, error) {
+	var req sqlRequest
+	if isJsonRequest(c) {
+		dec := json.NewDecoder(c.Request.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			return req, &engine.Error{Code: engine.ErrSyntax, Msg: "invalid JSON request: " + err.Error()}
+		}
+		return req, nil
+	}
+
+	req.Sql = c.PostForm("sql")
+	req.Handle = c.PostForm("handle")
+	req.Format = c.PostForm("format")
+	for _, p := range c.PostFormArray("params") {
+		req.Params = append(req.Params, p)
+	}
+	return req, nil
+}
+
+func (s *Server) execSqlQuery(c *gin.Context) {
+	req, err := readSqlRequest(c)
+	if err != nil {
+		WarningLogger.Printf("Received malformed query request: %s", err)
+		s.writeQueryResult(c, engine.QueryResult{Status: "malformed request", Err: err})
+		return
+	}
+
+	if req.Sql == "" && req.Handle == "" {
 		WarningLogger.Printf("Received empty query request")
-		resp.Result = "empty query request"
-		status = http.StatusBadRequest
-		c.IndentedJSON(status, resp)
+		s.writeQueryResult(c, engine.QueryResult{
+			Status: "empty query request",
+			Err:    &engine.Error{Code: engine.ErrSyntax, Msg: "empty query request"},
+		})
 		return
 	}
 
-	InfoLogger.Printf("Received SQL request: '%s'", sql)
+	if req.Handle != "" {
+		InfoLogger.Printf("Received prepared statement request: '%s' with %d params", req.Handle, len(req.Params))
+	} else {
+		InfoLogger.Printf("Received SQL request: '%s' with %d params", req.Sql, len(req.Params))
+	}
 
-	respChan := make(chan engine.QueryResult)
-	r := engine.QueryRequest{Sql: sql, Resp: respChan}
-	s.db.ProcessQuery(r)
+	format, err := negotiateFormat(c, req)
+	if err != nil {
+		s.writeQueryResult(c, engine.QueryResult{Status: "unsupported format", Err: err})
+		return
+	}
+	if format == formatNdjson {
+		s.streamSqlQuery(c, req)
+		return
+	}
 
-	select {
-	case qr := <-respChan:
-		resp.Result = qr.Status
-		if qr.Err != nil {
-			resp.Error = qr.Err.Error()
-			status = http.StatusBadRequest
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(s.cfg.QueryTimeoutSecs)*time.Second)
+	defer cancel()
+	qr, err := s.db.ExecRequest(ctx, engine.QueryRequest{Sql: req.Sql, Handle: req.Handle, Args: req.Params})
+	if err != nil && qr.Err == nil {
+		// the statement didn't reach the engine or didn't finish in time
+		qr = engine.QueryResult{Status: "query failed", Err: err}
+		if engine.ErrorCodeOf(err) == engine.ErrQueryTimeout {
+			qr.Status = "query timeout"
 		}
-		resp.Rows = make([]queryRow, len(qr.Rows))
+	}
+
+	s.writeFormatted(c, format, qr)
+}
+
+// httpStatusOf maps engine errors onto HTTP response codes.
+func httpStatusOf(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	switch engine.ErrorCodeOf(err) {
+	case engine.ErrSyntax:
+		return http.StatusBadRequest
+	case engine.ErrUndefinedTable, engine.ErrInvalidStatement, engine.ErrNoData:
+		return http.StatusNotFound
+	case engine.ErrInvalidAuthorization:
+		return http.StatusUnauthorized
+	case engine.ErrInsufficientPrivilege:
+		return http.StatusForbidden
+	case engine.ErrDuplicateTable, engine.ErrDuplicateObject, engine.ErrConstraintViolation:
+		return http.StatusConflict
+	case engine.ErrUndefinedColumn, engine.ErrUndefinedObject, engine.ErrInvalidValue,
+		engine.ErrInvalidParameter, engine.ErrWrongParamCount, engine.ErrUndefinedFunction,
+		engine.ErrDatatypeMismatch, engine.ErrDivisionByZero, engine.ErrGrouping:
+		return http.StatusUnprocessableEntity
+	case engine.ErrFeatureNotSupported:
+		return http.StatusNotImplemented
+	case engine.ErrTooManyRequests:
+		return http.StatusTooManyRequests
+	case engine.ErrQueryTimeout, engine.ErrShutdown, engine.ErrReadOnly:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (s *Server) writeQueryResult(c *gin.Context, qr engine.QueryResult) {
+	status := httpStatusOf(qr.Err)
+	errMsg, code := "", ""
+	if qr.Err != nil {
+		errMsg = qr.Err.Error()
+		code = string(engine.ErrorCodeOf(qr.Err))
+	}
+	columns := make([]queryColumn, 0, len(qr.Columns))
+	for _, col := range qr.Columns {
+		columns = append(columns, queryColumn{Name: col.Name, Type: col.Type.String()})
+	}
+
+	if isJsonRequest(c) {
+		resp := typedQueryResponse{Result: qr.Status, Error: errMsg, Code: code, RowsAffected: qr.RowsAffected, Columns: columns}
+		resp.Rows = make([][]interface{}, 0, len(qr.Rows))
 		for _, r := range qr.Rows {
-			resp.Rows = append(resp.Rows, queryRow{Fields: r.Fields})
+			resp.Rows = append(resp.Rows, typedRow(qr.Columns, r))
 		}
-	case <-time.After(time.Duration(s.cfg.QueryTimeoutSecs) * time.Second):
-		resp.Result = "query timeout"
-		status = http.StatusServiceUnavailable
+		c.IndentedJSON(status, resp)
+		return
 	}
 
+	resp := queryResponse{Result: qr.Status, Error: errMsg, Code: code, RowsAffected: qr.RowsAffected, Columns: columns}
+	resp.Rows = make([]queryRow, 0, len(qr.Rows))
+	for _, r := range qr.Rows {
+		resp.Rows = append(resp.Rows, queryRow{Fields: r.Fields})
+	}
 	c.IndentedJSON(status, resp)
 }
 
-func (s *Server) queryStatus(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"status": s.status, "last_log": s.lastLog})
+// typedRow converts row cells into values with JSON friendly types.
+// Cells that don't match their column type are passed on as strings.
+func typedRow(cols []engine.Column, r engine.Row) []interface{} {
+	vals := make([]interface{}, len(cols))
+	for i, col := range cols {
+		cell := r.Fields[col.Name]
+		v, err := engine.ParseValue(col.Type, cell)
+		if err != nil {
+			vals[i] = cell
+			continue
+		}
+		if t, ok := v.(time.Time); ok {
+			v = t.Format(engine.DateTimeLayout)
+		}
+		vals[i] = v
+	}
+	return vals
+}
+
+type prepareResponse struct {
+	Result string `json:"result"`
+	Error  string `json:"error"`
+	Code   string `json:"code,omitempty"`
+	Handle string `json:"handle"`
+	Params int    `json:"params"`
+}
+
+func (s *Server) prepareSqlQuery(c *gin.Context) {
+	req, err := readSqlRequest(c)
+	if err != nil {
+		WarningLogger.Printf("Received malformed prepare request: %s", err)
+		c.IndentedJSON(http.StatusBadRequest, prepareResponse{Result: "malformed request", Error: err.Error(), Code: string(engine.ErrSyntax)})
+		return
+	}
+	sql := req.Sql
+	if sql == "" {
+		WarningLogger.Printf("Received empty prepare request")
+		c.IndentedJSON(http.StatusBadRequest, prepareResponse{Result: "empty query request", Code: string(engine.ErrSyntax)})
+		return
+	}
+
+	InfoLogger.Printf("Received prepare request: '%s'", sql)
+
+	stmt, err := s.db.PrepareContext(c.Request.Context(), sql)
+	if err != nil {
+		c.IndentedJSON(httpStatusOf(err), prepareResponse{Result: "Syntax error", Error: err.Error(), Code: string(engine.ErrorCodeOf(err))})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, prepareResponse{Result: "OK", Handle: stmt.Handle(), Params: stmt.NumParams()})
 }
 
-func (s *Server) queryVersion(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"db_version": "1.0", "API_version": "1.0"})
+func (s *Server) deallocateSqlQuery(c *gin.Context) {
+	handle := c.Param("handle")
+	if !s.db.DeallocateContext(c.Request.Context(), handle) {
+		c.IndentedJSON(http.StatusNotFound, prepareResponse{Result: "not found", Handle: handle, Code: string(engine.ErrInvalidStatement)})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, prepareResponse{Result: "OK", Handle: handle})
 }
@@ -1,12 +1,19 @@
 package rest
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"gopicosql/db/engine"
 
@@ -44,7 +51,7 @@ func TestExecQueryHandlerSelectQueries(t *testing.T) {
 		{"empty query", "", 400},
 		{"invalid query 1", "sql", 400},
 		{"invalid query 2", "select *", 400},
-		{"valid query select", "select * from db", 400},
+		{"valid query select", "select * from db", 404},
 	}
 
 	for _, tc := range tcs {
@@ -62,3 +69,849 @@ func TestExecQueryHandlerSelectQueries(t *testing.T) {
 		})
 	}
 }
+
+func postForm(router http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestParamsAndPreparedStatements(t *testing.T) {
+	s, _ := NewServer(engine.NewConfigDefault())
+	s.setUpDbEng()
+	defer s.db.Stop()
+	router := s.setUpRouter()
+
+	w := postForm(router, "/query", url.Values{"sql": {"CREATE TABLE t (id INT, name TEXT)"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected code %d: %s", w.Code, w.Body.String())
+	}
+	w = postForm(router, "/query", url.Values{
+		"sql":    {"INSERT INTO t (id, name) VALUES (?, ?)"},
+		"params": {"1", "it's"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected code %d: %s", w.Code, w.Body.String())
+	}
+
+	w = postForm(router, "/prepare", url.Values{"sql": {"SELECT name FROM t WHERE id = $1"}})
+	var pr prepareResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &pr); err != nil || w.Code != http.StatusOK || pr.Params != 1 {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	w = postForm(router, "/query", url.Values{"handle": {pr.Handle}, "params": {"1"}})
+	var qr queryResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &qr); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if len(qr.Rows) != 1 || qr.Rows[0].Fields["name"] != "it's" {
+		t.Errorf("Unexpected rows %v", qr.Rows)
+	}
+
+	w = postForm(router, "/query", url.Values{"handle": {pr.Handle}})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected code 422 on missing params, got %d", w.Code)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, "/prepare/"+pr.Handle, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected code %d: %s", w.Code, w.Body.String())
+	}
+	w = postForm(router, "/query", url.Values{"handle": {pr.Handle}, "params": {"1"}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected code 404 on deallocated statement, got %d", w.Code)
+	}
+}
+
+func TestErrorStatusCodes(t *testing.T) {
+	s, _ := NewServer(engine.NewConfigDefault())
+	s.setUpDbEng()
+	defer s.db.Stop()
+	router := s.setUpRouter()
+
+	tcs := []struct {
+		sql  string
+		resp int
+		code engine.ErrorCode
+	}{
+		{"CREATE TABLE t (id INT)", http.StatusOK, ""},
+		{"CREATE TABLE t (id INT)", http.StatusConflict, engine.ErrDuplicateTable},
+		{"SELECT * FROM nope", http.StatusNotFound, engine.ErrUndefinedTable},
+		{"SELECT nope FROM t", http.StatusUnprocessableEntity, engine.ErrUndefinedColumn},
+		{"INSERT INTO t (id) VALUES ('x')", http.StatusUnprocessableEntity, engine.ErrInvalidValue},
+		{"SELECT", http.StatusBadRequest, engine.ErrSyntax},
+	}
+
+	for _, tc := range tcs {
+		w := postForm(router, "/query", url.Values{"sql": {tc.sql}})
+		var qr queryResponse
+		json.Unmarshal(w.Body.Bytes(), &qr)
+		if w.Code != tc.resp || qr.Code != string(tc.code) {
+			t.Errorf("%s: expected %d/%s, got %d/%s", tc.sql, tc.resp, tc.code, w.Code, qr.Code)
+		}
+	}
+}
+
+func postJson(router http.Handler, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestJsonQuery(t *testing.T) {
+	s, _ := NewServer(engine.NewConfigDefault())
+	s.setUpDbEng()
+	defer s.db.Stop()
+	router := s.setUpRouter()
+
+	for _, body := range []string{
+		`{"sql": "CREATE TABLE t (id INT, name TEXT, ok BOOL, at DATETIME)"}`,
+		`{"sql": "INSERT INTO t (id, name, ok, at) VALUES ($1, $2, $3, $4)", "params": [12345678901, "a", true, "2022-01-06"]}`,
+		`{"sql": "INSERT INTO t (id, name) VALUES (?, ?)", "params": [2, "b"]}`,
+	} {
+		if w := postJson(router, "/query", body); w.Code != http.StatusOK {
+			t.Fatalf("Unexpected code %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	w := postJson(router, "/query", `{"sql": "SELECT * FROM t WHERE id = ?", "params": [12345678901]}`)
+	exp := `{"result":"OK","error":"","rows_affected":0,"columns":[{"name":"id","type":"INT"},{"name":"name","type":"TEXT"},` +
+		`{"name":"ok","type":"BOOL"},{"name":"at","type":"DATETIME"}],"rows":[[12345678901,"a",true,"2022-01-06 00:00:00"]]}`
+	var got, want interface{}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	json.Unmarshal([]byte(exp), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %s, got %s", exp, w.Body.String())
+	}
+
+	w = postJson(router, "/query", `{"sql": "SELECT ok, at FROM t WHERE id = '2'"}`)
+	var tr typedQueryResponse
+	json.Unmarshal(w.Body.Bytes(), &tr)
+	if len(tr.Rows) != 1 || tr.Rows[0][0] != nil || tr.Rows[0][1] != nil {
+		t.Errorf("Expected nulls, got %s", w.Body.String())
+	}
+
+	if w := postJson(router, "/query", `{"sql": `); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected code 400 on malformed request, got %d", w.Code)
+	}
+}
+
+func TestNdjsonStreaming(t *testing.T) {
+	s, _ := NewServer(engine.NewConfigDefault())
+	s.setUpDbEng()
+	defer s.db.Stop()
+	router := s.setUpRouter()
+
+	postForm(router, "/query", url.Values{"sql": {"CREATE TABLE t (id INT, name TEXT)"}})
+	for i := 0; i < 250; i++ {
+		postForm(router, "/query", url.Values{
+			"sql":    {"INSERT INTO t (id, name) VALUES (?, ?)"},
+			"params": {strconv.Itoa(i), "n" + strconv.Itoa(i)},
+		})
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/query", strings.NewReader(`{"sql": "SELECT id, name FROM t"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/x-ndjson")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 251 {
+		t.Fatalf("Expected 251 lines, got %d", len(lines))
+	}
+	var header streamHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || len(header.Columns) != 2 {
+		t.Errorf("Unexpected header %s", lines[0])
+	}
+	var row []interface{}
+	if err := json.Unmarshal([]byte(lines[250]), &row); err != nil || len(row) != 2 || row[1] != "n249" {
+		t.Errorf("Unexpected row %s", lines[250])
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/query", strings.NewReader(url.Values{"sql": {"SELECT * FROM nope"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/x-ndjson")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), string(engine.ErrUndefinedTable)) {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body.String())
+	}
+	// an expression failing midway ends the stream with an error line
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/query", strings.NewReader(url.Values{"sql": {"SELECT 10 / (id - 5) AS x FROM t"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/x-ndjson")
+	router.ServeHTTP(w, req)
+	lines = strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	var last streamHeader
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil || len(lines) != 7 || last.Result != "error" || last.Code != string(engine.ErrDivisionByZero) {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAcceptedFormat(t *testing.T) {
+	tcs := []struct {
+		accept string
+		format outputFormat
+	}{
+		{"", formatJson},
+		{"*/*", formatJson},
+		{"application/json, text/plain, */*", formatJson},
+		{"text/csv, */*", formatJson},
+		{"text/csv, */*;q=0.8", formatCsv},
+		{"text/*", formatCsv},
+		{"text/plain;q=0.5, text/tab-separated-values", formatTsv},
+		{"application/x-ndjson", formatNdjson},
+		{"application/json;q=0.1, application/x-ndjson", formatNdjson},
+		{"TEXT/PLAIN; charset=utf-8", formatText},
+		{"text/csv;q=0, text/*;q=0.9", formatTsv},
+		{"image/png", formatJson},
+	}
+	for _, tc := range tcs {
+		if got := acceptedFormat(tc.accept); got != tc.format {
+			t.Errorf("%q: expected format %d, got %d", tc.accept, tc.format, got)
+		}
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	s, _ := NewServer(engine.NewConfigDefault())
+	s.setUpDbEng()
+	defer s.db.Stop()
+	router := s.setUpRouter()
+
+	postForm(router, "/query", url.Values{"sql": {"CREATE TABLE t (id INT, name TEXT, ok BOOL)"}})
+	postForm(router, "/query", url.Values{"sql": {"INSERT INTO t (name, id, ok) VALUES ('a, \"b\"', '1', 'true'), ('tab\there', '10', 'false')"}})
+
+	query := func(path, accept string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	sel := url.Values{"sql": {"SELECT * FROM t"}}
+
+	tcs := []struct {
+		name   string
+		path   string
+		accept string
+		form   url.Values
+		code   int
+		body   string
+	}{
+		{"csv accept", "/query", "text/csv", sel, http.StatusOK,
+			"id,name,ok\n1,\"a, \"\"b\"\"\",true\n10,tab\there,false\n"},
+		{"tsv param", "/query?format=tsv", "", sel, http.StatusOK,
+			"id\tname\tok\n1\ta, \"b\"\ttrue\n10\ttab\\there\tfalse\n"},
+		{"text param wins over accept", "/query?format=text", "text/csv", sel, http.StatusOK,
+			" id | name      | ok\n----+-----------+-------\n  1 | a, \"b\"    | true\n 10 | tab\\there | false\n(2 rows)\n"},
+		{"form format", "/query", "", url.Values{"sql": {"SELECT id FROM t WHERE id = '1'"}, "format": {"table"}}, http.StatusOK,
+			" id\n----\n  1\n(1 row)\n"},
+		{"csv error", "/query?format=csv", "", url.Values{"sql": {"SELECT * FROM nope"}}, http.StatusNotFound,
+			"ERROR: 42P01: table nope does not exist\n"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			w := query(tc.path, tc.accept, tc.form)
+			if w.Code != tc.code || w.Body.String() != tc.body {
+				t.Errorf("Expected %d %q, got %d %q", tc.code, tc.body, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if w := query("/query?format=xml", "", sel); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 on unsupported format, got %d", w.Code)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	s, _ := NewServer(engine.NewConfigDefault())
+	s.setUpDbEng()
+	defer s.db.Stop()
+	router := s.setUpRouter()
+
+	importCsv := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/csv")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var b strings.Builder
+	b.WriteString("id,name,active,created\n")
+	for i := 0; i < 205; i++ {
+		fmt.Fprintf(&b, "%d,\"name, %d\",%t,2022-01-0%d 10:00:00\n", i, i, i%2 == 0, i%9+1)
+	}
+	b.WriteString("999,,,\n")
+
+	if w := importCsv("/tables/users/import", b.String()); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing table, got %d", w.Code)
+	}
+	w := importCsv("/tables/users/import?create=true", b.String())
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"rows_affected": 206`) {
+		t.Fatalf("Unexpected import response %d: %s", w.Code, w.Body.String())
+	}
+
+	cols, err := s.db.TableColumns("users")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := []engine.Column{
+		{Name: "id", Type: engine.INT},
+		{Name: "name", Type: engine.TEXT},
+		{Name: "active", Type: engine.BOOL},
+		{Name: "created", Type: engine.DATETIME},
+	}
+	if !reflect.DeepEqual(cols, want) {
+		t.Errorf("Expected inferred columns %v, got %v", want, cols)
+	}
+
+	tcs := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"invalid value", "id,name\n1,a\nx,b\n", http.StatusUnprocessableEntity},
+		{"unknown column", "id,nope\n1,a\n", http.StatusUnprocessableEntity},
+		{"ragged record", "id,name\n1,a,b\n", http.StatusBadRequest},
+		{"empty document", "", http.StatusBadRequest},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := importCsv("/tables/users/import", tc.body); w.Code != tc.code {
+				t.Errorf("Expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// a rejected document must not be partially imported
+	w = importCsv("/tables/users/import", "id,name\n1000,a\nx,b\n")
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "line 3") {
+		t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	// nor one failing once inserted, a created table is dropped again
+	w = importCsv("/tables/users/import", "id,name\n1000,a\n5,b\n")
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate key, got %d: %s", w.Code, w.Body.String())
+	}
+	w = importCsv("/tables/dups/import?create=true", "id,name\n1,a\n1,b\n")
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate key, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := s.db.TableColumns("dups"); engine.ErrorCodeOf(err) != engine.ErrUndefinedTable {
+		t.Errorf("Expected the table of a failed import to be dropped, got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/tables/users/export", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected export response %d: %s", w.Code, w.Body.String())
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 207 || lines[0] != "id,name,active,created" || lines[1] != "0,\"name, 0\",true,2022-01-01 10:00:00" {
+		t.Errorf("Unexpected export of %d lines, starting with %q", len(lines), lines[:2])
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/tables/nope/export", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+}
+
+func TestAbortResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		c.Writer.WriteString("id,name\n1,a\n")
+		c.Writer.Flush()
+		abortResponse(c)
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != io.ErrUnexpectedEOF || string(body) != "id,name\n1,a\n" {
+		t.Errorf("Expected a cut-off body, got %q and %v", body, err)
+	}
+
+	// without a connection to close the response is left as it is
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Body.String() != "id,name\n1,a\n" {
+		t.Errorf("Unexpected body %q", w.Body.String())
+	}
+}
+
+func TestResourceEndpoints(t *testing.T) {
+	s, _ := NewServer(engine.NewConfigDefault())
+	s.setUpDbEng()
+	defer s.db.Stop()
+	router := s.setUpRouter()
+
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", gin.MIMEJSON)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	postForm(router, "/query", url.Values{"sql": {"CREATE TABLE users (id INT, name TEXT, active BOOL)"}})
+
+	w := call(http.MethodGet, "/tables", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"primary_key": "id"`) {
+		t.Errorf("Unexpected tables %d: %s", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodGet, "/tables/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+
+	w = call(http.MethodPost, "/tables/users/rows", `{"id": 1, "name": "alice", "active": true}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/tables/users/rows/1" {
+		t.Errorf("Unexpected insert %d %v: %s", w.Code, w.Header(), w.Body.String())
+	}
+	w = call(http.MethodPost, "/tables/users/rows", `[{"id": 2, "name": "bob"}, {"id": 3, "name": "carol", "active": false}]`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Unexpected insert %d: %s", w.Code, w.Body.String())
+	}
+
+	list := func(path string) []map[string]interface{} {
+		w := call(http.MethodGet, path, "")
+		var objs []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &objs); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+		}
+		return objs
+	}
+	if objs := list("/tables/users/rows"); len(objs) != 3 {
+		t.Errorf("Expected 3 rows, got %v", objs)
+	}
+	if objs := list("/tables/users/rows?id[gte]=2&name[ne]=bob"); len(objs) != 1 || objs[0]["name"] != "carol" || objs[0]["active"] != false {
+		t.Errorf("Unexpected filtered rows %v", objs)
+	}
+
+	w = call(http.MethodGet, "/tables/users/rows/2", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name": "bob"`) || !strings.Contains(w.Body.String(), `"active": null`) {
+		t.Errorf("Unexpected row %d: %s", w.Code, w.Body.String())
+	}
+
+	w = call(http.MethodPatch, "/tables/users/rows/2", `{"active": true}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"active": true`) {
+		t.Errorf("Unexpected update %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := call(http.MethodDelete, "/tables/users/rows/2", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", w.Code)
+	}
+
+	tcs := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"deleted row", http.MethodGet, "/tables/users/rows/2", "", http.StatusNotFound},
+		{"delete missing row", http.MethodDelete, "/tables/users/rows/2", "", http.StatusNotFound},
+		{"patch missing row", http.MethodPatch, "/tables/users/rows/2", `{"name": "x"}`, http.StatusNotFound},
+		{"unknown filter column", http.MethodGet, "/tables/users/rows?nope=1", "", http.StatusUnprocessableEntity},
+		{"unknown filter operator", http.MethodGet, "/tables/users/rows?id[like]=1", "", http.StatusUnprocessableEntity},
+		{"unknown column", http.MethodPost, "/tables/users/rows", `{"nope": 1}`, http.StatusUnprocessableEntity},
+		{"invalid value", http.MethodPost, "/tables/users/rows", `{"id": "x"}`, http.StatusUnprocessableEntity},
+		{"not an object", http.MethodPost, "/tables/users/rows", `[1]`, http.StatusUnprocessableEntity},
+		{"malformed JSON", http.MethodPost, "/tables/users/rows", `{`, http.StatusBadRequest},
+		{"duplicate key", http.MethodPost, "/tables/users/rows", `{"id": 1, "name": "again"}`, http.StatusConflict},
+		{"patch to a duplicate key", http.MethodPatch, "/tables/users/rows/3", `{"id": 1}`, http.StatusConflict},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := call(tc.method, tc.path, tc.body); w.Code != tc.code {
+				t.Errorf("Expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	cfg := engine.NewConfigDefault()
+	cfg.DbDir = t.TempDir()
+	s, _ := NewServer(cfg)
+	s.setUpDbEng()
+	defer s.db.Stop()
+	router := s.setUpRouter()
+
+	postForm(router, "/query", url.Values{"sql": {"CREATE TABLE t (id INT)"}})
+	s.db.CreateUser("admin", "adminpw", true)
+	s.db.CreateUser("bob", "bobpw", false)
+	key, _ := s.db.CreateApiKey("bob")
+
+	query := func(sql string, auth func(*http.Request)) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/query", strings.NewReader(url.Values{"sql": {sql}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if auth != nil {
+			auth(req)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	basic := func(user, password string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	apiKey := func(r *http.Request) { r.Header.Set("X-API-Key", key) }
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+key) }
+
+	tcs := []struct {
+		name string
+		sql  string
+		auth func(*http.Request)
+		code int
+	}{
+		{"anonymous", "SELECT * FROM t", nil, http.StatusUnauthorized},
+		{"wrong password", "SELECT * FROM t", basic("admin", "nope"), http.StatusUnauthorized},
+		{"invalid key", "SELECT * FROM t", func(r *http.Request) { r.Header.Set("X-API-Key", "gpk_x") }, http.StatusUnauthorized},
+		{"superuser", "SELECT * FROM t", basic("admin", "adminpw"), http.StatusOK},
+		{"no grant", "SELECT * FROM t", apiKey, http.StatusForbidden},
+		{"grant by user", "GRANT SELECT ON t TO bob", apiKey, http.StatusForbidden},
+		{"grant by superuser", "GRANT SELECT ON t TO bob", basic("admin", "adminpw"), http.StatusOK},
+		{"granted", "SELECT * FROM t", bearer, http.StatusOK},
+		{"not granted", "DROP TABLE t", basic("bob", "bobpw"), http.StatusForbidden},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := query(tc.sql, tc.auth); w.Code != tc.code {
+				t.Errorf("Expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// the privileges are enforced for the resource endpoints too
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodDelete, "/tables/t/rows/1", nil)
+	apiKey(req)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+
+	// prepared statements can only be used by the user who prepared them
+	call := func(method, path string, form url.Values, auth func(*http.Request)) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		auth(req)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w = call(http.MethodPost, "/prepare", url.Values{"sql": {"SELECT * FROM t"}}, apiKey)
+	var prep prepareResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &prep); err != nil || prep.Handle == "" {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	admin := basic("admin", "adminpw")
+	if w := call(http.MethodPost, "/query", url.Values{"handle": {prep.Handle}}, admin); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodDelete, "/prepare/"+prep.Handle, nil, admin); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+	if w := call(http.MethodPost, "/query", url.Values{"handle": {prep.Handle}}, apiKey); w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := call(http.MethodDelete, "/prepare/"+prep.Handle, nil, apiKey); w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/status", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected /status to stay public, got %d", w.Code)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(1, 2)
+	l.now = func() time.Time { return now }
+
+	expect := func(allowed bool, wait time.Duration) {
+		t.Helper()
+		ok, w := l.allow("client")
+		if ok != allowed || w != wait {
+			t.Errorf("Expected %t/%s, got %t/%s", allowed, wait, ok, w)
+		}
+	}
+	expect(true, 0)
+	expect(true, 0)
+	expect(false, time.Second)
+	now = now.Add(500 * time.Millisecond)
+	expect(false, 500*time.Millisecond)
+	now = now.Add(500 * time.Millisecond)
+	expect(true, 0)
+
+	if ok, _ := l.allow("other"); !ok {
+		t.Errorf("Expected clients to have separate buckets")
+	}
+	now = now.Add(bucketIdleAfter * 2)
+	l.allow("client")
+	if _, ok := l.buckets["other"]; ok {
+		t.Errorf("Expected an idle bucket to be pruned")
+	}
+}
+
+func TestAdmissionControl(t *testing.T) {
+	cfg := engine.NewConfigDefault()
+	cfg.MaxRestRequests = 1
+	router := gin.New()
+	started, release := make(chan struct{}), make(chan struct{})
+	router.GET("/slow", newAdmission(cfg).handle, func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+	})
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/slow", nil)
+		router.ServeHTTP(w, req)
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/slow", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", code)
+	}
+
+	// the slot is released once the request is done
+	go func() { <-started }()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+
+	cfg = engine.NewConfigDefault()
+	cfg.RateLimitPerSec = 0.5
+	cfg.RateLimitBurst = 1
+	s, _ := NewServer(cfg)
+	s.setUpDbEng()
+	defer s.db.Stop()
+	router = s.setUpRouter()
+	if w := postForm(router, "/query", url.Values{"sql": {"CREATE TABLE t (id INT)"}}); w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	w = postForm(router, "/query", url.Values{"sql": {"SELECT * FROM t"}})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected 429 with Retry-After 2, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestRateLimitClientAddress(t *testing.T) {
+	cfg := engine.NewConfigDefault()
+	cfg.RateLimitPerSec = 0.5
+	cfg.RateLimitBurst = 1
+	s, _ := NewServer(cfg)
+	s.setUpDbEng()
+	defer s.db.Stop()
+
+	get := func(router http.Handler, forwardedFor string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/tables", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// a client can't get a fresh bucket by making up the header
+	router := s.setUpRouter()
+	if code := get(router, "10.0.0.1"); code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", code)
+	}
+	if code := get(router, "10.0.0.2"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", code)
+	}
+
+	// behind a trusted proxy the header tells clients apart
+	cfg.TrustedProxies = []string{"192.0.2.0/24"}
+	router = s.setUpRouter()
+	if code := get(router, "10.0.0.1"); code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", code)
+	}
+	if code := get(router, "10.0.0.2"); code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", code)
+	}
+	if code := get(router, "10.0.0.2"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cfg := engine.NewConfigDefault()
+	cfg.DbDir = t.TempDir()
+	s, _ := NewServer(cfg)
+	s.setUpDbEng()
+	defer s.db.Stop()
+	router := s.setUpRouter()
+
+	postForm(router, "/query", url.Values{"sql": {"CREATE TABLE t (id INT, name TEXT)"}})
+	postForm(router, "/query", url.Values{"sql": {"INSERT INTO t (id, name) VALUES ('1', 'a'), ('2', 'bb')"}})
+	postForm(router, "/query", url.Values{"sql": {"SELECT * FROM nope"}})
+	postForm(router, "/query", url.Values{"sql": {"SELEC"}})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Unexpected response %d %v", w.Code, w.Header())
+	}
+
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE gopicosql_query_duration_seconds histogram",
+		`gopicosql_queries_total{statement="insert",status="ok"} 1`,
+		`gopicosql_queries_total{statement="select",status="42P01"} 1`,
+		`gopicosql_queries_total{statement="unknown",status="42601"} 1`,
+		`gopicosql_query_duration_seconds_bucket{statement="create",status="ok",le="+Inf"} 1`,
+		`gopicosql_query_duration_seconds_count{statement="create",status="ok"} 1`,
+		"gopicosql_request_queue_capacity 10",
+		"gopicosql_workers_capacity 20",
+		"# TYPE gopicosql_compaction_duration_seconds summary",
+		"gopicosql_compaction_duration_seconds_count 0",
+		`gopicosql_table_rows{table="t"} 2`,
+		`gopicosql_table_bytes{table="t"} 117`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected line %q in:\n%s", line, body)
+		}
+	}
+
+	// with auth enabled users only see the tables they may read
+	s.db.CreateUser("admin", "pw", true)
+	s.db.CreateUser("bob", "pw", false)
+	metrics := func(user string) (int, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+		if user != "" {
+			req.SetBasicAuth(user, "pw")
+		}
+		router.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	if code, _ := metrics(""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d", code)
+	}
+	if code, body := metrics("bob"); code != http.StatusOK || strings.Contains(body, `table="t"`) {
+		t.Errorf("Unexpected response %d:\n%s", code, body)
+	}
+	if code, body := metrics("admin"); code != http.StatusOK || !strings.Contains(body, `gopicosql_table_rows{table="t"} 2`) {
+		t.Errorf("Unexpected response %d:\n%s", code, body)
+	}
+}
+
+func TestHealthAndStatus(t *testing.T) {
+	cfg := engine.NewConfigDefault()
+	cfg.DbDir = filepath.Join(t.TempDir(), "missing")
+	s, _ := NewServer(cfg)
+	s.setUpDbEng()
+	router := s.setUpRouter()
+
+	get := func(path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		router.ServeHTTP(w, req)
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+	expect := func(path string, code int, status string) {
+		t.Helper()
+		if c, body := get(path); c != code || body["status"] != status {
+			t.Errorf("%s: expected %d %s, got %d %v", path, code, status, c, body)
+		}
+	}
+
+	postForm(router, "/query", url.Values{"sql": {"CREATE TABLE t (id INT)"}})
+	expect("/healthz", http.StatusOK, "ready")
+	expect("/readyz", http.StatusOK, "ready")
+	if _, body := get("/status"); body["tables"] != float64(1) || body["version"] != Version || body["uptime_secs"] == nil {
+		t.Errorf("Unexpected status %v", body)
+	}
+	if _, body := get("/status"); body["last_compaction"] != nil {
+		t.Errorf("Expected no compaction yet, got %v", body["last_compaction"])
+	}
+	if _, body := get("/version"); body["db_version"] != Version {
+		t.Errorf("Unexpected version %v", body)
+	}
+
+	// DbDir doesn't exist, so saving users fails and the engine goes read-only
+	if err := s.db.CreateUser("admin", "pw", true); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	expect("/healthz", http.StatusOK, "read-only")
+	expect("/readyz", http.StatusServiceUnavailable, "read-only")
+	if _, body := get("/status"); body["last_log"] == "" {
+		t.Errorf("Expected the disk error in status, got %v", body)
+	}
+	if w := postForm(router, "/query", url.Values{"sql": {"INSERT INTO t (id) VALUES ('1')"}}); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected writes to be rejected, got %d", w.Code)
+	}
+	if w := postForm(router, "/query", url.Values{"sql": {"SELECT * FROM t"}}); w.Code != http.StatusOK {
+		t.Errorf("Expected reads to work, got %d", w.Code)
+	}
+
+	s.db.Drain()
+	expect("/healthz", http.StatusOK, "draining")
+	expect("/readyz", http.StatusServiceUnavailable, "draining")
+	s.db.Stop()
+	expect("/healthz", http.StatusServiceUnavailable, "stopped")
+
+	// the engine couldn't be set up
+	s.db, s.lastLog = nil, "disk on fire"
+	expect("/healthz", http.StatusServiceUnavailable, "error")
+	if _, body := get("/status"); body["status"] != "error" || body["last_log"] != "disk on fire" {
+		t.Errorf("Unexpected status %v", body)
+	}
+	for _, path := range []string{"/tables", "/metrics"} {
+		if code, body := get(path); code != http.StatusServiceUnavailable || body["code"] != string(engine.ErrShutdown) {
+			t.Errorf("%s: expected 503, got %d %v", path, code, body)
+		}
+	}
+	if w := postForm(router, "/query", url.Values{"sql": {"SELECT * FROM t"}}); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+}
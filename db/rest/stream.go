@@ -0,0 +1,80 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gopicosql/db/engine"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mimeNdjson = "application/x-ndjson"
+	// flushEvery is the number of streamed rows buffered before being
+	// flushed to the client.
+	flushEvery = 100
+)
+
+// streamHeader is the first line of a NDJSON response, every following line
+// is a row encoded as in typedQueryResponse.Rows. If the query fails midway
+// a last line with the error is sent.
+type streamHeader struct {
+	Result  string        `json:"result"`
+	Error   string        `json:"error"`
+	Code    string        `json:"code,omitempty"`
+	Columns []queryColumn `json:"columns"`
+}
+
+// streamSqlQuery runs the query and writes rows to the client as they are
+// read from the table. Rows are produced no faster than the client reads
+// them, the whole transfer is bounded by the query timeout.
+func (s *Server) streamSqlQuery(c *gin.Context, req sqlRequest) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(s.cfg.QueryTimeoutSecs)*time.Second)
+	defer cancel()
+
+	rows, err := s.db.OpenStream(ctx, engine.QueryRequest{Sql: req.Sql, Handle: req.Handle, Args: req.Params})
+	if err != nil {
+		c.Status(httpStatusOf(err))
+		c.Header("Content-Type", mimeNdjson)
+		json.NewEncoder(c.Writer).Encode(streamHeader{
+			Result: "error",
+			Error:  err.Error(),
+			Code:   string(engine.ErrorCodeOf(err)),
+		})
+		return
+	}
+	defer rows.Close()
+
+	cols := rows.Columns()
+	header := streamHeader{Result: "OK", Columns: make([]queryColumn, 0, len(cols))}
+	for _, col := range cols {
+		header.Columns = append(header.Columns, queryColumn{Name: col.Name, Type: col.Type.String()})
+	}
+
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", mimeNdjson)
+	enc := json.NewEncoder(c.Writer)
+	if err := enc.Encode(header); err != nil {
+		return
+	}
+
+	n := 0
+	for rows.Next() {
+		if err := enc.Encode(typedRow(cols, rows.Row())); err != nil {
+			WarningLogger.Printf("Streaming aborted: %s", err)
+			return
+		}
+		n++
+		if n%flushEvery == 0 {
+			c.Writer.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		WarningLogger.Printf("Streaming aborted after %d rows: %s", n, err)
+		enc.Encode(streamHeader{Result: "error", Error: err.Error(), Code: string(engine.ErrorCodeOf(err))})
+	}
+	c.Writer.Flush()
+}
@@ -0,0 +1,122 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gopicosql/db/engine"
+)
+
+// certReloader serves the certificate and client CAs configured in Cfg and
+// reloads them as soon as any of the files is modified, so rotated
+// certificates are picked up without a restart. Failed reloads keep the
+// previous files in use.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	lock    *sync.Mutex
+	modTime time.Time
+	config  *tls.Config
+}
+
+func newCertReloader(cfg *engine.Cfg) (*certReloader, error) {
+	r := &certReloader{
+		certFile: cfg.TlsCertFile,
+		keyFile:  cfg.TlsKeyFile,
+		caFile:   cfg.TlsClientCAFile,
+		lock:     &sync.Mutex{},
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestModTime returns the most recent modification time of the files.
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f == "" {
+			continue
+		}
+		st, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.modTime = modTime
+	r.config = config
+	return nil
+}
+
+// configForClient is used as tls.Config.GetConfigForClient, every handshake
+// checks whether the files changed since they were loaded.
+func (r *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err == nil && modTime.After(r.modTime) {
+		if err := r.reload(); err != nil {
+			ErrorLogger.Printf("Cannot reload TLS certificates, keeping the old ones: %s", err)
+		} else {
+			InfoLogger.Printf("Reloaded TLS certificates")
+		}
+	}
+	return r.config, nil
+}
+
+// newTlsConfig returns the TLS configuration of the server or nil if TLS
+// is not configured.
+func newTlsConfig(cfg *engine.Cfg) (*tls.Config, error) {
+	if cfg.TlsCertFile == "" && cfg.TlsKeyFile == "" {
+		if cfg.TlsClientCAFile != "" {
+			return nil, fmt.Errorf("client certificate verification requires TlsCertFile and TlsKeyFile")
+		}
+		return nil, nil
+	}
+
+	r, err := newCertReloader(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetConfigForClient: r.configForClient}, nil
+}
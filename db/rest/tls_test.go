@@ -0,0 +1,167 @@
+package rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopicosql/db/engine"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert creates a certificate signed by parent, a self-signed CA if
+// parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCert) keyPem(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("Cannot marshal key: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.pem, c.keyPem(t))
+	if err != nil {
+		t.Fatalf("Cannot load key pair: %s", err)
+	}
+	return cert
+}
+
+func writeCert(t *testing.T, cfg *engine.Cfg, c *testCert, modTime time.Time) {
+	if err := ioutil.WriteFile(cfg.TlsCertFile, c.pem, 0600); err != nil {
+		t.Fatalf("Cannot write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(cfg.TlsKeyFile, c.keyPem(t), 0600); err != nil {
+		t.Fatalf("Cannot write key: %s", err)
+	}
+	os.Chtimes(cfg.TlsCertFile, modTime, modTime)
+	os.Chtimes(cfg.TlsKeyFile, modTime, modTime)
+}
+
+func TestTlsReloadAndClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	cfg := engine.NewConfigDefault()
+	cfg.TlsCertFile = filepath.Join(dir, "server.crt")
+	cfg.TlsKeyFile = filepath.Join(dir, "server.key")
+	cfg.TlsClientCAFile = filepath.Join(dir, "ca.crt")
+
+	ca := newTestCert(t, "test-ca", nil)
+	ioutil.WriteFile(cfg.TlsClientCAFile, ca.pem, 0600)
+	writeCert(t, cfg, newTestCert(t, "server-1", ca), time.Now().Add(-time.Minute))
+
+	tlsConfig, err := newTlsConfig(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+	}
+	serverName := func(c *http.Client) string {
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			return ""
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	withCert := client(newTestCert(t, "client", ca).tlsCert(t))
+	if name := serverName(withCert); name != "server-1" {
+		t.Errorf("Expected server-1, got '%s'", name)
+	}
+	if _, err := client().Get(srv.URL); err == nil {
+		t.Errorf("Expected a client without certificate to be rejected")
+	}
+	stranger := newTestCert(t, "stranger", newTestCert(t, "other-ca", nil))
+	if _, err := client(stranger.tlsCert(t)).Get(srv.URL); err == nil {
+		t.Errorf("Expected a client with an unknown certificate to be rejected")
+	}
+
+	// a rotated certificate is served to new connections
+	writeCert(t, cfg, newTestCert(t, "server-2", ca), time.Now())
+	if name := serverName(withCert); name != "server-2" {
+		t.Errorf("Expected server-2, got '%s'", name)
+	}
+
+	// a broken rotation keeps the previous certificate
+	ioutil.WriteFile(cfg.TlsKeyFile, []byte("garbage"), 0600)
+	os.Chtimes(cfg.TlsKeyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if name := serverName(withCert); name != "server-2" {
+		t.Errorf("Expected server-2, got '%s'", name)
+	}
+}
+
+func TestTlsConfigErrors(t *testing.T) {
+	cfg := engine.NewConfigDefault()
+	if c, err := newTlsConfig(cfg); c != nil || err != nil {
+		t.Errorf("Expected no TLS by default, got %v %v", c, err)
+	}
+
+	cfg.TlsClientCAFile = "ca.crt"
+	if _, err := newTlsConfig(cfg); err == nil {
+		t.Errorf("Expected an error for client CA without a certificate")
+	}
+
+	cfg.TlsCertFile = filepath.Join(t.TempDir(), "missing.crt")
+	cfg.TlsKeyFile = cfg.TlsCertFile
+	if _, err := newTlsConfig(cfg); err == nil {
+		t.Errorf("Expected an error for missing files")
+	}
+}
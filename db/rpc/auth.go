@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+
+	"gopicosql/db/engine"
+	"gopicosql/db/rpc/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcCodes maps engine error codes to gRPC status codes, anything else is
+// Internal.
+var grpcCodes = map[engine.ErrorCode]codes.Code{
+	engine.ErrSyntax:                codes.InvalidArgument,
+	engine.ErrUndefinedColumn:       codes.InvalidArgument,
+	engine.ErrUndefinedObject:       codes.InvalidArgument,
+	engine.ErrInvalidValue:          codes.InvalidArgument,
+	engine.ErrInvalidParameter:      codes.InvalidArgument,
+	engine.ErrWrongParamCount:       codes.InvalidArgument,
+	engine.ErrUndefinedFunction:     codes.InvalidArgument,
+	engine.ErrDatatypeMismatch:      codes.InvalidArgument,
+	engine.ErrDivisionByZero:        codes.InvalidArgument,
+	engine.ErrGrouping:              codes.InvalidArgument,
+	engine.ErrUndefinedTable:        codes.NotFound,
+	engine.ErrInvalidStatement:      codes.NotFound,
+	engine.ErrNoData:                codes.NotFound,
+	engine.ErrDuplicateTable:        codes.AlreadyExists,
+	engine.ErrDuplicateObject:       codes.AlreadyExists,
+	engine.ErrConstraintViolation:   codes.FailedPrecondition,
+	engine.ErrInvalidAuthorization:  codes.Unauthenticated,
+	engine.ErrInsufficientPrivilege: codes.PermissionDenied,
+	engine.ErrFeatureNotSupported:   codes.Unimplemented,
+	engine.ErrTooManyRequests:       codes.ResourceExhausted,
+	engine.ErrQueryTimeout:          codes.DeadlineExceeded,
+	engine.ErrShutdown:              codes.Unavailable,
+	engine.ErrReadOnly:              codes.Unavailable,
+}
+
+// statusOf converts an engine error into a gRPC status error carrying the
+// engine error code as a pb.Error detail.
+func statusOf(err error) error {
+	code, msg := engine.ErrorCodeOf(err), err.Error()
+	if e, ok := err.(*engine.Error); ok {
+		msg = e.Msg
+	}
+	grpcCode, ok := grpcCodes[code]
+	if !ok {
+		grpcCode = codes.Internal
+	}
+	st := status.New(grpcCode, msg)
+	if withDetails, err := st.WithDetails(&pb.Error{Code: string(code), Message: msg}); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// authenticate resolves the user of a call either from an API key
+// (x-api-key or a bearer token) or from basic credentials in the
+// authorization metadata, the same way the REST API does. As long as no
+// user exists all calls are let through.
+func (s *Server) authenticate(ctx context.Context) (context.Context, error) {
+	if !s.db.AuthEnabled() {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	user, err := s.callUser(md)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return engine.WithUser(ctx, user), nil
+}
+
+func (s *Server) callUser(md metadata.MD) (string, error) {
+	if keys := md.Get("x-api-key"); len(keys) > 0 {
+		return s.db.AuthenticateKey(keys[0])
+	}
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		if strings.HasPrefix(auth[0], "Bearer ") {
+			return s.db.AuthenticateKey(strings.TrimPrefix(auth[0], "Bearer "))
+		}
+		if strings.HasPrefix(auth[0], "Basic ") {
+			creds, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth[0], "Basic "))
+			if i := strings.IndexByte(string(creds), ':'); err == nil && i >= 0 {
+				name := string(creds[:i])
+				return name, s.db.Authenticate(name, string(creds[i+1:]))
+			}
+		}
+	}
+	return "", &engine.Error{Code: engine.ErrInvalidAuthorization, Msg: "authentication required"}
+}
+
+func (s *Server) authenticateUnary(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// userStream passes the authenticated context to streaming handlers.
+type userStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *userStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *Server) authenticateStream(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &userStream{ServerStream: stream, ctx: ctx})
+}
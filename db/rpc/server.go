@@ -0,0 +1,183 @@
+// Package rpc serves the database over gRPC next to the REST API. The
+// service is defined in pb/gopicosql.proto, Go clients use the generated
+// pb.DatabaseClient. Regenerate the stubs with 'make proto'.
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"gopicosql/db/engine"
+	"gopicosql/db/rpc/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// streamBatch is the number of rows sent in a single QueryStream message.
+const streamBatch = 100
+
+// Server implements pb.DatabaseServer on top of the engine.
+type Server struct {
+	pb.UnimplementedDatabaseServer
+	db  *engine.DbEngine
+	cfg *engine.Cfg
+	srv *grpc.Server
+}
+
+func NewServer(db *engine.DbEngine, cfg *engine.Cfg, tlsConfig *tls.Config) *Server {
+	s := &Server{db: db, cfg: cfg}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.authenticateUnary),
+		grpc.StreamInterceptor(s.authenticateStream),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(withHttp2(tlsConfig))))
+	}
+	s.srv = grpc.NewServer(opts...)
+	pb.RegisterDatabaseServer(s.srv, s)
+	return s
+}
+
+// withHttp2 makes sure HTTP/2 is negotiated with ALPN, also by the configs
+// returned from GetConfigForClient.
+func withHttp2(base *tls.Config) *tls.Config {
+	config := base.Clone()
+	config.NextProtos = []string{"h2"}
+	if get := base.GetConfigForClient; get != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := get(hello)
+			if err != nil || c == nil {
+				return c, err
+			}
+			c = c.Clone()
+			c.NextProtos = []string{"h2"}
+			return c, nil
+		}
+	}
+	return config
+}
+
+// Serve accepts connections on ln until Shutdown is called.
+func (s *Server) Serve(ln net.Listener) error {
+	return s.srv.Serve(ln)
+}
+
+// Shutdown stops accepting connections and waits for the calls in
+// progress. If ctx is done first, they are cancelled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.srv.Stop()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) queryCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	if secs := s.cfg.QueryTimeoutSecs; secs > 0 {
+		return context.WithTimeout(ctx, time.Duration(secs)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (s *Server) Query(ctx context.Context, req *pb.QueryRequest) (*pb.QueryResponse, error) {
+	ctx, cancel := s.queryCtx(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, req.Sql, paramsOf(req.Params)...)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	defer rows.Close()
+
+	resp := &pb.QueryResponse{Columns: columnsOf(rows.Columns()), RowsAffected: int64(rows.RowsAffected())}
+	for rows.Next() {
+		row, err := rowOf(rows)
+		if err != nil {
+			return nil, statusOf(err)
+		}
+		resp.Rows = append(resp.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, statusOf(err)
+	}
+	return resp, nil
+}
+
+func (s *Server) Exec(ctx context.Context, req *pb.QueryRequest) (*pb.ExecResponse, error) {
+	ctx, cancel := s.queryCtx(ctx)
+	defer cancel()
+	res, err := s.db.Exec(ctx, req.Sql, paramsOf(req.Params)...)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return &pb.ExecResponse{RowsAffected: int64(res.RowsAffected)}, nil
+}
+
+func (s *Server) QueryStream(req *pb.QueryRequest, stream pb.Database_QueryStreamServer) error {
+	ctx, cancel := s.queryCtx(stream.Context())
+	defer cancel()
+	rows, err := s.db.QueryStream(ctx, req.Sql, paramsOf(req.Params)...)
+	if err != nil {
+		return statusOf(err)
+	}
+	defer rows.Close()
+
+	resp := &pb.QueryResponse{Columns: columnsOf(rows.Columns())}
+	for rows.Next() {
+		row, err := rowOf(rows)
+		if err != nil {
+			return statusOf(err)
+		}
+		resp.Rows = append(resp.Rows, row)
+		if len(resp.Rows) == streamBatch {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			resp = &pb.QueryResponse{}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return statusOf(err)
+	}
+	if len(resp.Rows) > 0 || resp.Columns != nil {
+		return stream.Send(resp)
+	}
+	return nil
+}
+
+func (s *Server) ListTables(ctx context.Context, req *pb.ListTablesRequest) (*pb.ListTablesResponse, error) {
+	user := engine.UserFrom(ctx)
+	resp := &pb.ListTablesResponse{}
+	for _, name := range s.db.Tables() {
+		if s.db.CheckPrivilege(user, name, engine.PrivSelect) != nil {
+			continue
+		}
+		cols, err := s.db.TableColumns(name)
+		if err != nil {
+			// dropped in the meantime
+			continue
+		}
+		resp.Tables = append(resp.Tables, tableOf(name, cols))
+	}
+	return resp, nil
+}
+
+func (s *Server) DescribeTable(ctx context.Context, req *pb.DescribeTableRequest) (*pb.Table, error) {
+	cols, err := s.db.TableColumns(req.Name)
+	if err == nil {
+		err = s.db.CheckPrivilege(engine.UserFrom(ctx), req.Name, engine.PrivSelect)
+	}
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return tableOf(req.Name, cols), nil
+}
@@ -0,0 +1,232 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"gopicosql/db/engine"
+	"gopicosql/db/rpc/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func openTestDb(t *testing.T, cfg *engine.Cfg) *engine.DbEngine {
+	db, err := engine.Open(cfg)
+	if err != nil {
+		t.Fatalf("Cannot open database: %s", err)
+	}
+	t.Cleanup(db.Stop)
+	ctx := context.Background()
+	db.Exec(ctx, "CREATE TABLE t (id INT, name TEXT, ok BOOL, at DATETIME)")
+	db.Exec(ctx, "INSERT INTO t (id, name, ok, at) VALUES ('1', 'a', 'true', '2022-01-06 12:30:00')")
+	db.Exec(ctx, "INSERT INTO t (id, name) VALUES ('2', 'b')")
+	return db
+}
+
+func startTestServer(t *testing.T, db *engine.DbEngine, cfg *engine.Cfg) pb.DatabaseClient {
+	ln := bufconn.Listen(1 << 20)
+	s := NewServer(db, cfg, nil)
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return ln.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Cannot connect: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewDatabaseClient(conn)
+}
+
+func expectCode(t *testing.T, err error, code codes.Code, engineCode engine.ErrorCode) {
+	t.Helper()
+	st := status.Convert(err)
+	if st.Code() != code {
+		t.Fatalf("Expected status %s, got %v", code, err)
+	}
+	details := st.Details()
+	if len(details) != 1 {
+		t.Fatalf("Expected an error detail, got %v", details)
+	}
+	if e, ok := details[0].(*pb.Error); !ok || e.Code != string(engineCode) {
+		t.Errorf("Expected engine code %s, got %v", engineCode, details[0])
+	}
+}
+
+func intValue(v int64) *pb.Value {
+	return &pb.Value{Kind: &pb.Value_Int{Int: v}}
+}
+
+func TestQuery(t *testing.T) {
+	client := startTestServer(t, openTestDb(t, nil), engine.NewConfigDefault())
+	ctx := context.Background()
+
+	resp, err := client.Query(ctx, &pb.QueryRequest{Sql: "SELECT * FROM t WHERE id >= ?", Params: []*pb.Value{intValue(1)}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	wantTypes := []pb.Type{pb.Type_INT, pb.Type_TEXT, pb.Type_BOOL, pb.Type_DATETIME}
+	for i, name := range []string{"id", "name", "ok", "at"} {
+		if c := resp.Columns[i]; c.Name != name || c.Type != wantTypes[i] {
+			t.Errorf("Expected column %s of type %s, got %v", name, wantTypes[i], c)
+		}
+	}
+	if len(resp.Rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(resp.Rows))
+	}
+	first := resp.Rows[0].Values
+	if first[0].GetInt() != 1 || first[1].GetText() != "a" || !first[2].GetBool() {
+		t.Errorf("Unexpected row %v", first)
+	}
+	if at := first[3].GetDatetime().AsTime().Format(engine.DateTimeLayout); at != "2022-01-06 12:30:00" {
+		t.Errorf("Expected 2022-01-06 12:30:00, got %s", at)
+	}
+	if second := resp.Rows[1].Values; second[2].GetKind() != nil || second[3].GetKind() != nil {
+		t.Errorf("Expected NULLs, got %v", second)
+	}
+
+	_, err = client.Query(ctx, &pb.QueryRequest{Sql: "SELECT * FROM nope"})
+	expectCode(t, err, codes.NotFound, engine.ErrUndefinedTable)
+	_, err = client.Query(ctx, &pb.QueryRequest{Sql: "SELEC * FROM t"})
+	expectCode(t, err, codes.InvalidArgument, engine.ErrSyntax)
+}
+
+func TestExec(t *testing.T) {
+	client := startTestServer(t, openTestDb(t, nil), engine.NewConfigDefault())
+	ctx := context.Background()
+
+	resp, err := client.Exec(ctx, &pb.QueryRequest{
+		Sql:    "INSERT INTO t (id, name, ok) VALUES (?, ?, ?)",
+		Params: []*pb.Value{intValue(3), {Kind: &pb.Value_Text{Text: "c"}}, {Kind: &pb.Value_Bool{Bool: false}}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp.RowsAffected != 1 {
+		t.Errorf("Expected 1 affected row, got %d", resp.RowsAffected)
+	}
+
+	resp, err = client.Exec(ctx, &pb.QueryRequest{Sql: "UPDATE t SET name = 'x' WHERE id >= '2'"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp.RowsAffected != 2 {
+		t.Errorf("Expected 2 affected rows, got %d", resp.RowsAffected)
+	}
+
+	_, err = client.Exec(ctx, &pb.QueryRequest{Sql: "CREATE TABLE t (id INT)"})
+	expectCode(t, err, codes.AlreadyExists, engine.ErrDuplicateTable)
+}
+
+func TestQueryStream(t *testing.T) {
+	db := openTestDb(t, nil)
+	client := startTestServer(t, db, engine.NewConfigDefault())
+	ctx := context.Background()
+	for i := 3; i <= 2*streamBatch+10; i++ {
+		if _, err := db.Exec(ctx, fmt.Sprintf("INSERT INTO t (id, name) VALUES ('%d', 'n')", i)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	stream, err := client.QueryStream(ctx, &pb.QueryRequest{Sql: "SELECT id FROM t"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var batches, rows int
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if (batches == 0) != (len(resp.Columns) == 1) {
+			t.Errorf("Expected columns in the first message only, got %v in message %d", resp.Columns, batches)
+		}
+		batches++
+		rows += len(resp.Rows)
+	}
+	if batches != 3 || rows != 2*streamBatch+10 {
+		t.Errorf("Expected %d rows in 3 messages, got %d in %d", 2*streamBatch+10, rows, batches)
+	}
+}
+
+func TestTables(t *testing.T) {
+	db := openTestDb(t, nil)
+	db.Exec(context.Background(), "CREATE TABLE u (name TEXT, age INT)")
+	client := startTestServer(t, db, engine.NewConfigDefault())
+	ctx := context.Background()
+
+	resp, err := client.ListTables(ctx, &pb.ListTablesRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(resp.Tables) != 2 {
+		t.Fatalf("Expected 2 tables, got %v", resp.Tables)
+	}
+
+	table, err := client.DescribeTable(ctx, &pb.DescribeTableRequest{Name: "u"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if table.PrimaryKey != "name" || len(table.Columns) != 2 || table.Columns[1].Type != pb.Type_INT {
+		t.Errorf("Unexpected table %v", table)
+	}
+
+	_, err = client.DescribeTable(ctx, &pb.DescribeTableRequest{Name: "nope"})
+	expectCode(t, err, codes.NotFound, engine.ErrUndefinedTable)
+}
+
+func TestAuthentication(t *testing.T) {
+	cfg := engine.NewConfigDefault()
+	cfg.DbDir = t.TempDir()
+	db := openTestDb(t, cfg)
+	if err := db.CreateUser("root", "s3cret", true); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := db.CreateUser("bob", "pw", false); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	client := startTestServer(t, db, cfg)
+	req := &pb.QueryRequest{Sql: "SELECT * FROM t"}
+
+	_, err := client.Query(context.Background(), req)
+	expectCode(t, err, codes.Unauthenticated, engine.ErrInvalidAuthorization)
+
+	basic := func(user, password string) context.Context {
+		creds := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic "+creds)
+	}
+	_, err = client.Query(basic("root", "wrong"), req)
+	expectCode(t, err, codes.Unauthenticated, engine.ErrInvalidAuthorization)
+	if _, err := client.Query(basic("root", "s3cret"), req); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	_, err = client.Query(basic("bob", "pw"), req)
+	expectCode(t, err, codes.PermissionDenied, engine.ErrInsufficientPrivilege)
+	tables, err := client.ListTables(basic("bob", "pw"), &pb.ListTablesRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(tables.Tables) != 0 {
+		t.Errorf("Expected no readable tables, got %v", tables.Tables)
+	}
+
+	stream, err := client.QueryStream(basic("bob", "wrong"), req)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	expectCode(t, err, codes.Unauthenticated, engine.ErrInvalidAuthorization)
+}
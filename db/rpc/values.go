@@ -0,0 +1,87 @@
+package rpc
+
+import (
+	"time"
+
+	"gopicosql/db/engine"
+	"gopicosql/db/rpc/pb"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func typeOf(ft engine.FieldType) pb.Type {
+	switch ft {
+	case engine.TEXT:
+		return pb.Type_TEXT
+	case engine.INT:
+		return pb.Type_INT
+	case engine.BOOL:
+		return pb.Type_BOOL
+	case engine.DATETIME:
+		return pb.Type_DATETIME
+	default:
+		return pb.Type_UNKNOWN
+	}
+}
+
+func columnsOf(cols []engine.Column) []*pb.Column {
+	res := make([]*pb.Column, len(cols))
+	for i, c := range cols {
+		res[i] = &pb.Column{Name: c.Name, Type: typeOf(c.Type)}
+	}
+	return res
+}
+
+func tableOf(name string, cols []engine.Column) *pb.Table {
+	t := &pb.Table{Name: name, Columns: columnsOf(cols)}
+	if len(cols) > 0 {
+		t.PrimaryKey = cols[0].Name
+	}
+	return t
+}
+
+// valueOf converts a value returned by engine.Rows.Values.
+func valueOf(v interface{}) *pb.Value {
+	switch v := v.(type) {
+	case string:
+		return &pb.Value{Kind: &pb.Value_Text{Text: v}}
+	case int64:
+		return &pb.Value{Kind: &pb.Value_Int{Int: v}}
+	case bool:
+		return &pb.Value{Kind: &pb.Value_Bool{Bool: v}}
+	case time.Time:
+		return &pb.Value{Kind: &pb.Value_Datetime{Datetime: timestamppb.New(v)}}
+	default:
+		return &pb.Value{}
+	}
+}
+
+func rowOf(rows *engine.Rows) (*pb.Row, error) {
+	vals, err := rows.Values()
+	if err != nil {
+		return nil, err
+	}
+	row := &pb.Row{Values: make([]*pb.Value, len(vals))}
+	for i, v := range vals {
+		row.Values[i] = valueOf(v)
+	}
+	return row, nil
+}
+
+// paramsOf converts request parameters into arguments for the engine.
+func paramsOf(params []*pb.Value) []interface{} {
+	args := make([]interface{}, len(params))
+	for i, p := range params {
+		switch k := p.GetKind().(type) {
+		case *pb.Value_Text:
+			args[i] = k.Text
+		case *pb.Value_Int:
+			args[i] = k.Int
+		case *pb.Value_Bool:
+			args[i] = k.Bool
+		case *pb.Value_Datetime:
+			args[i] = k.Datetime.AsTime()
+		}
+	}
+	return args
+}
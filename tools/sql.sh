@@ -10,5 +10,15 @@ fail() {
 
 command -v curl > /dev/null || fail "Curl not installed"
 
-curl -X POST $HOST:$PORT/query -d "sql=$1"
+# usage: [FORMAT=csv|tsv|text] sql.sh "<SQL>" [PARAM...]
+SQL="$1"
+shift
+
+# rewrite remaining arguments into curl options
+for p in "$@"; do
+    set -- "$@" --data-urlencode "params=$p"
+    shift
+done
+
+curl -X POST "$HOST:$PORT/query?format=${FORMAT:-json}" --data-urlencode "sql=$SQL" "$@"
 echo
\ No newline at end of file